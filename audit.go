@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/client"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/https"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Issues found by audit.
+const (
+	issueMissing    = "missing"
+	issueUnexpected = "unexpected"
+	issueMismatch   = "mismatch"
+	// skipped and protected pods are left unchanged by the webhook, they
+	// are reported but not counted as issues.
+	issueSkipped   = "skipped"
+	issueProtected = "protected"
+)
+
+// finding is a pod whose eni-ip does not agree with the webhook, or which
+// the webhook leaves unchanged.
+type finding struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Node      string `json:"node,omitempty"`
+	Issue     string `json:"issue"`
+	// Expected and Actual are the eni-ip limits summed over containers.
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+	Reason   string `json:"reason"`
+}
+
+// eniIP returns resource name, eni-ip unless a policy says otherwise, limited
+// by containers of pod, and whether any request of it differs from its limit.
+func eniIP(pod *corev1.Pod, name corev1.ResourceName) (total resource.Quantity, found bool, inconsistent bool) {
+	for _, c := range pod.Spec.Containers {
+		limit, hasLimit := c.Resources.Limits[name]
+		request, hasRequest := c.Resources.Requests[name]
+		if hasLimit {
+			total.Add(limit)
+		}
+		if hasRequest && (!hasLimit || request.Cmp(limit) != 0) {
+			inconsistent = true
+		}
+		found = found || hasLimit || hasRequest
+	}
+	return total, found, inconsistent
+}
+
+// auditPod returns the issue of pod, nil if it agrees with the webhook. The
+// pod is running rather than being admitted, its nodes and headroom are not
+// checked.
+func auditPod(hs https.HttpsServer, pod *corev1.Pod) (*finding, error) {
+	result, err := hs.ExplainRunning(pod)
+	if err != nil {
+		return nil, err
+	}
+	f := &finding{
+		Namespace: pod.Namespace,
+		Name:      pod.Name,
+		Node:      pod.Spec.NodeName,
+		Expected:  "0",
+		Reason:    result.Reason,
+	}
+	name := corev1.ResourceName(https.UnderlayIPResource)
+	if result.Inject {
+		f.Expected = result.Quantity
+		f.Reason = fmt.Sprintf("%s, networks from %s", https.TKERouteENI, result.NetworksSource)
+		if result.Policy != "" {
+			f.Reason = fmt.Sprintf("EniIPPolicy %s", result.Policy)
+		}
+		name = result.Resource
+	}
+	total, found, inconsistent := eniIP(pod, name)
+	f.Actual = total.String()
+
+	switch {
+	case result.Protected:
+		f.Issue, f.Expected = issueProtected, f.Actual
+	case result.Skipped:
+		f.Issue, f.Expected = issueSkipped, f.Actual
+	case result.Inject && !found:
+		f.Issue = issueMissing
+	case !result.Inject && found:
+		f.Issue = issueUnexpected
+	case result.Inject && (total.Cmp(resource.MustParse(result.Quantity)) != 0 || inconsistent):
+		f.Issue = issueMismatch
+	default:
+		return nil, nil
+	}
+	return f, nil
+}
+
+func (f *finding) isIssue() bool {
+	return f.Issue != issueSkipped && f.Issue != issueProtected
+}
+
+func listPods(cs kubernetes.Interface, namespace string) ([]corev1.Pod, error) {
+	var pods []corev1.Pod
+	opts := metav1.ListOptions{Limit: 500}
+	for {
+		list, err := cs.CoreV1().Pods(namespace).List(opts)
+		if err != nil {
+			return nil, err
+		}
+		pods = append(pods, list.Items...)
+		if list.Continue == "" {
+			return pods, nil
+		}
+		opts.Continue = list.Continue
+	}
+}
+
+// auditCommand reports running pods whose eni-ip does not agree with the
+// webhook, e.g. pods created while the webhook was down.
+func auditCommand(args []string) int {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	var output, namespace string
+	var includeCompleted bool
+	var syncTimeout time.Duration
+	fs.StringVar(&output, "o", "table", "Output format, one of table and json.")
+	fs.StringVar(&namespace, "namespace", metav1.NamespaceAll, "Only audit pods in namespace.")
+	fs.BoolVar(&includeCompleted, "include-completed", false, "Whether to audit succeeded and failed pods, they no longer hold eni-ip.")
+	fs.DurationVar(&syncTimeout, "sync-timeout", time.Minute, "How long to wait for namespaces, nodes and policies to be listed.")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [webhook flags] audit [flags]\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Webhook flags like --kubeconfig and --default-cni-source decide how pods are expected to be mutated.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if output != "table" && output != "json" {
+		fmt.Fprintf(os.Stderr, "unknown output format %q\n", output)
+		return 2
+	}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	wh := newWebhook(false, stopCh)
+	timeout := make(chan struct{})
+	timer := time.AfterFunc(syncTimeout, func() { close(timeout) })
+	defer timer.Stop()
+	for _, inf := range wh.informers {
+		if !inf.WaitForSync(timeout) {
+			fmt.Fprintf(os.Stderr, "%s are not listed in %s\n", inf.Name(), syncTimeout)
+			return 1
+		}
+	}
+	for _, check := range wh.checks {
+		if msg := check(); msg != "" {
+			fmt.Fprintf(os.Stderr, "warning: %s\n", msg)
+		}
+	}
+	hs := https.NewHttpsServer(wh.options)
+
+	cs, err := client.GetKubeClient(config.InCluster, config.Master, config.KubeConfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to get kube client: %v\n", err)
+		return 1
+	}
+	pods, err := listPods(cs, namespace)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to list pods: %v\n", err)
+		return 1
+	}
+	findings := []*finding{}
+	issues := 0
+	for i := range pods {
+		pod := &pods[i]
+		if !includeCompleted && (pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed) {
+			continue
+		}
+		f, err := auditPod(hs, pod)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to audit pod %s/%s: %v\n", pod.Namespace, pod.Name, err)
+			continue
+		}
+		if f != nil {
+			findings = append(findings, f)
+		}
+		if f != nil && f.isIssue() {
+			issues++
+		}
+	}
+	sort.Slice(findings, func(i, j int) bool {
+		if findings[i].Namespace != findings[j].Namespace {
+			return findings[i].Namespace < findings[j].Namespace
+		}
+		return findings[i].Name < findings[j].Name
+	})
+
+	if output == "json" {
+		data, _ := json.MarshalIndent(findings, "", "  ")
+		fmt.Println(string(data))
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "NAMESPACE\tNAME\tNODE\tISSUE\tEXPECTED\tACTUAL\tREASON")
+		for _, f := range findings {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", f.Namespace, f.Name, f.Node, f.Issue, f.Expected, f.Actual, f.Reason)
+		}
+		w.Flush()
+	}
+	fmt.Fprintf(os.Stderr, "audited %d pods, %d issues found, %d skipped or protected\n", len(pods), issues, len(findings)-issues)
+	if issues > 0 {
+		return 1
+	}
+	return 0
+}
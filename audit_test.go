@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/https"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// noNodes has no node advertising eni-ip nor headroom, checking them would
+// skip every pod, running pods are not checked.
+type noNodes struct{}
+
+func (noNodes) HasEligibleNode(pod *corev1.Pod) (bool, bool) { return false, true }
+func (noNodes) Headroom(pod *corev1.Pod) (int64, bool)       { return 0, true }
+
+type virtualNodeName struct{}
+
+func (virtualNodeName) VirtualNode(pod *corev1.Pod) (string, bool) {
+	return "nodeName", pod.Spec.NodeName == "eklet-1"
+}
+
+func (virtualNodeName) MayRunOnVirtualNode(pod *corev1.Pod) (string, bool) {
+	return "", false
+}
+
+// auditedPod returns a pod on node-1 whose containers limit and request
+// quantities of eni-ip, empty for none.
+func auditedPod(namespace string, networks string, limits ...string) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "pod"},
+		Spec:       corev1.PodSpec{NodeName: "node-1"},
+	}
+	if networks != "" {
+		pod.Annotations = map[string]string{https.CNINetworksAnnotation: networks}
+	}
+	for _, limit := range limits {
+		c := corev1.Container{Name: "c"}
+		if limit != "" {
+			q := resource.MustParse(limit)
+			c.Resources.Limits = corev1.ResourceList{https.UnderlayIPResource: q}
+			c.Resources.Requests = corev1.ResourceList{https.UnderlayIPResource: q}
+		}
+		pod.Spec.Containers = append(pod.Spec.Containers, c)
+	}
+	return pod
+}
+
+func TestAuditPod(t *testing.T) {
+	hs := https.NewHttpsServer(https.Options{
+		DefaultCNI:          &staticDefaults{defaultCNI: true, defaultNetworks: https.TKERouteENI},
+		NodeEligibility:     noNodes{},
+		NodeCheck:           https.NodeCheckSkip,
+		Headroom:            noNodes{},
+		HeadroomCheck:       https.HeadroomCheckReject,
+		VirtualNodes:        virtualNodeName{},
+		ProtectedNamespaces: []string{"kube-system"},
+	})
+	inconsistent := auditedPod("default", "", "1")
+	inconsistent.Spec.Containers[0].Resources.Requests[https.UnderlayIPResource] = resource.MustParse("2")
+	onVirtualNode := auditedPod("default", "", "1")
+	onVirtualNode.Spec.NodeName = "eklet-1"
+	tests := []struct {
+		name     string
+		pod      *corev1.Pod
+		issue    string
+		expected string
+		actual   string
+	}{
+		{name: "injected", pod: auditedPod("default", "", "1", "")},
+		{name: "missing", pod: auditedPod("default", "", ""), issue: issueMissing, expected: "1", actual: "0"},
+		{name: "unexpected", pod: auditedPod("default", "tke-bridge", "1"), issue: issueUnexpected, expected: "0", actual: "1"},
+		{name: "not tke-route-eni", pod: auditedPod("default", "tke-bridge", "")},
+		{name: "mismatch", pod: auditedPod("default", "", "1", "1"), issue: issueMismatch, expected: "1", actual: "2"},
+		{name: "request differs from limit", pod: inconsistent, issue: issueMismatch, expected: "1", actual: "1"},
+		{name: "skipped", pod: onVirtualNode, issue: issueSkipped, expected: "1", actual: "1"},
+		{name: "protected", pod: auditedPod("kube-system", "", ""), issue: issueProtected, expected: "0", actual: "0"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f, err := auditPod(hs, test.pod)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f == nil {
+				if test.issue != "" {
+					t.Errorf("no finding, want %s", test.issue)
+				}
+				return
+			}
+			if f.Issue != test.issue || f.Expected != test.expected || f.Actual != test.actual {
+				t.Errorf("finding %s expected %s actual %s, want %s expected %s actual %s (%s)",
+					f.Issue, f.Expected, f.Actual, test.issue, test.expected, test.actual, f.Reason)
+			}
+			if issue := test.issue != issueSkipped && test.issue != issueProtected; f.isIssue() != issue {
+				t.Errorf("isIssue = %v, want %v", f.isIssue(), issue)
+			}
+		})
+	}
+}
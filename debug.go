@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/x509"
+	"net"
+	"net/http"
+	"time"
+
+	wenhookconfig "github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/config"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/debug"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/policy"
+
+	"github.com/golang/glog"
+)
+
+// debugState is the effective state of the webhook served on /debug/config.
+type debugState struct {
+	Version     string            `json:"version"`
+	Config      Config            `json:"config"`
+	DefaultCNI  debugDefaultCNI   `json:"defaultCNI"`
+	Certificate *debugCertificate `json:"certificate,omitempty"`
+	Policies    []policy.Snapshot `json:"policies,omitempty"`
+	Degraded    []string          `json:"degraded,omitempty"`
+}
+
+type debugDefaultCNI struct {
+	Value    bool   `json:"value"`
+	Source   string `json:"source,omitempty"`
+	Networks string `json:"networks,omitempty"`
+}
+
+type debugCertificate struct {
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	DNSNames  []string  `json:"dnsNames,omitempty"`
+	Serial    string    `json:"serial"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+}
+
+// loopback returns whether addr only listens on loopback interfaces.
+func loopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// runDebug serves the debug handler on config.DebugListen.
+func runDebug(wh *webhook, cert *certificate) {
+	if config.DebugTokenFile == "" {
+		glog.Fatal("debug-listen needs debug-token-file, debug endpoints expose the configuration and profiles")
+	}
+	// the token is sent in plain text, it only stays in the pod on loopback
+	if !loopback(config.DebugListen) {
+		glog.Fatalf("debug-listen %s is not a loopback address, debug endpoints are served over plain HTTP, reach them by port-forward instead", config.DebugListen)
+	}
+	handler := debug.NewHandler(debug.Options{
+		TokenFile: config.DebugTokenFile,
+		State: func() interface{} {
+			return wh.debugState(cert)
+		},
+		Handlers: map[string]http.Handler{"/simulate": simulateHandler(wh.server)},
+	})
+	go func() {
+		glog.Fatal(http.ListenAndServe(config.DebugListen, handler))
+	}()
+}
+
+func (wh *webhook) debugState(cert *certificate) *debugState {
+	c, opts := wh.effective()
+	state := &debugState{Version: version, Config: c}
+	state.DefaultCNI.Value = opts.DefaultCNI.DefaultCNI()
+	if s, ok := opts.DefaultCNI.(*wenhookconfig.State); ok {
+		state.DefaultCNI.Source = s.Source()
+		state.DefaultCNI.Networks = s.DefaultNetworks()
+	}
+	if leaf := cert.leaf(); leaf != nil {
+		state.Certificate = &debugCertificate{
+			Subject:   leaf.Subject.String(),
+			Issuer:    leaf.Issuer.String(),
+			DNSNames:  leaf.DNSNames,
+			Serial:    leaf.SerialNumber.String(),
+			NotBefore: leaf.NotBefore,
+			NotAfter:  leaf.NotAfter,
+		}
+	}
+	if wh.policies != nil {
+		state.Policies = wh.policies.Snapshot()
+	}
+	for _, check := range wh.checks {
+		if msg := check(); msg != "" {
+			state.Degraded = append(state.Degraded, msg)
+		}
+	}
+	return state
+}
+
+// leaf returns the parsed certificate in effect, nil if it fails to parse.
+func (s *certificate) leaf() *x509.Certificate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.cert == nil || len(s.cert.Certificate) == 0 {
+		return nil
+	}
+	leaf, err := x509.ParseCertificate(s.cert.Certificate[0])
+	if err != nil {
+		return nil
+	}
+	return leaf
+}
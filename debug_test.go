@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestLoopback(t *testing.T) {
+	tests := []struct {
+		addr     string
+		loopback bool
+	}{
+		{"127.0.0.1:6060", true},
+		{"127.0.0.2:6060", true},
+		{"localhost:6060", true},
+		{"[::1]:6060", true},
+		{":6060", false},
+		{"0.0.0.0:6060", false},
+		{"10.0.0.1:6060", false},
+		{"example.com:6060", false},
+		{"127.0.0.1", false},
+	}
+	for _, test := range tests {
+		if loopback := loopback(test.addr); loopback != test.loopback {
+			t.Errorf("%s: expect loopback %t, got %t", test.addr, test.loopback, loopback)
+		}
+	}
+}
@@ -3,27 +3,51 @@ package main
 import (
 	"crypto/tls"
 	"flag"
+	"fmt"
 	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/capacity"
 	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/client"
 	wenhookconfig "github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/config"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/configfile"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/events"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/health"
 	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/https"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/informer"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/leaderelection"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/logging"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/metrics"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/namespace"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/node"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/policy"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/protection"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/readiness"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/reconciler"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/recorder"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/tracing"
 
 	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
 )
 
 var (
 	version string
 	config  Config
+	// admissions holds the admission paths served, mutations of other
+	// features may be registered on them in init functions.
+	admissions = https.NewRegistry()
 )
 
-func configTLS(config Config) *tls.Config {
-	sCert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
-	if err != nil {
-		glog.Fatal(err)
-	}
+func configTLS(cert *certificate) *tls.Config {
 	return &tls.Config{
-		Certificates: []tls.Certificate{sCert},
+		GetCertificate: cert.get,
 		// TODO: uses mutual tls after we agree on what cert the apiserver should use.
 		// ClientAuth:   tls.RequireAndVerifyClientCert,
 	}
@@ -38,6 +62,68 @@ type Config struct {
 	KubeConfig string
 	PresetMode bool
 	DefaultCNI bool
+	CNISource  wenhookconfig.Options
+	CNITimeout time.Duration
+
+	NamespaceDefaults bool
+	PinNetworks       bool
+	NodeCheck         string
+
+	VirtualNodeSelectors   string
+	VirtualNodeTolerations string
+	VirtualNodeAnnotations string
+
+	Reconcile             bool
+	ReconcilePeriod       time.Duration
+	ReconcileDeletePods   bool
+	ReconcileMaxDeletions int
+	LeaderElectNamespace  string
+	LeaderElectName       string
+
+	ProtectedNamespaces   string
+	WebhookConfigurations string
+	ProtectionCheckPeriod time.Duration
+
+	Policies           bool
+	PolicyStatusPeriod time.Duration
+
+	HeartbeatLeaseName  string
+	HeartbeatPeriod     time.Duration
+	HeartbeatCAFile     string
+	HeartbeatServerName string
+
+	CapacityMetrics bool
+	CapacityPeriod  time.Duration
+	NodePoolLabel   string
+	HeadroomCheck   string
+
+	StripStale bool
+
+	ReadinessGate          string
+	ENICIDRs               string
+	ENICIDRsNodeAnnotation string
+
+	LogFormat string
+
+	DebugListen    string
+	DebugTokenFile string
+
+	TracingEndpoint    string
+	TracingSampleRatio float64
+
+	RecordFile        string
+	RecordMaxBytes    int64
+	RecordMaxFiles    int
+	RecordSampleRatio float64
+	RecordNamespaces  string
+	RecordDecisions   string
+	RecordRedact      string
+
+	ConfigFile        string
+	ConfigCheckPeriod time.Duration
+	// Resource and Quantity are only set by the configuration file.
+	Resource corev1.ResourceName
+	Quantity *resource.Quantity
 }
 
 func (c *Config) addFlags() {
@@ -50,40 +136,437 @@ func (c *Config) addFlags() {
 	flag.StringVar(&c.Master, "master", c.Master, "The address of the Kubernetes API server (overrides any value in kubeconfig).")
 	flag.StringVar(&c.KubeConfig, "kubeconfig", c.KubeConfig, "Path to kubeconfig file with authorization and master location information.")
 	flag.BoolVar(&c.PresetMode, "preset-mode", c.PresetMode, "Whether webhook running on preset mode.")
-	flag.BoolVar(&c.DefaultCNI, "default-cni", c.DefaultCNI, "Whether tke-route-eni is default-cni(need preset-mode=true).")
+	flag.BoolVar(&c.DefaultCNI, "default-cni", c.DefaultCNI, "Whether tke-route-eni is default-cni(need preset-mode=true or default-cni-source=value).")
+	flag.StringVar(&c.CNISource.Source, "default-cni-source", c.CNISource.Source, "Where to determine whether tke-route-eni is default-cni, one of configmap, file and value. preset-mode=true implies value.")
+	flag.StringVar(&c.CNISource.ConfigMapNamespace, "multus-configmap-namespace", c.CNISource.ConfigMapNamespace, "Namespace of the configmap containing multus config(default-cni-source=configmap).")
+	flag.StringVar(&c.CNISource.ConfigMapName, "multus-configmap-name", c.CNISource.ConfigMapName, "Name of the configmap containing multus config(default-cni-source=configmap).")
+	flag.StringVar(&c.CNISource.ConfigMapKey, "multus-configmap-key", c.CNISource.ConfigMapKey, "Key of the configmap containing multus config(default-cni-source=configmap).")
+	flag.StringVar(&c.CNISource.File, "multus-conf-file", c.CNISource.File, "Path of the multus config file(default-cni-source=file).")
+	flag.DurationVar(&c.CNITimeout, "default-cni-timeout", c.CNITimeout, "How long to wait for default-cni-source on startup before falling back to --default-cni, 0 means waiting forever. The source keeps being resolved in background after falling back.")
+	flag.BoolVar(&c.NamespaceDefaults, "namespace-default-networks", c.NamespaceDefaults, "Whether pods without networks annotation use the networks annotated on their namespace by "+namespace.DefaultNetworksAnnotation+" before falling back to default-cni.")
+	flag.BoolVar(&c.PinNetworks, "pin-networks", c.PinNetworks, "Whether to write the networks resolved from namespace or cluster default into "+https.CNINetworksAnnotation+" of pods without it.")
+	flag.StringVar(&c.NodeCheck, "node-check", https.NodeCheckOff, "What to do with "+https.TKERouteENI+" pods when no node matching their nodeSelector and required node affinity advertises "+https.UnderlayIPResource+", one of off, skip and reject.")
+	flag.StringVar(&c.VirtualNodeSelectors, "virtual-node-selectors", c.VirtualNodeSelectors, "Comma separated key=value or key labels of virtual nodes, pods selecting them by nodeSelector or required node affinity, or bound to them by nodeName if nodes are watched, are not injected, e.g. type=virtual-kubelet,node.kubernetes.io/instance-type=eklet.")
+	flag.StringVar(&c.VirtualNodeTolerations, "virtual-node-tolerations", c.VirtualNodeTolerations, "Comma separated taint keys of virtual nodes, pods tolerating them are still injected with a warning since they may run on other nodes, e.g. virtual-kubelet.io/provider.")
+	flag.StringVar(&c.VirtualNodeAnnotations, "virtual-node-annotations", c.VirtualNodeAnnotations, "Comma separated key=value or key pod annotations marking pods bound for virtual nodes besides "+node.VirtualNodeAnnotation+"=true, they are not injected.")
+	flag.BoolVar(&c.Reconcile, "reconcile", c.Reconcile, "Whether to run the controller finding "+https.TKERouteENI+" pods admitted without "+https.UnderlayIPResource+", e.g. while the webhook was unavailable. Only the leader of the lease runs it, pods in namespaces the namespaceSelectors of webhook-configurations exclude are ignored.")
+	flag.DurationVar(&c.ReconcilePeriod, "reconcile-period", c.ReconcilePeriod, "How often the controller checks all pods(reconcile=true).")
+	flag.BoolVar(&c.ReconcileDeletePods, "reconcile-delete-pods", c.ReconcileDeletePods, "Whether the controller deletes pods without "+https.UnderlayIPResource+" owned by a controller, so that they are re-created through the webhook(reconcile=true). Only pods using "+https.TKERouteENI+" by their own networks annotation are deleted, pods using it by namespace or cluster defaults are only reported.")
+	flag.IntVar(&c.ReconcileMaxDeletions, "reconcile-max-deletions", c.ReconcileMaxDeletions, "How many pods the controller deletes at most every period(reconcile-delete-pods=true).")
+	flag.StringVar(&c.LeaderElectNamespace, "leader-elect-namespace", c.LeaderElectNamespace, "Namespace of the lease electing the controller leader, defaults to $POD_NAMESPACE or kube-system(reconcile=true).")
+	flag.StringVar(&c.LeaderElectName, "leader-elect-name", c.LeaderElectName, "Name of the lease electing the controller leader(reconcile=true).")
+	flag.StringVar(&c.ProtectedNamespaces, "protected-namespaces", c.ProtectedNamespaces, "Comma separated namespaces admitted unchanged besides $POD_NAMESPACE, the one of the webhook itself. The webhook verifies namespaceSelectors of webhook-configurations exclude them on startup and every protection-check-period.")
+	flag.StringVar(&c.WebhookConfigurations, "webhook-configurations", c.WebhookConfigurations, "Comma separated names of the MutatingWebhookConfigurations of the webhook, whose namespaceSelectors are verified, empty disables the verification.")
+	flag.DurationVar(&c.ProtectionCheckPeriod, "protection-check-period", c.ProtectionCheckPeriod, "How often namespaceSelectors are verified to exclude protected namespaces.")
+	flag.BoolVar(&c.Policies, "policies", c.Policies, "Whether pods are decided by EniIPPolicies before their networks, see deploy/eniippolicy-crd.yaml.")
+	flag.DurationVar(&c.PolicyStatusPeriod, "policy-status-period", c.PolicyStatusPeriod, "How often admissions matched by EniIPPolicies are added to their status(policies=true).")
+	flag.StringVar(&c.HeartbeatLeaseName, "heartbeat-lease-name", c.HeartbeatLeaseName, "Lease in leader-elect-namespace renewed by every replica serving admissions, empty disables it. The watchdog command flips the failure policy to Ignore once it goes stale, e.g. "+defaultHeartbeatLeaseName+".")
+	flag.DurationVar(&c.HeartbeatPeriod, "heartbeat-period", c.HeartbeatPeriod, "How often the heartbeat lease is renewed(heartbeat-lease-name is set).")
+	flag.StringVar(&c.HeartbeatCAFile, "heartbeat-ca-file", c.HeartbeatCAFile, "CA bundle the apiserver verifies the serving certificate with, i.e. caBundle of the webhook configurations, the lease is only renewed while the certificate is valid against it(heartbeat-lease-name is set).")
+	flag.StringVar(&c.HeartbeatServerName, "heartbeat-server-name", c.HeartbeatServerName, "DNS name of the webhook service the serving certificate is verified for, defaults to add-pod-eni-ip-limit-webhook.<leader-elect-namespace>.svc(heartbeat-lease-name is set).")
+	flag.BoolVar(&c.CapacityMetrics, "capacity-metrics", c.CapacityMetrics, "Whether to export allocatable, requested and free "+https.UnderlayIPResource+" of nodes and node pools, and pods pending for it, on /metrics.")
+	flag.DurationVar(&c.CapacityPeriod, "capacity-period", c.CapacityPeriod, "How often capacity metrics are computed(capacity-metrics=true).")
+	flag.StringVar(&c.NodePoolLabel, "node-pool-label", c.NodePoolLabel, "Label of nodes naming their node pool(capacity-metrics=true).")
+	flag.BoolVar(&c.StripStale, "strip-stale", c.StripStale, "Whether to remove "+https.UnderlayIPResource+" from limits and requests of pods not using "+https.TKERouteENI+", including hostNetwork pods, they can not be scheduled onto nodes without it otherwise.")
+	flag.StringVar(&c.ReadinessGate, "readiness-gate", c.ReadinessGate, "Readiness gate added to "+https.TKERouteENI+" pods if not empty, e.g. "+readiness.DefaultConditionType+". The controller sets the condition once pod IP is in an ENI subnet, only the leader of the lease runs it.")
+	flag.StringVar(&c.ENICIDRs, "eni-cidrs", c.ENICIDRs, "Comma separated ENI subnets of all nodes(readiness-gate is set).")
+	flag.StringVar(&c.ENICIDRsNodeAnnotation, "eni-cidrs-node-annotation", c.ENICIDRsNodeAnnotation, "Annotation of nodes holding their comma separated ENI subnets, used besides eni-cidrs(readiness-gate is set).")
+	flag.StringVar(&c.LogFormat, "log-format", logging.FormatText, "Format of admission logs, one of text, logged by glog with key=value fields, and json, written to stdout one object per line. Other logs are always glog.")
+	flag.StringVar(&c.DebugListen, "debug-listen", c.DebugListen, "Loopback address of the debug listener serving /debug/config, /debug/loglevel and /debug/pprof/ over plain HTTP, empty disables it, e.g. 127.0.0.1:6060.")
+	flag.StringVar(&c.DebugTokenFile, "debug-token-file", c.DebugTokenFile, "File holding the bearer token debug clients must send, read on every request(debug-listen is set).")
+	flag.StringVar(&c.TracingEndpoint, "tracing-endpoint", c.TracingEndpoint, "OTLP/HTTP endpoint of a collector receiving spans of admission requests in JSON, spans are posted to its /v1/traces unless it has a path, empty disables tracing, e.g. http://localhost:4318.")
+	flag.Float64Var(&c.TracingSampleRatio, "tracing-sample-ratio", c.TracingSampleRatio, "Ratio of admission requests traced if the apiserver sends no sampled traceparent header, requests with one follow it(tracing-endpoint is set).")
+	flag.StringVar(&c.RecordFile, "record-file", c.RecordFile, "File admissions are recorded to one JSON object per line, for the replay command, empty disables recording. It is rotated to record-file.1 and so on once it exceeds record-max-bytes.")
+	flag.Int64Var(&c.RecordMaxBytes, "record-max-bytes", c.RecordMaxBytes, "Size of the record file at which it is rotated(record-file is set).")
+	flag.IntVar(&c.RecordMaxFiles, "record-max-files", c.RecordMaxFiles, "How many rotated record files are kept(record-file is set).")
+	flag.Float64Var(&c.RecordSampleRatio, "record-sample-ratio", c.RecordSampleRatio, "Ratio of admissions passing record-namespaces and record-decisions recorded(record-file is set).")
+	flag.StringVar(&c.RecordNamespaces, "record-namespaces", c.RecordNamespaces, "Comma separated namespaces whose admissions are recorded, empty records all(record-file is set).")
+	flag.StringVar(&c.RecordDecisions, "record-decisions", c.RecordDecisions, "Comma separated decisions recorded, some of allowed, patched, denied and error, empty records all(record-file is set).")
+	flag.StringVar(&c.RecordRedact, "record-redact", c.RecordRedact, "Comma separated redactions of recorded requests, some of env, last-applied and command, or none(record-file is set).")
+	flag.StringVar(&c.ConfigFile, "config", c.ConfigFile, "Versioned YAML configuration file overriding flags, see deploy/webhook-config.yaml. Its changes are applied while serving, an invalid change is logged and the configuration in effect is kept.")
+	flag.DurationVar(&c.ConfigCheckPeriod, "config-check-period", c.ConfigCheckPeriod, "How often the configuration file and the files of the serving certificate are checked for changes.")
+	flag.StringVar(&c.HeadroomCheck, "headroom-check", https.HeadroomCheckOff, "What to do with "+https.TKERouteENI+" pods when nodes matching their nodeSelector and required node affinity have no free "+https.UnderlayIPResource+", one of off, warn and reject. Free "+https.UnderlayIPResource+" is computed every capacity-period.")
+}
+
+// protectedNamespaces returns namespaces never mutated, including the one of
+// the webhook itself.
+func (c *Config) protectedNamespaces() []string {
+	var namespaces []string
+	if own := os.Getenv("POD_NAMESPACE"); own != "" {
+		namespaces = append(namespaces, own)
+	}
+	for _, namespace := range strings.Split(c.ProtectedNamespaces, ",") {
+		if namespace = strings.TrimSpace(namespace); namespace != "" {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	return namespaces
+}
+
+// splitList returns the non empty items of comma separated s.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// cniSource returns the default cni source with preset-mode taken into account.
+func (c *Config) cniSource() wenhookconfig.Options {
+	opts := c.CNISource
+	if c.PresetMode {
+		opts.Source = wenhookconfig.SourceValue
+	}
+	opts.Value = c.DefaultCNI
+	return opts
+}
+
+// defaultHeartbeatLeaseName is the heartbeat lease in deploy manifests.
+const defaultHeartbeatLeaseName = "add-pod-eni-ip-limit-webhook-heartbeat"
+
+// commands run without serving admissions, e.g. webhook mutate -f pod.yaml.
+var commands = map[string]func(args []string) int{
+	"audit":    auditCommand,
+	"mutate":   mutateCommand,
+	"replay":   replayCommand,
+	"watchdog": watchdogCommand,
+}
+
+// runCommand runs the command named by args[0] and returns its exit code.
+func runCommand(args []string) int {
+	command, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+		return 2
+	}
+	// commands log to stderr unless told otherwise
+	logToStderr := true
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "logtostderr" || f.Name == "alsologtostderr" || f.Name == "log_dir" {
+			logToStderr = false
+		}
+	})
+	if logToStderr {
+		flag.Set("logtostderr", "true")
+	}
+	defer glog.Flush()
+	return command(args[1:])
 }
 
 func init() {
+	config.CNISource = wenhookconfig.NewOptions()
+	config.ReconcilePeriod = time.Minute
+	config.ReconcileMaxDeletions = 10
+	config.LeaderElectNamespace = os.Getenv("POD_NAMESPACE")
+	if config.LeaderElectNamespace == "" {
+		config.LeaderElectNamespace = metav1.NamespaceSystem
+	}
+	config.LeaderElectName = "add-pod-eni-ip-limit-webhook"
+	config.WebhookConfigurations = "add-pod-eni-ip-limit-webhook,add-pod-eni-ip-limit-template-webhook"
+	config.ProtectionCheckPeriod = time.Minute
+	config.PolicyStatusPeriod = 30 * time.Second
+	config.HeartbeatPeriod = 10 * time.Second
+	config.CapacityPeriod = 30 * time.Second
+	config.NodePoolLabel = capacity.DefaultNodePoolLabel
+	config.ConfigCheckPeriod = 10 * time.Second
+	config.TracingSampleRatio = 1
+	config.RecordMaxBytes = 100 << 20
+	config.RecordMaxFiles = 5
+	config.RecordSampleRatio = 1
+	config.RecordRedact = strings.Join(logging.DefaultRedactions, ",")
 	config.addFlags()
-	flag.Parse()
 }
 
 func main() {
+	flag.Parse()
+	if err := logging.SetFormat(config.LogFormat); err != nil {
+		glog.Fatal(err)
+	}
+	loadConfigFile()
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(flag.Args()))
+	}
+
 	flag.VisitAll(func(i *flag.Flag) {
 		glog.V(2).Infof("FLAG: --%s=%q", i.Name, i.Value)
 	})
 	glog.V(2).Infof("Version: %+v", version)
 
-	var defaultCNI bool
-	if config.PresetMode {
-		defaultCNI = config.DefaultCNI
-	} else {
-		cs, err := client.GetKubeClient(config.InCluster, config.Master, config.KubeConfig)
+	stopCh := make(chan struct{})
+	wh := newWebhook(config.Reconcile || config.ReadinessGate != "" || config.HeartbeatLeaseName != "", stopCh)
+	protectionCheck := config.WebhookConfigurations != "" && len(config.protectedNamespaces()) > 0
+	if protectionCheck && wh.client == nil {
+		// preset mode needs no kube client, the check alone does not create one
+		glog.Infof("Not verifying namespaceSelectors of %s exclude protected namespaces without a kube client", config.WebhookConfigurations)
+		protectionCheck = false
+	}
+	if protectionCheck {
+		checker := protection.NewChecker(wh.client, strings.Split(config.WebhookConfigurations, ","), config.protectedNamespaces())
+		checker.Check()
+		wh.protection = checker
+		go checker.Run(config.ProtectionCheckPeriod, stopCh)
+		wh.checks = append(wh.checks, checker.Degraded)
+	}
+
+	cert := &certificate{}
+	if err := cert.load(config); err != nil {
+		glog.Fatal(err)
+	}
+	wh.server = https.NewReloadableServer(wh.options)
+	if config.ConfigFile != "" {
+		watcher := configfile.NewWatcher(config.ConfigFile, configData, func(f *configfile.File) error {
+			next := flagConfig
+			next.applyFile(f)
+			return wh.reload(next, cert)
+		})
+		go watcher.Run(config.ConfigCheckPeriod, stopCh)
+	}
+	go cert.run(config.ConfigCheckPeriod, stopCh)
+	hs := wh.server
+	runControllers(wh, hs, stopCh)
+	runHeartbeat(wh, stopCh)
+	if wh.policies != nil {
+		go wh.policies.RunStatus(config.PolicyStatusPeriod, stopCh)
+	}
+	if config.TracingEndpoint != "" {
+		tracer, err := tracing.NewTracer(tracing.Options{
+			Endpoint:    config.TracingEndpoint,
+			ServiceName: "add-pod-eni-ip-limit-webhook",
+			SampleRatio: config.TracingSampleRatio,
+			Period:      5 * time.Second,
+		})
 		if err != nil {
-			glog.Fatalf("Failed to get kube client: %v", err)
+			glog.Fatal(err)
 		}
-		defaultCNI, err = wenhookconfig.GetDefaultCNIFromMultus(cs)
+		go tracer.Run(stopCh)
+		admissions.SetTracer(tracer)
+	}
+	if config.RecordFile != "" {
+		rec, err := newRecorder(config)
 		if err != nil {
-			glog.Fatalf("Failed to determine whether %s is default cni, %v", https.TKERouteENI, err)
+			glog.Fatal(err)
 		}
+		go rec.Run(stopCh)
+		admissions.SetRecorder(rec)
 	}
-
-	glog.Infof("Whether %s is default cni: %t", https.TKERouteENI, defaultCNI)
-	hs := https.NewHttpsServer(defaultCNI)
-	http.HandleFunc("/add-pod-eni-ip-limit", hs.ServeHttps)
+	admissions.RegisterMutator("/add-pod-eni-ip-limit", "eni-ip", hs.PodMutator())
+	admissions.RegisterMutator("/add-pod-eni-ip-limit-template", "eni-ip", hs.TemplateMutator())
+	if config.DebugListen != "" {
+		runDebug(wh, cert)
+	}
+	// debug handlers registered on the default mux are never served here
+	mux := http.NewServeMux()
+	admissions.Install(mux)
+	mux.HandleFunc("/healthz", health.Healthz)
+	mux.HandleFunc("/readyz", health.Readyz(wh.checks...))
+	mux.Handle("/metrics", metrics.Handler())
 	server := &http.Server{
 		Addr:      ":443",
-		TLSConfig: configTLS(config),
+		Handler:   mux,
+		TLSConfig: configTLS(cert),
 	}
 	server.ListenAndServeTLS("", "")
 }
+
+// newRecorder returns the recorder of admissions configured by c.
+func newRecorder(c Config) (*recorder.Recorder, error) {
+	redactions, err := logging.ParseRedactions(c.RecordRedact)
+	if err != nil {
+		return nil, err
+	}
+	var decisions []string
+	for _, decision := range splitList(c.RecordDecisions) {
+		switch decision {
+		case https.ResultAllowed, https.ResultPatched, https.ResultDenied, https.ResultError:
+			decisions = append(decisions, decision)
+		default:
+			return nil, fmt.Errorf("unknown decision %q in --record-decisions", decision)
+		}
+	}
+	return recorder.New(recorder.Options{
+		File:        c.RecordFile,
+		MaxBytes:    c.RecordMaxBytes,
+		MaxFiles:    c.RecordMaxFiles,
+		SampleRatio: c.RecordSampleRatio,
+		Namespaces:  splitList(c.RecordNamespaces),
+		Decisions:   decisions,
+		Redactions:  redactions,
+	})
+}
+
+// runControllers runs the enabled controllers while leading, other replicas
+// only serve admissions.
+func runControllers(wh *webhook, explainer reconciler.Explainer, stopCh <-chan struct{}) {
+	var controllers []func(stop <-chan struct{})
+	if config.Reconcile {
+		recorder := events.NewRecorder(wh.client, "add-pod-eni-ip-limit-webhook")
+		pods, namespaces := wh.podInformer(), wh.namespaceInformer()
+		controllers = append(controllers, func(stop <-chan struct{}) {
+			reconciler.New(wh.client, pods, namespaces, explainer, recorder, reconciler.Options{
+				Period:         config.ReconcilePeriod,
+				DeletePods:     config.ReconcileDeletePods,
+				MaxDeletions:   config.ReconcileMaxDeletions,
+				Configurations: splitList(config.WebhookConfigurations),
+			}).Run(stop)
+		})
+	}
+	if config.ReadinessGate != "" {
+		// validated by newWebhook before the gate is added to pods
+		opts, err := config.readinessOptions()
+		if err != nil {
+			glog.Fatal(err)
+		}
+		var nodes *informer.Informer
+		if opts.NodeAnnotation != "" {
+			nodes = wh.nodeInformer()
+		}
+		controller := readiness.New(wh.client, wh.podInformer(), nodes, opts)
+		controllers = append(controllers, controller.Run)
+	}
+	if len(controllers) == 0 {
+		return
+	}
+
+	le := leaderelection.DefaultConfig(wh.client, config.LeaderElectNamespace, config.LeaderElectName)
+	le.OnStartedLeading = func(stop <-chan struct{}) {
+		for _, run := range controllers {
+			go run(stop)
+		}
+	}
+	go func() {
+		if err := leaderelection.Run(le, stopCh); err != nil {
+			glog.Fatalf("Failed to elect controller leader: %v", err)
+		}
+	}()
+}
+
+// webhook holds what mutating pods depends on.
+type webhook struct {
+	client kubernetes.Interface
+	// mu guards config and options, which change on reloads.
+	mu        sync.RWMutex
+	config    Config
+	options   https.Options
+	server    *https.ReloadableServer
+	checks    []health.Check
+	informers []*informer.Informer
+
+	stopCh     <-chan struct{}
+	namespaces *informer.Informer
+	nodes      *informer.Informer
+	pods       *informer.Informer
+	policies   *policy.Store
+	// protection verifies protected namespaces, nil if not checked.
+	protection *protection.Checker
+}
+
+// namespaceInformer returns the running informer of namespaces, starting it
+// if needed.
+func (wh *webhook) namespaceInformer() *informer.Informer {
+	if wh.namespaces == nil {
+		wh.namespaces = informer.NewNamespaceInformer(wh.client)
+		go wh.namespaces.Run(wh.stopCh)
+		wh.informers = append(wh.informers, wh.namespaces)
+	}
+	return wh.namespaces
+}
+
+// nodeInformer returns the running informer of nodes, starting it if needed.
+func (wh *webhook) nodeInformer() *informer.Informer {
+	if wh.nodes == nil {
+		wh.nodes = informer.NewNodeInformer(wh.client)
+		go wh.nodes.Run(wh.stopCh)
+		wh.informers = append(wh.informers, wh.nodes)
+	}
+	return wh.nodes
+}
+
+// podInformer returns the running informer of pods, starting it if needed.
+func (wh *webhook) podInformer() *informer.Informer {
+	if wh.pods == nil {
+		wh.pods = informer.NewPodInformer(wh.client)
+		go wh.pods.Run(wh.stopCh)
+		wh.informers = append(wh.informers, wh.pods)
+	}
+	return wh.pods
+}
+
+// newWebhook resolves the default cni and starts informers according to
+// config. A kube client is created if any of them or needsClient requires.
+func newWebhook(needsClient bool, stopCh <-chan struct{}) *webhook {
+	cniSource := config.cniSource()
+	if err := cniSource.Validate(); err != nil {
+		glog.Fatal(err)
+	}
+	if err := config.validate(); err != nil {
+		glog.Fatal(err)
+	}
+	wh := &webhook{stopCh: stopCh, config: config}
+	nodeCheck := config.NodeCheck != "" && config.NodeCheck != https.NodeCheckOff
+	headroomCheck := config.HeadroomCheck != "" && config.HeadroomCheck != https.HeadroomCheckOff
+	if needsClient || cniSource.NeedsClient() || config.NamespaceDefaults || config.Policies || nodeCheck || headroomCheck || config.CapacityMetrics {
+		var err error
+		// apiserver is not required to be reachable here, the default cni
+		// falls back once default-cni-timeout expires
+		wh.client, err = client.NewKubeClient(config.InCluster, config.Master, config.KubeConfig)
+		if err != nil {
+			glog.Fatalf("Failed to get kube client: %v", err)
+		}
+		go func() {
+			if err := client.CheckServer(wh.client); err != nil {
+				glog.Error(err)
+			}
+		}()
+	}
+	defaultCNI, err := wenhookconfig.Resolve(wh.client, cniSource, config.CNITimeout, config.DefaultCNI)
+	if err != nil {
+		glog.Fatalf("Failed to determine whether %s is default cni, %v", https.TKERouteENI, err)
+	}
+
+	glog.Infof("Whether %s is default cni: %t", https.TKERouteENI, defaultCNI.DefaultCNI())
+	wh.options = https.Options{DefaultCNI: defaultCNI}
+	wh.checks = []health.Check{defaultCNI.Degraded}
+
+	if config.NamespaceDefaults {
+		namespaceDefaults := namespace.NewDefaults(wh.namespaceInformer())
+		wh.options.NamespaceDefaults = namespaceDefaults
+		wh.checks = append(wh.checks, namespaceDefaults.Degraded)
+	}
+	if config.Policies {
+		wh.policies = policy.NewStore(wh.client, wh.namespaceInformer())
+		go wh.policies.Run(stopCh)
+		wh.options.Policies = wh.policies
+		wh.checks = append(wh.checks, wh.policies.Degraded)
+		wh.informers = append(wh.informers, wh.policies.Informer())
+	}
+	if nodeCheck {
+		wh.nodes = informer.NewNodeInformer(wh.client)
+		// handlers of the eligibility cache must be added before running
+		nodeEligibility := node.NewEligibility(wh.nodes, https.UnderlayIPResource)
+		go wh.nodes.Run(stopCh)
+		wh.options.NodeEligibility = nodeEligibility
+		wh.checks = append(wh.checks, nodeEligibility.Degraded)
+		wh.informers = append(wh.informers, wh.nodes)
+	}
+
+	if headroomCheck || config.CapacityMetrics {
+		exporter := capacity.NewExporter(wh.nodeInformer(), wh.podInformer(), capacity.Options{
+			Resource:      https.UnderlayIPResource,
+			NodePoolLabel: config.NodePoolLabel,
+			Period:        config.CapacityPeriod,
+			Metrics:       config.CapacityMetrics,
+		})
+		go exporter.Run(stopCh)
+		if headroomCheck {
+			wh.options.Headroom = exporter
+		}
+	}
+
+	if wh.options, err = wh.serverOptions(config); err != nil {
+		glog.Fatal(err)
+	}
+	return wh
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/https"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/jsonpatch"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/node"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/schema"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/yaml"
+)
+
+// stringSlice is a flag which may be given multiple times.
+type stringSlice []string
+
+func (s *stringSlice) String() string { return strings.Join(*s, ",") }
+
+func (s *stringSlice) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// staticDefaults are cluster default networks given by flags.
+type staticDefaults struct {
+	defaultCNI      bool
+	defaultNetworks string
+}
+
+func (d *staticDefaults) DefaultCNI() bool { return d.defaultCNI }
+
+func (d *staticDefaults) DefaultNetworks() string { return d.defaultNetworks }
+
+func (d *staticDefaults) Degraded() string { return "" }
+
+// staticNamespaceDefaults are namespace default networks given by flags.
+type staticNamespaceDefaults map[string]string
+
+func (d staticNamespaceDefaults) DefaultNetworks(namespace string) (string, bool) {
+	networks, ok := d[namespace]
+	return networks, ok
+}
+
+func (d staticNamespaceDefaults) Known(namespace string) bool { return true }
+
+// offlineOptions are flags shared by commands resolving networks without a
+// cluster, like mutate.
+type offlineOptions struct {
+	defaultCNI             bool
+	defaultNetworks        string
+	namespaceNetworks      stringSlice
+	pinNetworks            bool
+	stripStale             bool
+	readinessGate          string
+	virtualNodeSelectors   string
+	virtualNodeTolerations string
+	virtualNodeAnnotations string
+}
+
+func (o *offlineOptions) addFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&o.defaultCNI, "default-cni", false, "Whether "+https.TKERouteENI+" is default cni of the cluster.")
+	fs.StringVar(&o.defaultNetworks, "default-networks", "", "Default networks of the cluster, e.g. tke-bridge,tke-route-eni. It overrides --default-cni.")
+	fs.Var(&o.namespaceNetworks, "namespace-networks", "namespace=networks, default networks of a namespace, may be given multiple times.")
+	fs.BoolVar(&o.pinNetworks, "pin-networks", false, "Whether to write the resolved networks into "+https.CNINetworksAnnotation+".")
+	fs.BoolVar(&o.stripStale, "strip-stale", false, "Whether to remove "+https.UnderlayIPResource+" from objects not using "+https.TKERouteENI+".")
+	fs.StringVar(&o.readinessGate, "readiness-gate", "", "Readiness gate added to objects using "+https.TKERouteENI+" if not empty.")
+	fs.StringVar(&o.virtualNodeSelectors, "virtual-node-selectors", "", "Comma separated key=value or key labels of virtual nodes.")
+	fs.StringVar(&o.virtualNodeTolerations, "virtual-node-tolerations", "", "Comma separated taint keys of virtual nodes.")
+	fs.StringVar(&o.virtualNodeAnnotations, "virtual-node-annotations", "", "Comma separated key=value or key pod annotations marking pods bound for virtual nodes.")
+}
+
+func (o *offlineOptions) server() (https.HttpsServer, error) {
+	opts, err := o.options()
+	if err != nil {
+		return nil, err
+	}
+	return https.NewHttpsServer(opts), nil
+}
+
+func (o *offlineOptions) options() (https.Options, error) {
+	defaults := &staticDefaults{defaultCNI: o.defaultCNI}
+	namespaceDefaults := make(staticNamespaceDefaults)
+	if o.defaultNetworks != "" {
+		defaults.defaultNetworks = o.defaultNetworks
+		defaults.defaultCNI = strings.Contains(o.defaultNetworks, https.TKERouteENI)
+	} else if o.defaultCNI {
+		defaults.defaultNetworks = https.TKERouteENI
+	}
+	for _, kv := range o.namespaceNetworks {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return https.Options{}, fmt.Errorf("invalid --namespace-networks %q, expect namespace=networks", kv)
+		}
+		namespaceDefaults[parts[0]] = parts[1]
+	}
+	virtualNodes, err := node.ParseVirtualNodeRules(o.virtualNodeSelectors, o.virtualNodeTolerations, o.virtualNodeAnnotations)
+	if err != nil {
+		return https.Options{}, err
+	}
+	return https.Options{
+		DefaultCNI:        defaults,
+		NamespaceDefaults: namespaceDefaults,
+		PinNetworks:       o.pinNetworks,
+		StripStale:        o.stripStale,
+		ReadinessGate:     o.readinessGate,
+		VirtualNodes:      virtualNodes,
+	}, nil
+}
+
+// object is a decoded input document.
+type object struct {
+	raw []byte
+	obj runtime.Object
+	// err is why obj is not decoded.
+	err error
+}
+
+func (o *object) describe() string {
+	if o.obj == nil {
+		return "unknown object"
+	}
+	kind := o.obj.GetObjectKind().GroupVersionKind().Kind
+	accessor, err := meta.Accessor(o.obj)
+	if err != nil {
+		return kind
+	}
+	name := accessor.GetName()
+	if name == "" {
+		name = accessor.GetGenerateName()
+	}
+	if accessor.GetNamespace() == "" {
+		return fmt.Sprintf("%s %s", kind, name)
+	}
+	return fmt.Sprintf("%s %s/%s", kind, accessor.GetNamespace(), name)
+}
+
+// readObjects reads YAML or JSON documents from r, lists are expanded.
+func readObjects(r io.Reader) ([]object, error) {
+	var objects []object
+	decoder := utilyaml.NewYAMLOrJSONDecoder(r, 4096)
+	for {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			if err == io.EOF {
+				return objects, nil
+			}
+			return nil, err
+		}
+		if len(raw) == 0 || string(raw) == "null" {
+			continue
+		}
+		var list struct {
+			Kind  string            `json:"kind"`
+			Items []json.RawMessage `json:"items"`
+		}
+		if err := json.Unmarshal(raw, &list); err == nil && strings.HasSuffix(list.Kind, "List") {
+			for _, item := range list.Items {
+				objects = append(objects, decodeObject(item))
+			}
+			continue
+		}
+		objects = append(objects, decodeObject(raw))
+	}
+}
+
+// readFile reads objects from file, - for stdin.
+func readFile(file string) ([]object, error) {
+	if file == "-" {
+		return readObjects(os.Stdin)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readObjects(f)
+}
+
+func decodeObject(raw []byte) object {
+	obj, _, err := schema.Codecs.UniversalDeserializer().Decode(raw, nil, nil)
+	return object{raw: raw, obj: obj, err: err}
+}
+
+// mutateCommand runs the admission logic on pods and workloads read from
+// files or stdin, without a cluster.
+func mutateCommand(args []string) int {
+	fs := flag.NewFlagSet("mutate", flag.ExitOnError)
+	var files stringSlice
+	var output, namespace string
+	var opts offlineOptions
+	fs.Var(&files, "f", "File containing pods or workloads in YAML or JSON, - for stdin, may be given multiple times.")
+	fs.StringVar(&output, "o", "yaml", "Output format, one of yaml and json for mutated objects, patch for JSON patches and explain for decisions.")
+	fs.StringVar(&namespace, "namespace", "default", "Namespace of objects without one.")
+	opts.addFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s mutate -f FILE [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if len(files) == 0 {
+		fs.Usage()
+		return 2
+	}
+	switch output {
+	case "yaml", "json", "patch", "explain":
+	default:
+		fmt.Fprintf(os.Stderr, "unknown output format %q\n", output)
+		return 2
+	}
+
+	hs, err := opts.server()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	var objects []object
+	for _, file := range files {
+		objs, err := readFile(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read %s: %v\n", file, err)
+			return 1
+		}
+		objects = append(objects, objs...)
+	}
+
+	failed := false
+	var out bytes.Buffer
+	for i, o := range objects {
+		var result *https.Result
+		if o.err == nil {
+			result, o.err = hs.Explain(namespace, o.obj)
+		}
+		if o.err != nil || result.Rejection != "" {
+			failed = true
+		}
+		if result != nil && output != "explain" {
+			for _, warning := range result.Warnings {
+				fmt.Fprintf(os.Stderr, "Warning: %s: %s\n", o.describe(), warning)
+			}
+		}
+		if err := writeResult(&out, output, i, &o, result); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", o.describe(), err)
+			failed = true
+		}
+	}
+	os.Stdout.Write(out.Bytes())
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+func writeResult(out *bytes.Buffer, output string, index int, o *object, result *https.Result) error {
+	switch output {
+	case "explain":
+		fmt.Fprintf(out, "%s: %s\n", o.describe(), explain(o, result))
+		if result != nil {
+			for _, warning := range result.Warnings {
+				fmt.Fprintf(out, "  warning: %s\n", warning)
+			}
+		}
+		return nil
+	case "patch":
+		if o.err != nil {
+			return o.err
+		}
+		patch := result.Patch
+		if patch == nil {
+			patch = json.RawMessage("[]")
+		}
+		fmt.Fprintf(out, "# %s\n%s\n", o.describe(), patch)
+		return nil
+	}
+
+	if o.err != nil {
+		return o.err
+	}
+	if result.Rejection != "" {
+		return fmt.Errorf("rejected: %s", result.Rejection)
+	}
+	mutated := o.raw
+	if result.Patch != nil {
+		var err error
+		if mutated, err = applyManifestPatch(o.raw, result.Patch); err != nil {
+			return err
+		}
+	}
+	if output == "json" {
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, mutated, "", "  "); err != nil {
+			return err
+		}
+		out.Write(indented.Bytes())
+		out.WriteByte('\n')
+		return nil
+	}
+	y, err := yaml.JSONToYAML(mutated)
+	if err != nil {
+		return err
+	}
+	if index > 0 {
+		out.WriteString("---\n")
+	}
+	out.Write(y)
+	return nil
+}
+
+// applyManifestPatch applies patch of the webhook to the manifest raw.
+func applyManifestPatch(raw []byte, patch json.RawMessage) ([]byte, error) {
+	patch, err := https.ManifestPatch(patch)
+	if err != nil {
+		return nil, err
+	}
+	return jsonpatch.Apply(raw, patch)
+}
+
+func explain(o *object, result *https.Result) string {
+	if o.err != nil {
+		return fmt.Sprintf("error: %v", o.err)
+	}
+	var networks string
+	if result.Networks != "" {
+		networks = fmt.Sprintf("networks %s from %s", result.Networks, result.NetworksSource)
+	} else if result.NetworksSource != "" {
+		networks = fmt.Sprintf("networks from %s", result.NetworksSource)
+	}
+	if result.Policy != "" {
+		networks = fmt.Sprintf("EniIPPolicy %s, %s", result.Policy, networks)
+	}
+	switch {
+	case result.Rejection != "":
+		return fmt.Sprintf("reject, %s", result.Rejection)
+	case result.Inject && result.Patch == nil:
+		return fmt.Sprintf("%s already requested, %s", result.Resource, networks)
+	case result.Inject && result.Quantity != "1":
+		return fmt.Sprintf("inject %s %s, %s", result.Resource, result.Quantity, networks)
+	case result.Inject:
+		return fmt.Sprintf("inject %s, %s", result.Resource, networks)
+	case len(result.Stripped) > 0:
+		return fmt.Sprintf("strip %s from containers %s, %s", https.UnderlayIPResource, strings.Join(result.Stripped, ","), result.Reason)
+	case networks != "":
+		return fmt.Sprintf("skip, %s, %s", result.Reason, networks)
+	default:
+		return fmt.Sprintf("skip, %s", result.Reason)
+	}
+}
@@ -0,0 +1,236 @@
+package capacity
+
+import (
+	"sync"
+	"time"
+
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/informer"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/metrics"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/node"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// DefaultNodePoolLabel is the label of TKE nodes naming their node pool.
+const DefaultNodePoolLabel = "tke.cloud.tencent.com/nodepool-id"
+
+var (
+	nodeAllocatable = metrics.NewGaugeVec("capacity_node_allocatable",
+		"Allocatable eni-ip of nodes.", "node", "pool")
+	nodeRequested = metrics.NewGaugeVec("capacity_node_requested",
+		"eni-ip requested by pods bound to nodes, by namespace of pods.", "node", "pool", "namespace")
+	nodeFree = metrics.NewGaugeVec("capacity_node_free",
+		"Allocatable eni-ip of nodes not requested by any pod.", "node", "pool")
+	poolAllocatable = metrics.NewGaugeVec("capacity_pool_allocatable",
+		"Allocatable eni-ip of node pools.", "pool")
+	poolRequested = metrics.NewGaugeVec("capacity_pool_requested",
+		"eni-ip requested by pods bound to nodes of node pools, by namespace of pods.", "pool", "namespace")
+	poolFree = metrics.NewGaugeVec("capacity_pool_free",
+		"Allocatable eni-ip of node pools not requested by any pod.", "pool")
+	pendingPods = metrics.NewGaugeVec("capacity_pending_pods",
+		"Pods requesting eni-ip the scheduler failed to fit onto any node, by namespace.", "namespace")
+)
+
+// Options of the exporter.
+type Options struct {
+	Resource corev1.ResourceName
+	// NodePoolLabel groups nodes into pools.
+	NodePoolLabel string
+	// Period between two computations.
+	Period time.Duration
+	// Metrics is whether to export the computed capacity, it is only kept
+	// for Headroom otherwise.
+	Metrics bool
+}
+
+// Exporter computes eni-ip allocatable, requested and free of nodes and node
+// pools from the node and pod informers, and exports them.
+type Exporter struct {
+	opts  Options
+	nodes *informer.Informer
+	pods  *informer.Informer
+
+	mu sync.RWMutex
+	// free is nil until computed once.
+	free []freeNode
+}
+
+type freeNode struct {
+	node *corev1.Node
+	free int64
+}
+
+// NewExporter returns an exporter of the nodes and pods informers.
+func NewExporter(nodes, pods *informer.Informer, opts Options) *Exporter {
+	return &Exporter{
+		opts:  opts,
+		nodes: nodes,
+		pods:  pods,
+	}
+}
+
+// Run computes capacity every period until stopCh is closed.
+func (e *Exporter) Run(stopCh <-chan struct{}) {
+	if !e.nodes.WaitForSync(stopCh) || !e.pods.WaitForSync(stopCh) {
+		return
+	}
+	glog.Infof("Computing %s capacity every %s", e.opts.Resource, e.opts.Period)
+	wait.Until(e.export, e.opts.Period, stopCh)
+}
+
+// Headroom returns the free resource of schedulable nodes pod may be
+// scheduled onto, as of the last computation. known is false before the
+// first computation.
+func (e *Exporter) Headroom(pod *corev1.Pod) (free int64, known bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.free == nil {
+		return 0, false
+	}
+	for _, n := range e.free {
+		if n.free > 0 && !n.node.Spec.Unschedulable && node.MatchesPod(pod, n.node) {
+			free += n.free
+		}
+	}
+	return free, true
+}
+
+type usage struct {
+	allocatable int64
+	requested   map[string]int64
+}
+
+func newUsage() *usage {
+	return &usage{requested: make(map[string]int64)}
+}
+
+func (u *usage) free() int64 {
+	free := u.allocatable
+	for _, requested := range u.requested {
+		free -= requested
+	}
+	return free
+}
+
+func (e *Exporter) export() {
+	nodes := make(map[string]*usage)
+	pools := make(map[string]*usage)
+	nodePools := make(map[string]string)
+	nodeObjects := make(map[string]*corev1.Node)
+	for _, obj := range e.nodes.List() {
+		n, ok := obj.(*corev1.Node)
+		if !ok {
+			continue
+		}
+		allocatable := n.Status.Allocatable[e.opts.Resource]
+		pool := n.Labels[e.opts.NodePoolLabel]
+		nodePools[n.Name] = pool
+		nodeObjects[n.Name] = n
+		nodes[n.Name] = newUsage()
+		nodes[n.Name].allocatable = allocatable.Value()
+		if pools[pool] == nil {
+			pools[pool] = newUsage()
+		}
+		pools[pool].allocatable += allocatable.Value()
+	}
+
+	pending := make(map[string]int64)
+	for _, obj := range e.pods.List() {
+		pod, ok := obj.(*corev1.Pod)
+		if !ok || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		requested := PodRequest(pod, e.opts.Resource)
+		if requested == 0 {
+			continue
+		}
+		if pod.Spec.NodeName == "" {
+			// pods just created are not pending for lack of capacity
+			if unschedulable(pod) {
+				pending[pod.Namespace]++
+			}
+			continue
+		}
+		u, ok := nodes[pod.Spec.NodeName]
+		if !ok {
+			continue
+		}
+		u.requested[pod.Namespace] += requested
+		pools[nodePools[pod.Spec.NodeName]].requested[pod.Namespace] += requested
+	}
+
+	free := make([]freeNode, 0, len(nodes))
+	for name, u := range nodes {
+		if u.allocatable > 0 {
+			free = append(free, freeNode{node: nodeObjects[name], free: u.free()})
+		}
+	}
+	e.mu.Lock()
+	e.free = free
+	e.mu.Unlock()
+	if !e.opts.Metrics {
+		return
+	}
+
+	// series are built first and swapped in at once, so that scrapes never
+	// see them missing
+	nodeAllocatables, nodeRequests, nodeFrees := nodeAllocatable.NewSamples(), nodeRequested.NewSamples(), nodeFree.NewSamples()
+	poolAllocatables, poolRequests, poolFrees := poolAllocatable.NewSamples(), poolRequested.NewSamples(), poolFree.NewSamples()
+	pendings := pendingPods.NewSamples()
+	for name, u := range nodes {
+		pool := nodePools[name]
+		nodeAllocatables.Set(float64(u.allocatable), name, pool)
+		nodeFrees.Set(float64(u.free()), name, pool)
+		for namespace, requested := range u.requested {
+			nodeRequests.Set(float64(requested), name, pool, namespace)
+		}
+	}
+	for pool, u := range pools {
+		poolAllocatables.Set(float64(u.allocatable), pool)
+		poolFrees.Set(float64(u.free()), pool)
+		for namespace, requested := range u.requested {
+			poolRequests.Set(float64(requested), pool, namespace)
+		}
+	}
+	for namespace, count := range pending {
+		pendings.Set(float64(count), namespace)
+	}
+	metrics.Replace(nodeAllocatables, nodeRequests, nodeFrees, poolAllocatables, poolRequests, poolFrees, pendings)
+}
+
+// unschedulable returns whether the scheduler failed to fit pod onto any node.
+func unschedulable(pod *corev1.Pod) bool {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodScheduled {
+			return c.Status == corev1.ConditionFalse && c.Reason == corev1.PodReasonUnschedulable
+		}
+	}
+	return false
+}
+
+// PodRequest returns resource requested by pod as the scheduler accounts it,
+// the larger of the sum of containers and any init container.
+func PodRequest(pod *corev1.Pod, name corev1.ResourceName) int64 {
+	var total resource.Quantity
+	for _, c := range pod.Spec.Containers {
+		if q, ok := c.Resources.Requests[name]; ok {
+			total.Add(q)
+		} else if q, ok := c.Resources.Limits[name]; ok {
+			// extended resources default requests to limits
+			total.Add(q)
+		}
+	}
+	for _, c := range pod.Spec.InitContainers {
+		q, ok := c.Resources.Requests[name]
+		if !ok {
+			q, ok = c.Resources.Limits[name]
+		}
+		if ok && q.Cmp(total) > 0 {
+			total = q
+		}
+	}
+	return total.Value()
+}
@@ -0,0 +1,162 @@
+package capacity
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/informer"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/metrics"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+const eniIP = corev1.ResourceName("tke.cloud.tencent.com/eni-ip")
+
+func runInformer(t *testing.T, stopCh <-chan struct{}, name string, list runtime.Object) *informer.Informer {
+	i := informer.New(name,
+		func(metav1.ListOptions) (runtime.Object, error) { return list, nil },
+		func(metav1.ListOptions) (watch.Interface, error) { return watch.NewFake(), nil })
+	go i.Run(stopCh)
+	if !i.WaitForSync(stopCh) {
+		t.Fatalf("%s are not synced", name)
+	}
+	return i
+}
+
+func testNode(name, pool string, allocatable int64) corev1.Node {
+	n := corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{DefaultNodePoolLabel: pool}}}
+	if allocatable > 0 {
+		n.Status.Allocatable = corev1.ResourceList{eniIP: *resource.NewQuantity(allocatable, resource.DecimalSI)}
+	}
+	return n
+}
+
+// requests returns containers requesting quantities of eni-ip, zero for none.
+func requests(quantities ...int64) []corev1.Container {
+	var containers []corev1.Container
+	for _, q := range quantities {
+		c := corev1.Container{Name: "c"}
+		if q > 0 {
+			c.Resources.Limits = corev1.ResourceList{eniIP: *resource.NewQuantity(q, resource.DecimalSI)}
+		}
+		containers = append(containers, c)
+	}
+	return containers
+}
+
+func testPod(namespace, name, node string, containers ...corev1.Container) corev1.Pod {
+	return corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Spec:       corev1.PodSpec{NodeName: node, Containers: containers},
+		Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+}
+
+func TestPodRequest(t *testing.T) {
+	withInit := testPod("default", "init", "", requests(1, 1)...)
+	withInit.Spec.InitContainers = requests(3)
+	smallInit := testPod("default", "small-init", "", requests(2)...)
+	smallInit.Spec.InitContainers = requests(1)
+	requested := testPod("default", "requested", "", requests(2)...)
+	requested.Spec.Containers[0].Resources.Requests = corev1.ResourceList{eniIP: resource.MustParse("1")}
+	tests := []struct {
+		name    string
+		pod     corev1.Pod
+		request int64
+	}{
+		{name: "none", pod: testPod("default", "none", "", requests(0)...)},
+		{name: "limits default requests", pod: testPod("default", "limits", "", requests(1, 0, 2)...), request: 3},
+		{name: "requests over limits", pod: requested, request: 1},
+		{name: "larger init container", pod: withInit, request: 3},
+		{name: "smaller init container", pod: smallInit, request: 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if request := PodRequest(&test.pod, eniIP); request != test.request {
+				t.Errorf("request = %d, want %d", request, test.request)
+			}
+		})
+	}
+}
+
+func TestExport(t *testing.T) {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	cordoned := testNode("node-4", "pool-b", 4)
+	cordoned.Spec.Unschedulable = true
+	nodes := runInformer(t, stopCh, "nodes", &corev1.NodeList{Items: []corev1.Node{
+		testNode("node-1", "pool-a", 10),
+		testNode("node-2", "pool-a", 5),
+		testNode("node-3", "pool-b", 0),
+		cordoned,
+	}})
+	succeeded := testPod("default", "succeeded", "node-1", requests(5)...)
+	succeeded.Status.Phase = corev1.PodSucceeded
+	unschedulable := testPod("default", "unschedulable", "", requests(1)...)
+	unschedulable.Status.Phase = corev1.PodPending
+	unschedulable.Status.Conditions = []corev1.PodCondition{{
+		Type: corev1.PodScheduled, Status: corev1.ConditionFalse, Reason: corev1.PodReasonUnschedulable,
+	}}
+	created := testPod("default", "created", "", requests(1)...)
+	created.Status.Phase = corev1.PodPending
+	pods := runInformer(t, stopCh, "pods", &corev1.PodList{Items: []corev1.Pod{
+		testPod("default", "a", "node-1", requests(2)...),
+		testPod("kube-system", "b", "node-1", requests(1)...),
+		testPod("default", "c", "node-2", requests(1, 2)...),
+		testPod("default", "bridge", "node-2", requests(0)...),
+		succeeded,
+		unschedulable,
+		created,
+	}})
+	e := NewExporter(nodes, pods, Options{Resource: eniIP, NodePoolLabel: DefaultNodePoolLabel, Metrics: true})
+	if _, known := e.Headroom(&corev1.Pod{}); known {
+		t.Error("headroom is known before computing")
+	}
+	e.export()
+
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	exported := rec.Body.String()
+	for _, sample := range []string{
+		`eni_ip_webhook_capacity_node_allocatable{node="node-1",pool="pool-a"} 10`,
+		`eni_ip_webhook_capacity_node_requested{node="node-1",pool="pool-a",namespace="default"} 2`,
+		`eni_ip_webhook_capacity_node_requested{node="node-1",pool="pool-a",namespace="kube-system"} 1`,
+		`eni_ip_webhook_capacity_node_free{node="node-1",pool="pool-a"} 7`,
+		`eni_ip_webhook_capacity_node_free{node="node-2",pool="pool-a"} 2`,
+		`eni_ip_webhook_capacity_node_free{node="node-3",pool="pool-b"} 0`,
+		`eni_ip_webhook_capacity_pool_allocatable{pool="pool-a"} 15`,
+		`eni_ip_webhook_capacity_pool_requested{pool="pool-a",namespace="default"} 5`,
+		`eni_ip_webhook_capacity_pool_free{pool="pool-a"} 9`,
+		`eni_ip_webhook_capacity_pool_free{pool="pool-b"} 4`,
+		`eni_ip_webhook_capacity_pending_pods{namespace="default"} 1`,
+	} {
+		if !strings.Contains(exported, sample+"\n") {
+			t.Errorf("missing sample %s in\n%s", sample, exported)
+		}
+	}
+
+	tests := []struct {
+		name string
+		pod  corev1.Pod
+		free int64
+	}{
+		{name: "any node", pod: testPod("default", "new", ""), free: 9},
+		{name: "nodeName", pod: testPod("default", "new", "node-2"), free: 2},
+		{name: "node without eni-ip", pod: testPod("default", "new", "node-3")},
+		{name: "cordoned node", pod: testPod("default", "new", "node-4")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			free, known := e.Headroom(&test.pod)
+			if !known || free != test.free {
+				t.Errorf("headroom = %d, %v, want %d", free, known, test.free)
+			}
+		})
+	}
+}
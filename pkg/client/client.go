@@ -10,8 +10,21 @@ import (
 	"github.com/golang/glog"
 )
 
-// GetKubeClient creates a k8s client
+// GetKubeClient creates a k8s client and checks apiserver is reachable.
 func GetKubeClient(incluster bool, apiserver string, kubeconfig string) (kubernetes.Interface, error) {
+	kubeClient, err := NewKubeClient(incluster, apiserver, kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckServer(kubeClient); err != nil {
+		return nil, err
+	}
+	return kubeClient, nil
+}
+
+// NewKubeClient creates a k8s client without contacting apiserver, so that
+// an unreachable apiserver only fails its requests.
+func NewKubeClient(incluster bool, apiserver string, kubeconfig string) (kubernetes.Interface, error) {
 	var config *rest.Config
 	var err error
 
@@ -23,23 +36,21 @@ func GetKubeClient(incluster bool, apiserver string, kubeconfig string) (kuberne
 	if err != nil {
 		return nil, err
 	}
+	return kubernetes.NewForConfig(config)
+}
 
-	kubeClient, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		return nil, err
-	}
-
+// CheckServer logs the version of apiserver.
+func CheckServer(kubeClient kubernetes.Interface) error {
 	// Informers don't seem to do a good job logging error messages when it
 	// can't reach the server, making debugging hard. This makes it easier to
 	// figure out if apiserver is configured incorrectly.
 	glog.Infof("Testing communication with server")
 	v, err := kubeClient.Discovery().ServerVersion()
 	if err != nil {
-		return nil, fmt.Errorf("error communicating with apiserver: %v", err)
+		return fmt.Errorf("error communicating with apiserver: %v", err)
 	}
 	glog.Infof("Running with Kubernetes cluster version: v%s.%s. git version: %s. git tree state: %s. commit: %s. platform: %s",
 		v.Major, v.Minor, v.GitVersion, v.GitTreeState, v.GitCommit, v.Platform)
 	glog.Info("Communication with server successful")
-
-	return kubeClient, nil
+	return nil
 }
@@ -3,56 +3,236 @@ package config
 import (
 	"encoding/json"
 	"fmt"
+	"path/filepath"
+	"sort"
 	"strings"
-	"time"
 
 	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/https"
 
 	"github.com/golang/glog"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
 )
 
 const (
 	TKECNIConfCM  = "tke-cni-agent-conf"
 	MultusCNIConf = "00-multus.conf"
+
+	multusPluginType = "multus"
 )
 
+// DelegateConf is a network delegated to by multus. It is either a single
+// plugin conf or a conflist carrying its plugins in Plugins.
+type DelegateConf struct {
+	Name    string         `json:"name,omitempty"`
+	Type    string         `json:"type,omitempty"`
+	Plugins []DelegateConf `json:"plugins,omitempty"`
+}
+
+// NetConf is the multus config, see
+// https://github.com/intel/multus-cni/blob/master/doc/configuration.md.
+// DefaultDelegates is the tke-cni-agent extension listing the default
+// networks separated by comma.
 type NetConf struct {
-	DefaultDelegates string `json:"defaultDelegates"`
-}
-
-func GetDefaultCNIFromMultus(clienset kubernetes.Interface) (bool, error) {
-	var defaultCNI bool
-	err := wait.PollImmediateInfinite(time.Second*3, func() (done bool, err error) {
-		cm, err := clienset.CoreV1().ConfigMaps(metav1.NamespaceSystem).Get(TKECNIConfCM, metav1.GetOptions{})
-		if err != nil {
-			if k8serrors.IsNotFound(err) {
-				// consider tke-route-eni is default cni
-				defaultCNI = true
-				return true, nil
-			}
-			glog.Warningf("Failed to get cm %s/%s, will retry(%v)", metav1.NamespaceSystem, TKECNIConfCM, err)
-			return false, nil
-		}
-		// get defaultDelegates from key 00-multus.conf
-		str, ok := cm.Data[MultusCNIConf]
-		if ok {
-			var netConf NetConf
-			bytes := []byte(str)
-			err = json.Unmarshal(bytes, &netConf)
-			if err != nil {
-				return false, err
-			}
-			if strings.Contains(netConf.DefaultDelegates, https.TKERouteENI) {
-				defaultCNI = true
+	Name             string         `json:"name,omitempty"`
+	Type             string         `json:"type,omitempty"`
+	CNIVersion       string         `json:"cniVersion,omitempty"`
+	ClusterNetwork   string         `json:"clusterNetwork,omitempty"`
+	DefaultNetworks  []string       `json:"defaultNetworks,omitempty"`
+	Delegates        []DelegateConf `json:"delegates,omitempty"`
+	DefaultDelegates string         `json:"defaultDelegates,omitempty"`
+}
+
+// netConfList is a CNI conflist, multus may be installed as one of its plugins.
+type netConfList struct {
+	Name    string            `json:"name,omitempty"`
+	Plugins []json.RawMessage `json:"plugins"`
+}
+
+// ParseNetConf parses a multus conf, or a conflist containing a multus plugin.
+func ParseNetConf(data []byte) (*NetConf, error) {
+	var list netConfList
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse multus config: %v", err)
+	}
+	if len(list.Plugins) == 0 {
+		var netConf NetConf
+		if err := json.Unmarshal(data, &netConf); err != nil {
+			return nil, fmt.Errorf("failed to parse multus config: %v", err)
+		}
+		return &netConf, nil
+	}
+
+	for _, raw := range list.Plugins {
+		var netConf NetConf
+		if err := json.Unmarshal(raw, &netConf); err != nil {
+			return nil, fmt.Errorf("failed to parse plugin of conflist %s: %v", list.Name, err)
+		}
+		if netConf.Type == multusPluginType {
+			return &netConf, nil
+		}
+	}
+	return nil, fmt.Errorf("no %s plugin found in conflist %s", multusPluginType, list.Name)
+}
+
+// Networks returns the networks attached to pods which do not select
+// networks themselves, the first one is the primary network.
+func (n *NetConf) Networks() []string {
+	var networks []string
+	if n.DefaultDelegates != "" {
+		for _, name := range strings.Split(n.DefaultDelegates, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				networks = append(networks, name)
 			}
-			glog.Infof("default cni is %s, set defaultCNI to %t", netConf.DefaultDelegates, defaultCNI)
-			return true, nil
 		}
-		return false, fmt.Errorf("no %s key found in cm %s/%s", MultusCNIConf, metav1.NamespaceSystem, TKECNIConfCM)
-	})
-	return defaultCNI, err
+		return networks
+	}
+	if n.ClusterNetwork != "" {
+		networks = append(networks, networkName(n.ClusterNetwork))
+		for _, name := range n.DefaultNetworks {
+			networks = append(networks, networkName(name))
+		}
+		return networks
+	}
+	for _, delegate := range n.Delegates {
+		networks = append(networks, delegate.networkName())
+	}
+	return networks
+}
+
+// PrimaryNetwork returns the network providing the pod's default interface.
+func (n *NetConf) PrimaryNetwork() string {
+	networks := n.Networks()
+	if len(networks) == 0 {
+		return ""
+	}
+	return networks[0]
+}
+
+// HasNetwork returns whether network is attached to pods by default.
+func (n *NetConf) HasNetwork(network string) bool {
+	for _, name := range n.Networks() {
+		if name == network {
+			return true
+		}
+	}
+	if n.DefaultDelegates != "" || n.ClusterNetwork != "" {
+		return false
+	}
+	for _, delegate := range n.Delegates {
+		if delegate.hasType(network) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *DelegateConf) networkName() string {
+	if d.Name != "" {
+		return d.Name
+	}
+	if d.Type != "" {
+		return d.Type
+	}
+	if len(d.Plugins) > 0 {
+		return d.Plugins[0].Type
+	}
+	return ""
+}
+
+func (d *DelegateConf) hasType(pluginType string) bool {
+	if d.Type == pluginType {
+		return true
+	}
+	for _, plugin := range d.Plugins {
+		if plugin.Type == pluginType {
+			return true
+		}
+	}
+	return false
+}
+
+// networkName returns the network name of clusterNetwork and defaultNetworks,
+// which may also be given as a path like /etc/cni/net.d/10-tke-route-eni.conf.
+func networkName(network string) string {
+	if !strings.Contains(network, "/") {
+		return network
+	}
+	name := filepath.Base(network)
+	name = strings.TrimSuffix(strings.TrimSuffix(name, ".conflist"), ".conf")
+	if i := strings.Index(name, "-"); i > 0 && strings.Trim(name[:i], "0123456789") == "" {
+		name = name[i+1:]
+	}
+	return name
+}
+
+// DefaultNetworks is what pods without networks annotation are attached to.
+type DefaultNetworks struct {
+	// DefaultCNI is whether tke-route-eni is one of the networks.
+	DefaultCNI bool
+	// Networks are the network names, nil if they are unknown.
+	Networks []string
+}
+
+// routeENIOnly is used when tke-cni-agent is not installed.
+var routeENIOnly = DefaultNetworks{DefaultCNI: true, Networks: []string{https.TKERouteENI}}
+
+// defaultNetworksFromNetConf returns the networks attached to pods by default.
+func defaultNetworksFromNetConf(data []byte) (DefaultNetworks, error) {
+	netConf, err := ParseNetConf(data)
+	if err != nil {
+		return DefaultNetworks{}, err
+	}
+	defaultCNI := netConf.HasNetwork(https.TKERouteENI)
+	glog.Infof("default networks are %v, primary network is %s, set defaultCNI to %t",
+		netConf.Networks(), netConf.PrimaryNetwork(), defaultCNI)
+	return DefaultNetworks{DefaultCNI: defaultCNI, Networks: netConf.Networks()}, nil
+}
+
+// multusConfFromConfigMap returns the multus config stored in key of data. If
+// key is missing, the first key which looks like a multus config is used.
+func multusConfFromConfigMap(data map[string]string, key string) (string, string, bool) {
+	if str, ok := data[key]; ok {
+		return key, str, true
+	}
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		if strings.HasSuffix(k, ".conf") || strings.HasSuffix(k, ".conflist") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if netConf, err := ParseNetConf([]byte(data[k])); err == nil && netConf.Type == multusPluginType {
+			return k, data[k], true
+		}
+	}
+	return "", "", false
+}
+
+// GetDefaultCNIFromMultus reads the multus config from key of configmap
+// namespace/name once, tke-route-eni is default cni if the configmap does not
+// exist.
+func GetDefaultCNIFromMultus(clienset kubernetes.Interface, namespace, name, key string) (DefaultNetworks, error) {
+	cm, err := clienset.CoreV1().ConfigMaps(namespace).Get(name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		// consider tke-route-eni is default cni
+		return routeENIOnly, nil
+	}
+	if err != nil {
+		return DefaultNetworks{}, fmt.Errorf("failed to get cm %s/%s: %v", namespace, name, err)
+	}
+	confKey, str, ok := multusConfFromConfigMap(cm.Data, key)
+	if !ok {
+		return DefaultNetworks{}, fmt.Errorf("no %s key or multus config found in cm %s/%s", key, namespace, name)
+	}
+	if confKey != key {
+		glog.Warningf("No %s key found in cm %s/%s, use key %s", key, namespace, name, confKey)
+	}
+	defaultNetworks, err := defaultNetworksFromNetConf([]byte(str))
+	if err != nil {
+		return DefaultNetworks{}, fmt.Errorf("invalid key %s in cm %s/%s: %v", confKey, namespace, name, err)
+	}
+	return defaultNetworks, nil
 }
@@ -0,0 +1,126 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseNetConf(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      string
+		networks  []string
+		routeENI  bool
+		expectErr bool
+	}{
+		{
+			name:     "delegates",
+			data:     `{"type":"multus","delegates":[{"type":"tke-bridge"},{"name":"tke-route-eni","type":"tke-route-eni"}]}`,
+			networks: []string{"tke-bridge", "tke-route-eni"},
+			routeENI: true,
+		},
+		{
+			name:     "delegate conflist named by its first plugin",
+			data:     `{"type":"multus","delegates":[{"plugins":[{"type":"tke-bridge"},{"type":"portmap"}]}]}`,
+			networks: []string{"tke-bridge"},
+		},
+		{
+			name:     "delegate conflist with route eni plugin",
+			data:     `{"type":"multus","delegates":[{"name":"eni","plugins":[{"type":"tke-route-eni"}]}]}`,
+			networks: []string{"eni"},
+			routeENI: true,
+		},
+		{
+			name:     "default delegates take precedence",
+			data:     `{"type":"multus","defaultDelegates":"tke-bridge, tke-route-eni","delegates":[{"type":"tke-route-eni"}]}`,
+			networks: []string{"tke-bridge", "tke-route-eni"},
+			routeENI: true,
+		},
+		{
+			name:     "default delegates without route eni",
+			data:     `{"type":"multus","defaultDelegates":"tke-bridge","delegates":[{"type":"tke-route-eni"}]}`,
+			networks: []string{"tke-bridge"},
+		},
+		{
+			name:     "cluster network paths",
+			data:     `{"type":"multus","clusterNetwork":"/etc/cni/net.d/10-tke-bridge.conf","defaultNetworks":["/etc/cni/net.d/20-tke-route-eni.conflist"]}`,
+			networks: []string{"tke-bridge", "tke-route-eni"},
+			routeENI: true,
+		},
+		{
+			name:     "multus plugin of conflist",
+			data:     `{"name":"multus-cni","plugins":[{"type":"portmap"},{"type":"multus","clusterNetwork":"tke-route-eni"}]}`,
+			networks: []string{"tke-route-eni"},
+			routeENI: true,
+		},
+		{
+			name:      "conflist without multus",
+			data:      `{"name":"bridge","plugins":[{"type":"bridge"}]}`,
+			expectErr: true,
+		},
+		{
+			name:      "invalid json",
+			data:      `{"type":`,
+			expectErr: true,
+		},
+	}
+	for _, test := range tests {
+		netConf, err := ParseNetConf([]byte(test.data))
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("%s: expect error, got %+v", test.name, netConf)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if networks := netConf.Networks(); !reflect.DeepEqual(networks, test.networks) {
+			t.Errorf("%s: expect networks %v, got %v", test.name, test.networks, networks)
+		}
+		if routeENI := netConf.HasNetwork("tke-route-eni"); routeENI != test.routeENI {
+			t.Errorf("%s: expect tke-route-eni %t, got %t", test.name, test.routeENI, routeENI)
+		}
+	}
+}
+
+func TestNetworkName(t *testing.T) {
+	tests := []struct {
+		network string
+		name    string
+	}{
+		{"tke-route-eni", "tke-route-eni"},
+		{"/etc/cni/net.d/10-tke-route-eni.conf", "tke-route-eni"},
+		{"/etc/cni/net.d/00-multus.conflist", "multus"},
+		{"/etc/cni/net.d/tke-bridge.conf", "tke-bridge"},
+		{"/etc/cni/net.d/tke-bridge-v2.conf", "tke-bridge-v2"},
+		{"/etc/cni/net.d/bridge", "bridge"},
+	}
+	for _, test := range tests {
+		if name := networkName(test.network); name != test.name {
+			t.Errorf("networkName(%q): expect %q, got %q", test.network, test.name, name)
+		}
+	}
+}
+
+func TestMultusConfFromConfigMap(t *testing.T) {
+	multus := `{"type":"multus","delegates":[{"type":"tke-route-eni"}]}`
+	tests := []struct {
+		name string
+		data map[string]string
+		key  string
+		ok   bool
+	}{
+		{"configured key", map[string]string{MultusCNIConf: multus}, MultusCNIConf, true},
+		{"other multus key", map[string]string{"01-multus.conflist": `{"plugins":[{"type":"multus"}]}`, "10-bridge.conf": `{"type":"bridge"}`}, "01-multus.conflist", true},
+		{"no multus config", map[string]string{"10-bridge.conf": `{"type":"bridge"}`}, "", false},
+		{"empty", nil, "", false},
+	}
+	for _, test := range tests {
+		key, _, ok := multusConfFromConfigMap(test.data, MultusCNIConf)
+		if ok != test.ok || key != test.key {
+			t.Errorf("%s: expect key %q ok %t, got %q %t", test.name, test.key, test.ok, key, ok)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/golang/glog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Sources of the default cni.
+const (
+	SourceConfigMap = "configmap"
+	SourceFile      = "file"
+	SourceValue     = "value"
+
+	DefaultMultusConfFile = "/etc/cni/net.d/00-multus.conf"
+)
+
+// Options describes where to determine whether tke-route-eni is default cni.
+type Options struct {
+	// Source is one of configmap, file and value.
+	Source string
+
+	ConfigMapNamespace string
+	ConfigMapName      string
+	ConfigMapKey       string
+
+	// File is the path of the multus config when Source is file.
+	File string
+
+	// Value is used as is when Source is value.
+	Value bool
+}
+
+// NewOptions returns options reading the tke-cni-agent configmap.
+func NewOptions() Options {
+	return Options{
+		Source:             SourceConfigMap,
+		ConfigMapNamespace: metav1.NamespaceSystem,
+		ConfigMapName:      TKECNIConfCM,
+		ConfigMapKey:       MultusCNIConf,
+		File:               DefaultMultusConfFile,
+	}
+}
+
+// Validate checks the source is known.
+func (o *Options) Validate() error {
+	switch o.Source {
+	case SourceConfigMap, SourceFile, SourceValue:
+		return nil
+	default:
+		return fmt.Errorf("unknown default cni source %q, expect one of %s, %s and %s",
+			o.Source, SourceConfigMap, SourceFile, SourceValue)
+	}
+}
+
+// NeedsClient returns whether a kube client is needed to read the source.
+func (o *Options) NeedsClient() bool {
+	return o.Source == SourceConfigMap
+}
+
+// GetDefaultCNI returns the default networks according to opts.
+func GetDefaultCNI(clientset kubernetes.Interface, opts Options) (DefaultNetworks, error) {
+	switch opts.Source {
+	case SourceConfigMap:
+		return GetDefaultCNIFromMultus(clientset, opts.ConfigMapNamespace, opts.ConfigMapName, opts.ConfigMapKey)
+	case SourceFile:
+		return GetDefaultCNIFromFile(opts.File)
+	case SourceValue:
+		glog.Infof("default cni source is %s, set defaultCNI to %t", SourceValue, opts.Value)
+		return valueNetworks(opts.Value), nil
+	default:
+		return DefaultNetworks{}, opts.Validate()
+	}
+}
+
+// GetDefaultCNIFromFile reads the multus config from file.
+func GetDefaultCNIFromFile(file string) (DefaultNetworks, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return DefaultNetworks{}, err
+	}
+	defaultNetworks, err := defaultNetworksFromNetConf(data)
+	if err != nil {
+		return DefaultNetworks{}, fmt.Errorf("invalid multus config file %s: %v", file, err)
+	}
+	return defaultNetworks, nil
+}
+
+// valueNetworks returns the default networks of a fixed value, networks other
+// than tke-route-eni are unknown.
+func valueNetworks(defaultCNI bool) DefaultNetworks {
+	if defaultCNI {
+		return routeENIOnly
+	}
+	return DefaultNetworks{}
+}
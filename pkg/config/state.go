@@ -0,0 +1,157 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/https"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/metrics"
+
+	"github.com/golang/glog"
+	"k8s.io/client-go/kubernetes"
+)
+
+const sourceFallback = "fallback"
+
+// retries of the source back off from minRetryInterval to maxRetryInterval,
+// tests shorten them.
+var (
+	minRetryInterval = time.Second * 3
+	maxRetryInterval = time.Second * 30
+)
+
+var (
+	defaultCNIGauge = metrics.NewGaugeVec("default_cni",
+		"Whether tke-route-eni is default cni, by the source it is determined from.", "source")
+	degradedGauge = metrics.NewGaugeVec("default_cni_degraded",
+		"Whether default cni is a fallback value because its source is not resolved yet.")
+)
+
+// State holds whether tke-route-eni is default cni. It starts as a fallback
+// value when the source can not be resolved in time, and is updated once the
+// source is resolved in background.
+type State struct {
+	mu       sync.RWMutex
+	value    DefaultNetworks
+	source   string
+	degraded bool
+	lastErr  error
+}
+
+func (s *State) set(value DefaultNetworks, source string, degraded bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setLocked(value, source, degraded)
+}
+
+func (s *State) setLocked(value DefaultNetworks, source string, degraded bool) {
+	s.value = value
+	s.source = source
+	s.degraded = degraded
+	if !degraded {
+		s.lastErr = nil
+	}
+
+	defaultCNI, degradedSample := defaultCNIGauge.NewSamples(), degradedGauge.NewSamples()
+	defaultCNI.Set(metrics.BoolToFloat(value.DefaultCNI), source)
+	degradedSample.Set(metrics.BoolToFloat(degraded))
+	metrics.Replace(defaultCNI, degradedSample)
+}
+
+func (s *State) setError(err error) {
+	s.mu.Lock()
+	s.lastErr = err
+	s.mu.Unlock()
+}
+
+// DefaultCNI returns whether tke-route-eni is default cni.
+func (s *State) DefaultCNI() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.value.DefaultCNI
+}
+
+// DefaultNetworks returns the default networks in the format of pod
+// annotation tke.cloud.tencent.com/networks, empty if they are unknown. A
+// fallback value is never reported, it should not be pinned onto pods.
+func (s *State) DefaultNetworks() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.degraded {
+		return ""
+	}
+	return strings.Join(s.value.Networks, ",")
+}
+
+// Source returns where the current value comes from.
+func (s *State) Source() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.source
+}
+
+// Degraded returns a non empty message if the current value is a fallback.
+func (s *State) Degraded() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.degraded {
+		return ""
+	}
+	if s.lastErr != nil {
+		return fmt.Sprintf("default cni source is not resolved, using fallback %t: %v", s.value.DefaultCNI, s.lastErr)
+	}
+	return fmt.Sprintf("default cni source is not resolved, using fallback %t", s.value.DefaultCNI)
+}
+
+// Resolve determines whether tke-route-eni is default cni according to opts,
+// retrying the source until it is resolved, every failure is reported by
+// Degraded. With a zero timeout it blocks until the source is resolved.
+// Otherwise it returns a degraded state holding fallback once timeout
+// expires, and keeps resolving the source in background.
+func Resolve(clientset kubernetes.Interface, opts Options, timeout time.Duration, fallback bool) (*State, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	state := &State{}
+	resolved := make(chan struct{})
+	go func() {
+		defer close(resolved)
+		interval := minRetryInterval
+		for {
+			value, err := GetDefaultCNI(clientset, opts)
+			if err == nil {
+				state.set(value, opts.Source, false)
+				return
+			}
+			glog.Errorf("Failed to determine whether %s is default cni, will retry in %v: %v", https.TKERouteENI, interval, err)
+			state.setError(err)
+			time.Sleep(interval)
+			if interval *= 2; interval > maxRetryInterval {
+				interval = maxRetryInterval
+			}
+		}
+	}()
+
+	if timeout <= 0 {
+		<-resolved
+		return state, nil
+	}
+	select {
+	case <-resolved:
+	case <-time.After(timeout):
+		state.mu.Lock()
+		// the source may be resolved right after timeout
+		if state.source == "" {
+			glog.Warningf("Default cni source %s is not resolved in %v, fall back to %t", opts.Source, timeout, fallback)
+			state.setLocked(valueNetworks(fallback), sourceFallback, true)
+		}
+		state.mu.Unlock()
+		go func() {
+			<-resolved
+			glog.Infof("Default cni source %s is resolved, %s is default cni: %t", opts.Source, https.TKERouteENI, state.DefaultCNI())
+		}()
+	}
+	return state, nil
+}
@@ -0,0 +1,134 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const routeENIConf = `{"type":"multus","delegates":[{"type":"tke-bridge"},{"type":"tke-route-eni"}]}`
+
+func TestResolve(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	confFile := filepath.Join(dir, "00-multus.conf")
+	if err := ioutil.WriteFile(confFile, []byte(routeENIConf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing.conf")
+	tests := []struct {
+		name     string
+		opts     Options
+		timeout  time.Duration
+		fallback bool
+
+		expectErr  bool
+		defaultCNI bool
+		networks   string
+		source     string
+		degraded   bool
+	}{
+		{
+			name:       "file",
+			opts:       Options{Source: SourceFile, File: confFile},
+			timeout:    time.Second,
+			defaultCNI: true,
+			networks:   "tke-bridge,tke-route-eni",
+			source:     SourceFile,
+		},
+		{
+			name:       "no timeout",
+			opts:       Options{Source: SourceFile, File: confFile},
+			defaultCNI: true,
+			networks:   "tke-bridge,tke-route-eni",
+			source:     SourceFile,
+		},
+		{
+			name:       "value",
+			opts:       Options{Source: SourceValue, Value: true},
+			timeout:    time.Second,
+			defaultCNI: true,
+			networks:   "tke-route-eni",
+			source:     SourceValue,
+		},
+		{
+			name:       "fallback true",
+			opts:       Options{Source: SourceFile, File: missing},
+			timeout:    50 * time.Millisecond,
+			fallback:   true,
+			defaultCNI: true,
+			source:     sourceFallback,
+			degraded:   true,
+		},
+		{
+			name:     "fallback false",
+			opts:     Options{Source: SourceFile, File: missing},
+			timeout:  50 * time.Millisecond,
+			source:   sourceFallback,
+			degraded: true,
+		},
+		{
+			name:      "unknown source",
+			opts:      Options{Source: "etcd"},
+			expectErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			state, err := Resolve(nil, test.opts, test.timeout, test.fallback)
+			if (err != nil) != test.expectErr {
+				t.Fatalf("error = %v, want error %v", err, test.expectErr)
+			}
+			if err != nil {
+				return
+			}
+			if state.DefaultCNI() != test.defaultCNI || state.DefaultNetworks() != test.networks || state.Source() != test.source {
+				t.Errorf("default cni %v, networks %q from %s, want %v, %q from %s",
+					state.DefaultCNI(), state.DefaultNetworks(), state.Source(), test.defaultCNI, test.networks, test.source)
+			}
+			if degraded := state.Degraded(); (degraded != "") != test.degraded {
+				t.Errorf("degraded %q, want degraded %v", degraded, test.degraded)
+			}
+		})
+	}
+}
+
+func TestResolveRetry(t *testing.T) {
+	defer func(min, max time.Duration) {
+		minRetryInterval, maxRetryInterval = min, max
+	}(minRetryInterval, maxRetryInterval)
+	minRetryInterval, maxRetryInterval = 10*time.Millisecond, 20*time.Millisecond
+
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	confFile := filepath.Join(dir, "00-multus.conf")
+	state, err := Resolve(nil, Options{Source: SourceFile, File: confFile}, 50*time.Millisecond, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	degraded := state.Degraded()
+	if !strings.Contains(degraded, "using fallback false") || !strings.Contains(degraded, confFile) {
+		t.Errorf("degraded %q, want the fallback and the failure of the source", degraded)
+	}
+
+	// the source is resolved by retries in background
+	if err := ioutil.WriteFile(confFile, []byte(routeENIConf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for state.Degraded() != "" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if degraded := state.Degraded(); degraded != "" || !state.DefaultCNI() || state.Source() != SourceFile {
+		t.Errorf("default cni %v from %s, degraded %q after the source is resolved", state.DefaultCNI(), state.Source(), degraded)
+	}
+}
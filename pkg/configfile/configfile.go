@@ -0,0 +1,98 @@
+package configfile
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"sigs.k8s.io/yaml"
+)
+
+// Version of the configuration file, files of other versions are rejected.
+const (
+	APIVersion = "tke.cloud.tencent.com/v1alpha1"
+	Kind       = "EniIPWebhookConfiguration"
+)
+
+// File overrides flags of the webhook, fields left out keep their flag
+// values. See deploy/webhook-config.yaml for an example.
+type File struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+
+	TLS         *TLS         `json:"tls,omitempty"`
+	DefaultCNI  *DefaultCNI  `json:"defaultCNI,omitempty"`
+	Resource    *Resource    `json:"resource,omitempty"`
+	Exclusions  *Exclusions  `json:"exclusions,omitempty"`
+	ErrorPolicy *ErrorPolicy `json:"errorPolicy,omitempty"`
+	// PinNetworks overrides --pin-networks.
+	PinNetworks *bool `json:"pinNetworks,omitempty"`
+	// StripStale overrides --strip-stale.
+	StripStale *bool `json:"stripStale,omitempty"`
+}
+
+// TLS overrides --tls-cert-file and --tls-private-key-file, the files are
+// read again on every change of the configuration.
+type TLS struct {
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+}
+
+// DefaultCNI overrides --preset-mode and --default-cni.
+type DefaultCNI struct {
+	PresetMode *bool `json:"presetMode,omitempty"`
+	Value      *bool `json:"value,omitempty"`
+}
+
+// Resource is what tke-route-eni pods not decided by an EniIPPolicy limit.
+type Resource struct {
+	// Name defaults to tke.cloud.tencent.com/eni-ip.
+	Name corev1.ResourceName `json:"name,omitempty"`
+	// Quantity defaults to 1.
+	Quantity *resource.Quantity `json:"quantity,omitempty"`
+}
+
+// Exclusions are pods never injected, each list overrides the flag of the
+// same name.
+type Exclusions struct {
+	ProtectedNamespaces    []string `json:"protectedNamespaces,omitempty"`
+	VirtualNodeSelectors   []string `json:"virtualNodeSelectors,omitempty"`
+	VirtualNodeTolerations []string `json:"virtualNodeTolerations,omitempty"`
+	VirtualNodeAnnotations []string `json:"virtualNodeAnnotations,omitempty"`
+}
+
+// ErrorPolicy overrides --node-check and --headroom-check.
+type ErrorPolicy struct {
+	NodeCheck     string `json:"nodeCheck,omitempty"`
+	HeadroomCheck string `json:"headroomCheck,omitempty"`
+}
+
+// Load reads and validates the configuration file at path.
+func Load(path string) (*File, []byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := Parse(data)
+	return f, data, err
+}
+
+// Parse decodes a configuration file, unknown fields are errors so that
+// typos are not silently ignored.
+func Parse(data []byte) (*File, error) {
+	f := &File{}
+	if err := yaml.UnmarshalStrict(data, f); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %v", err)
+	}
+	if f.APIVersion != APIVersion || f.Kind != Kind {
+		return nil, fmt.Errorf("unsupported configuration %s %s, expect %s %s", f.APIVersion, f.Kind, APIVersion, Kind)
+	}
+	if f.TLS != nil && (f.TLS.CertFile == "") != (f.TLS.KeyFile == "") {
+		return nil, fmt.Errorf("tls needs both certFile and keyFile")
+	}
+	if f.Resource != nil && f.Resource.Quantity != nil && f.Resource.Quantity.Sign() <= 0 {
+		return nil, fmt.Errorf("resource quantity %s is not positive", f.Resource.Quantity)
+	}
+	return f, nil
+}
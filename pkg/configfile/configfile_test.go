@@ -0,0 +1,119 @@
+package configfile
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const header = "apiVersion: tke.cloud.tencent.com/v1alpha1\nkind: EniIPWebhookConfiguration\n"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      string
+		expectErr bool
+		check     func(f *File) error
+	}{
+		{name: "empty", data: header},
+		{
+			name: "overrides",
+			data: header + "defaultCNI:\n  presetMode: true\n  value: false\nresource:\n  quantity: 2\nexclusions:\n  protectedNamespaces: [kube-system, kube-public]\npinNetworks: true\n",
+			check: func(f *File) error {
+				if f.DefaultCNI == nil || !*f.DefaultCNI.PresetMode || *f.DefaultCNI.Value {
+					return fmt.Errorf("unexpected defaultCNI %+v", f.DefaultCNI)
+				}
+				if f.Resource == nil || f.Resource.Name != "" || f.Resource.Quantity.Value() != 2 {
+					return fmt.Errorf("unexpected resource %+v", f.Resource)
+				}
+				if f.Exclusions == nil || len(f.Exclusions.ProtectedNamespaces) != 2 {
+					return fmt.Errorf("unexpected exclusions %+v", f.Exclusions)
+				}
+				if f.PinNetworks == nil || !*f.PinNetworks || f.StripStale != nil || f.TLS != nil {
+					return fmt.Errorf("unexpected pinNetworks %v stripStale %v tls %v", f.PinNetworks, f.StripStale, f.TLS)
+				}
+				return nil
+			},
+		},
+		{name: "tls", data: header + "tls:\n  certFile: /tls.crt\n  keyFile: /tls.key\n"},
+		{name: "tls without key", data: header + "tls:\n  certFile: /tls.crt\n", expectErr: true},
+		{name: "zero quantity", data: header + "resource:\n  quantity: 0\n", expectErr: true},
+		{name: "unknown field", data: header + "pinNetwork: true\n", expectErr: true},
+		{name: "other version", data: "apiVersion: tke.cloud.tencent.com/v1\nkind: EniIPWebhookConfiguration\n", expectErr: true},
+		{name: "no kind", data: "apiVersion: tke.cloud.tencent.com/v1alpha1\n", expectErr: true},
+		{name: "invalid yaml", data: header + "pinNetworks: [\n", expectErr: true},
+	}
+	for _, test := range tests {
+		f, err := Parse([]byte(test.data))
+		if (err != nil) != test.expectErr {
+			t.Errorf("%s: expect error %t, got %v", test.name, test.expectErr, err)
+			continue
+		}
+		if err == nil && test.check != nil {
+			if err := test.check(f); err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			}
+		}
+	}
+}
+
+func TestWatcherCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "configfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	initial := header
+	if err := ioutil.WriteFile(path, []byte(initial), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var applied []*File
+	reject := false
+	w := NewWatcher(path, []byte(initial), func(f *File) error {
+		if reject {
+			return fmt.Errorf("rejected")
+		}
+		applied = append(applied, f)
+		return nil
+	})
+
+	tests := []struct {
+		name string
+		// data is written before the check, the file is removed if nil
+		data    *string
+		reject  bool
+		applied int
+	}{
+		{name: "unchanged", data: &initial},
+		{name: "changed", data: strptr(header + "pinNetworks: true\n"), applied: 1},
+		{name: "invalid", data: strptr(header + "pinNetwork: true\n"), applied: 1},
+		{name: "valid again", data: strptr(header + "stripStale: true\n"), applied: 2},
+		{name: "rejected", data: strptr(header + "stripStale: false\n"), reject: true, applied: 2},
+		{name: "rejected change is not retried", data: strptr(header + "stripStale: false\n"), applied: 2},
+		{name: "removed", applied: 2},
+		{name: "back to the initial", data: &initial, applied: 3},
+	}
+	for _, test := range tests {
+		if test.data == nil {
+			os.Remove(path)
+		} else if err := ioutil.WriteFile(path, []byte(*test.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		reject = test.reject
+		w.check()
+		if len(applied) != test.applied {
+			t.Errorf("%s: expect %d applied, got %d", test.name, test.applied, len(applied))
+		}
+	}
+	if len(applied) > 1 && (applied[1].StripStale == nil || !*applied[1].StripStale) {
+		t.Errorf("expect stripStale applied, got %+v", applied[1])
+	}
+}
+
+func strptr(s string) *string {
+	return &s
+}
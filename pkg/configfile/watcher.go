@@ -0,0 +1,79 @@
+package configfile
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/metrics"
+
+	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+var (
+	reloads = metrics.NewCounterVec("config_reloads_total",
+		"Changes of the configuration file, by result, one of applied, invalid and rejected.", "result")
+	lastApplied = metrics.NewGaugeVec("config_last_applied_timestamp_seconds",
+		"Unix time the configuration file in effect was applied.")
+	inEffect = metrics.NewGaugeVec("config_in_effect",
+		"Whether the configuration file on disk is the one in effect, 0 after an invalid or rejected change.")
+)
+
+// Results of reloads.
+const (
+	ResultApplied  = "applied"
+	ResultInvalid  = "invalid"
+	ResultRejected = "rejected"
+)
+
+// Watcher polls a configuration file and applies its changes. No file
+// notification library is vendored, and polling the content also follows
+// the symlink swaps of ConfigMap volumes.
+type Watcher struct {
+	path   string
+	apply  func(*File) error
+	loaded []byte
+}
+
+// NewWatcher returns a watcher of path, data is the content in effect, as
+// returned by Load. apply returns an error to reject a valid file, the
+// previous configuration stays in effect then.
+func NewWatcher(path string, data []byte, apply func(*File) error) *Watcher {
+	lastApplied.Set(float64(time.Now().Unix()))
+	inEffect.Set(1)
+	return &Watcher{path: path, apply: apply, loaded: data}
+}
+
+// Run checks the file every period until stopCh is closed.
+func (w *Watcher) Run(period time.Duration, stopCh <-chan struct{}) {
+	wait.Until(w.check, period, stopCh)
+}
+
+func (w *Watcher) check() {
+	f, data, err := Load(w.path)
+	if data == nil && err != nil {
+		glog.Warningf("Failed to read configuration %s, keep the one in effect: %v", w.path, err)
+		return
+	}
+	if bytes.Equal(data, w.loaded) {
+		return
+	}
+	// a failed change is not retried until the file changes again
+	w.loaded = data
+	if err != nil {
+		glog.Errorf("Configuration %s is invalid, keep the one in effect: %v", w.path, err)
+		reloads.Inc(ResultInvalid)
+		inEffect.Set(0)
+		return
+	}
+	if err := w.apply(f); err != nil {
+		glog.Errorf("Configuration %s is rejected, keep the one in effect: %v", w.path, err)
+		reloads.Inc(ResultRejected)
+		inEffect.Set(0)
+		return
+	}
+	glog.Infof("Configuration %s is applied", w.path)
+	reloads.Inc(ResultApplied)
+	lastApplied.Set(float64(time.Now().Unix()))
+	inEffect.Set(1)
+}
@@ -0,0 +1,100 @@
+package debug
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// Options of the debug handler.
+type Options struct {
+	// TokenFile holds the bearer token clients must send, it is read on
+	// every request so that a mounted Secret can be rotated.
+	TokenFile string
+	// State returns the effective state served on /debug/config as JSON.
+	State func() interface{}
+	// Handlers are served by path besides the debug endpoints, behind the
+	// same authentication.
+	Handlers map[string]http.Handler
+}
+
+// NewHandler serves /debug/config, /debug/loglevel, /debug/pprof/ and the
+// handlers of opts to clients authenticated by the bearer token of opts.
+func NewHandler(opts Options) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/config", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(opts.State()); err != nil {
+			glog.Errorf("Failed to encode debug config: %v", err)
+		}
+	})
+	mux.HandleFunc("/debug/loglevel", logLevel)
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	for path, handler := range opts.Handlers {
+		mux.Handle(path, handler)
+	}
+	return &authenticator{tokenFile: opts.TokenFile, next: mux}
+}
+
+// authenticator rejects requests without the bearer token of tokenFile.
+type authenticator struct {
+	tokenFile string
+	next      http.Handler
+}
+
+func (a *authenticator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	data, err := ioutil.ReadFile(a.tokenFile)
+	token := strings.TrimSpace(string(data))
+	if err != nil || token == "" {
+		glog.Errorf("Debug token %s is unavailable, deny %s: %v", a.tokenFile, r.URL.Path, err)
+		http.Error(w, "debug token is unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) || subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, prefix)), []byte(token)) != 1 {
+		glog.Warningf("Unauthenticated debug request %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	a.next.ServeHTTP(w, r)
+}
+
+// logLevel returns the glog verbosity, PUT with ?v=N changes it.
+func logLevel(w http.ResponseWriter, r *http.Request) {
+	v := flag.Lookup("v")
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		level := r.URL.Query().Get("v")
+		if n, err := strconv.Atoi(level); err != nil || n < 0 {
+			http.Error(w, fmt.Sprintf("invalid verbosity %q, expect a non negative integer", level), http.StatusBadRequest)
+			return
+		}
+		old := v.Value.String()
+		if err := v.Value.Set(level); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		glog.Infof("Log verbosity changed from %s to %s by %s", old, level, r.RemoteAddr)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	fmt.Fprintf(w, "%s\n", v.Value.String())
+}
@@ -0,0 +1,61 @@
+package debug
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuthentication(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	handler := NewHandler(Options{
+		TokenFile: tokenFile,
+		State:     func() interface{} { return map[string]string{"version": "test"} },
+		Handlers: map[string]http.Handler{"/simulate": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("simulated"))
+		})},
+	})
+	tests := []struct {
+		name  string
+		token string
+		// file is the content of the token file, nil if it does not exist
+		file []byte
+		path string
+		code int
+	}{
+		{name: "valid", token: "secret", file: []byte("secret\n"), path: "/debug/config", code: http.StatusOK},
+		{name: "extra handler", token: "secret", file: []byte("secret"), path: "/simulate", code: http.StatusOK},
+		{name: "wrong token", token: "guess", file: []byte("secret"), path: "/debug/config", code: http.StatusUnauthorized},
+		{name: "no token", file: []byte("secret"), path: "/debug/pprof/", code: http.StatusUnauthorized},
+		{name: "extra handler without token", file: []byte("secret"), path: "/simulate", code: http.StatusUnauthorized},
+		{name: "empty token file", file: []byte("\n"), path: "/debug/config", code: http.StatusServiceUnavailable},
+		{name: "no token file", token: "secret", path: "/debug/config", code: http.StatusServiceUnavailable},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			os.Remove(tokenFile)
+			if test.file != nil {
+				if err := ioutil.WriteFile(tokenFile, test.file, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			req := httptest.NewRequest(http.MethodGet, test.path, nil)
+			if test.token != "" {
+				req.Header.Set("Authorization", "Bearer "+test.token)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != test.code {
+				t.Errorf("code = %d, want %d: %s", rec.Code, test.code, rec.Body)
+			}
+		})
+	}
+}
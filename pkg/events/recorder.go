@@ -0,0 +1,52 @@
+package events
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Recorder creates events about objects on behalf of component.
+type Recorder struct {
+	client    kubernetes.Interface
+	component string
+	host      string
+}
+
+// NewRecorder returns a recorder creating events by client.
+func NewRecorder(client kubernetes.Interface, component string) *Recorder {
+	host, _ := os.Hostname()
+	return &Recorder{client: client, component: component, host: host}
+}
+
+// Eventf creates an event about ref, failures are only logged.
+func (r *Recorder) Eventf(ref *corev1.ObjectReference, eventType, reason, messageFmt string, args ...interface{}) {
+	namespace := ref.Namespace
+	if namespace == "" {
+		namespace = metav1.NamespaceDefault
+	}
+	now := metav1.Now()
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%v.%x", ref.Name, now.UnixNano()),
+			Namespace: namespace,
+		},
+		InvolvedObject: *ref,
+		Reason:         reason,
+		Message:        fmt.Sprintf(messageFmt, args...),
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+		Type:           eventType,
+		Source:         corev1.EventSource{Component: r.component, Host: r.host},
+	}
+	if _, err := r.client.CoreV1().Events(namespace).Create(event); err != nil {
+		glog.Warningf("Failed to create event %s of %s %s/%s: %v", reason, ref.Kind, ref.Namespace, ref.Name, err)
+		return
+	}
+	glog.V(4).Infof("Event(%s %s/%s): type: %s reason: %s %s", ref.Kind, ref.Namespace, ref.Name, eventType, reason, event.Message)
+}
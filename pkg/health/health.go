@@ -0,0 +1,35 @@
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Check returns a non empty message when the webhook runs degraded.
+type Check func() string
+
+// Healthz reports the webhook is alive.
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprint(w, "ok")
+}
+
+// Readyz reports the webhook is ready along with degraded checks. A degraded
+// webhook still serves admissions with fallback values, so it keeps reporting
+// ready, otherwise the service loses its endpoints and pod creation is blocked.
+func Readyz(checks ...Check) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var messages []string
+		for _, check := range checks {
+			if msg := check(); msg != "" {
+				messages = append(messages, msg)
+			}
+		}
+		if len(messages) == 0 {
+			fmt.Fprint(w, "ok")
+			return
+		}
+		w.Header().Set("X-Webhook-Degraded", "true")
+		fmt.Fprintf(w, "degraded:\n%s", strings.Join(messages, "\n"))
+	}
+}
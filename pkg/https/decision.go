@@ -0,0 +1,250 @@
+package https
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// Where the networks of a pod come from.
+const (
+	NetworksFromPod       = "pod"
+	NetworksFromNamespace = "namespace"
+	NetworksFromCluster   = "cluster"
+)
+
+type decision struct {
+	// inject is whether the pod uses tke-route-eni and needs eni-ip.
+	inject bool
+	// routeENI is whether the networks use tke-route-eni, whatever policies
+	// and checks decide.
+	routeENI bool
+	// networks is empty when they are unknown, it happens when networks come
+	// from the cluster default cni without multus config.
+	networks string
+	source   string
+	reason   string
+	// rejection is the message to deny the pod with, if not empty.
+	rejection string
+	// skipped is whether the pod is left unchanged though it may use
+	// tke-route-eni, e.g. bound for virtual nodes or skipped by a policy.
+	skipped bool
+	// unsure tells why the networks may be wrong, e.g. the cluster default
+	// cni is a fallback, nothing is stripped from the pod then.
+	unsure string
+	// warnings are returned to the client creating the pod.
+	warnings []string
+	// stripped are containers whose stale eni-ip is removed.
+	stripped []string
+	// protected is whether the pod is in a protected namespace, which is
+	// never mutated.
+	protected bool
+	// policy is the name of the policy deciding the pod, if any.
+	policy string
+	match  *PolicyMatch
+	// resource and quantity limited by the first container on inject.
+	resource corev1.ResourceName
+	quantity resource.Quantity
+	// steps explain how the decision is reached, in order.
+	steps []string
+}
+
+func (d *decision) step(format string, args ...interface{}) {
+	d.steps = append(d.steps, fmt.Sprintf(format, args...))
+}
+
+// summary tells what is decided and why, for logs.
+func (d decision) summary() string {
+	switch {
+	case d.rejection != "":
+		return d.rejection
+	case d.inject && d.policy != "":
+		return fmt.Sprintf("inject %s %s by EniIPPolicy %s", d.quantity.String(), d.resource, d.policy)
+	case d.inject:
+		return fmt.Sprintf("inject %s %s, networks %q from %s", d.quantity.String(), d.resource, d.networks, d.source)
+	}
+	return d.reason
+}
+
+// decide resolves the networks of pod from the pod annotation, the namespace
+// default networks and the cluster default cni in order. A matching policy
+// takes precedence over the networks. Nodes and headroom are not checked for
+// a running pod, which is not scheduled again.
+func (s *httpsSvr) decide(namespace string, pod *corev1.Pod, running bool) decision {
+	if s.protected[namespace] {
+		d := decision{protected: true, reason: fmt.Sprintf("namespace %s is protected", namespace)}
+		d.step("namespace %s is protected, admitted unchanged", namespace)
+		return d
+	}
+	d := decision{resource: s.resource, quantity: s.quantity}
+	if pod.Spec.HostNetwork {
+		d.reason = "hostNetwork"
+		d.step("hostNetwork pod uses no pod networks")
+	} else {
+		s.resolveNetworks(namespace, pod, &d)
+	}
+	if s.policies != nil {
+		m, unsure := s.policies.Match(namespace, pod, policyNetworks(d, pod))
+		if m != nil {
+			d.step("EniIPPolicy %s matches, action %s", m.Name, m.Action)
+			s.applyPolicy(pod, &d, m)
+			if m.Action != PolicyInject {
+				return d
+			}
+		} else if unsure != "" {
+			d.warnings = append(d.warnings, fmt.Sprintf("EniIPPolicies may be missed since %s, the pod is decided by its networks", unsure))
+			if d.unsure == "" {
+				d.unsure = unsure
+			}
+			d.step("EniIPPolicies may be missed, %s", unsure)
+		} else {
+			d.step("no EniIPPolicy matches")
+		}
+	}
+	if !d.inject {
+		return d
+	}
+	if s.virtualNodes != nil {
+		if reason, ok := s.virtualNodes.VirtualNode(pod); ok {
+			d.inject, d.skipped = false, true
+			d.reason = fmt.Sprintf("bound for virtual node by %s", reason)
+			d.step("skipped, %s", d.reason)
+			return d
+		}
+		if reason, ok := s.virtualNodes.MayRunOnVirtualNode(pod); ok {
+			d.warnings = append(d.warnings, fmt.Sprintf("the pod may be scheduled onto virtual nodes by %s, which do not advertise %s, it is added since the pod may run on other nodes; select virtual nodes by nodeSelector or required node affinity to skip it",
+				reason, d.resource))
+			d.step("may run on virtual nodes by %s, not skipped", reason)
+		}
+	}
+	if running {
+		d.step("running pod, nodes and headroom are not checked")
+	} else if d.resource == UnderlayIPResource {
+		s.checkCapacity(pod, &d)
+	}
+	return d
+}
+
+func (s *httpsSvr) resolveNetworks(namespace string, pod *corev1.Pod, d *decision) {
+	d.source = NetworksFromCluster
+	if networks, ok := pod.Annotations[CNINetworksAnnotation]; ok {
+		d.networks, d.source = networks, NetworksFromPod
+	} else if s.namespaceDefaults != nil {
+		if networks, ok := s.namespaceDefaults.DefaultNetworks(namespace); ok {
+			d.networks, d.source = networks, NetworksFromNamespace
+		} else if !s.namespaceDefaults.Known(namespace) {
+			d.unsure = fmt.Sprintf("namespace %s is not synced, its default networks are unknown", namespace)
+		}
+	}
+
+	if d.source == NetworksFromCluster {
+		d.inject = s.defaultCNI.DefaultCNI()
+		d.networks = s.defaultCNI.DefaultNetworks()
+		if degraded := s.defaultCNI.Degraded(); degraded != "" && d.unsure == "" {
+			d.unsure = degraded
+		}
+		d.step("no networks annotation, cluster default cni is %s: %t", TKERouteENI, d.inject)
+		if d.unsure != "" {
+			d.step("networks are unsure, %s", d.unsure)
+		}
+	} else {
+		d.inject = strings.Contains(d.networks, TKERouteENI)
+		d.step("networks %q from %s, using %s: %t", d.networks, d.source, TKERouteENI, d.inject)
+	}
+	d.routeENI = d.inject
+	if !d.inject {
+		d.reason = fmt.Sprintf("not %s", TKERouteENI)
+	}
+}
+
+// policyNetworks returns the networks pod is matched against policies with.
+func policyNetworks(d decision, pod *corev1.Pod) []string {
+	if pod.Spec.HostNetwork {
+		return []string{PolicyHostNetwork}
+	}
+	var networks []string
+	for _, network := range strings.Split(d.networks, ",") {
+		if network = strings.TrimSpace(network); network != "" {
+			networks = append(networks, network)
+		}
+	}
+	if len(networks) == 0 && d.inject {
+		// the cluster default cni is tke-route-eni without multus config
+		networks = []string{TKERouteENI}
+	}
+	return networks
+}
+
+// applyPolicy decides pod by the matching policy m.
+func (s *httpsSvr) applyPolicy(pod *corev1.Pod, d *decision, m *PolicyMatch) {
+	d.policy, d.match = m.Name, m
+	switch m.Action {
+	case PolicyReject:
+		d.inject = false
+		d.rejection = fmt.Sprintf("rejected by EniIPPolicy %s", m.Name)
+		if m.Message != "" {
+			d.rejection += ": " + m.Message
+		}
+	case PolicySkip:
+		// nothing is mutated, not even stale eni-ip stripped
+		d.inject, d.skipped = false, true
+		d.reason = fmt.Sprintf("skipped by EniIPPolicy %s", m.Name)
+	case PolicyInject:
+		// checked against virtual nodes and capacity by decide
+		d.inject, d.reason = true, ""
+		d.resource, d.quantity = m.Resource, m.Quantity
+	}
+}
+
+// checkCapacity checks nodes and headroom of a pod to be injected.
+func (s *httpsSvr) checkCapacity(pod *corev1.Pod, d *decision) {
+	s.checkNodes(pod, d)
+	if d.inject && d.rejection == "" {
+		s.checkHeadroom(pod, d)
+	}
+}
+
+// checkNodes skips or rejects a tke-route-eni pod if none of the nodes it may
+// be scheduled onto advertises eni-ip, it would be pending forever otherwise.
+func (s *httpsSvr) checkNodes(pod *corev1.Pod, d *decision) {
+	if s.nodeCheck == "" || s.nodeCheck == NodeCheckOff {
+		return
+	}
+	eligible, known := s.nodeEligibility.HasEligibleNode(pod)
+	if !known || eligible {
+		return
+	}
+	msg := fmt.Sprintf("no node matching nodeName, nodeSelector and required node affinity of the pod advertises %s", UnderlayIPResource)
+	if s.nodeCheck == NodeCheckReject {
+		d.rejection = fmt.Sprintf("pod uses %s but %s", TKERouteENI, msg)
+		d.step("node check rejects, %s", msg)
+		return
+	}
+	d.inject, d.skipped = false, true
+	d.reason = msg
+	d.step("node check skips, %s", msg)
+}
+
+// checkHeadroom warns about or rejects a tke-route-eni pod if the nodes it may
+// be scheduled onto have no free eni-ip, it would be pending until some is
+// released otherwise.
+func (s *httpsSvr) checkHeadroom(pod *corev1.Pod, d *decision) {
+	if s.headroomCheck == "" || s.headroomCheck == HeadroomCheckOff {
+		return
+	}
+	free, known := s.headroom.Headroom(pod)
+	if !known || free >= d.quantity.Value() {
+		return
+	}
+	msg := fmt.Sprintf("no %s headroom, nodes matching nodeName, nodeSelector and required node affinity of the pod have %d free, the pod stays Pending until %s is released or nodes are added",
+		UnderlayIPResource, free, UnderlayIPResource)
+	if s.headroomCheck == HeadroomCheckReject {
+		d.rejection = msg
+		d.step("headroom check rejects, %s", msg)
+		return
+	}
+	d.warnings = append(d.warnings, msg)
+	d.step("headroom check warns, %s", msg)
+}
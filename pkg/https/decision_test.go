@@ -0,0 +1,418 @@
+package https
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type fakeDefaultCNI struct {
+	defaultCNI bool
+	networks   string
+	degraded   string
+}
+
+func (f fakeDefaultCNI) DefaultCNI() bool        { return f.defaultCNI }
+func (f fakeDefaultCNI) DefaultNetworks() string { return f.networks }
+func (f fakeDefaultCNI) Degraded() string        { return f.degraded }
+
+// fakeNamespaces are namespace default networks, namespaces not in networks
+// are unknown unless synced.
+type fakeNamespaces struct {
+	networks map[string]string
+	synced   bool
+}
+
+func (f fakeNamespaces) DefaultNetworks(namespace string) (string, bool) {
+	networks, ok := f.networks[namespace]
+	return networks, ok
+}
+
+func (f fakeNamespaces) Known(namespace string) bool {
+	_, ok := f.networks[namespace]
+	return ok || f.synced
+}
+
+var (
+	clusterRouteENI = fakeDefaultCNI{defaultCNI: true, networks: TKERouteENI}
+	clusterBridge   = fakeDefaultCNI{networks: "tke-bridge"}
+)
+
+func newPod(annotations map[string]string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "default", Annotations: annotations},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "c"}}},
+	}
+}
+
+func networksAnnotation(networks string) map[string]string {
+	return map[string]string{CNINetworksAnnotation: networks}
+}
+
+func TestDecideNetworks(t *testing.T) {
+	hostNetwork := newPod(nil)
+	hostNetwork.Spec.HostNetwork = true
+	tests := []struct {
+		name      string
+		opts      Options
+		namespace string
+		pod       *corev1.Pod
+		inject    bool
+		source    string
+		networks  string
+	}{
+		{
+			name:     "pod annotation with route eni",
+			opts:     Options{DefaultCNI: clusterBridge},
+			pod:      newPod(networksAnnotation("tke-bridge,tke-route-eni")),
+			inject:   true,
+			source:   NetworksFromPod,
+			networks: "tke-bridge,tke-route-eni",
+		},
+		{
+			name:     "pod annotation without route eni",
+			opts:     Options{DefaultCNI: clusterRouteENI},
+			pod:      newPod(networksAnnotation("tke-bridge")),
+			source:   NetworksFromPod,
+			networks: "tke-bridge",
+		},
+		{
+			name:     "pod annotation over namespace default",
+			opts:     Options{DefaultCNI: clusterBridge, NamespaceDefaults: fakeNamespaces{networks: map[string]string{"default": "tke-route-eni"}}},
+			pod:      newPod(networksAnnotation("tke-bridge")),
+			source:   NetworksFromPod,
+			networks: "tke-bridge",
+		},
+		{
+			name:     "namespace default",
+			opts:     Options{DefaultCNI: clusterBridge, NamespaceDefaults: fakeNamespaces{networks: map[string]string{"default": "tke-route-eni"}}},
+			pod:      newPod(nil),
+			inject:   true,
+			source:   NetworksFromNamespace,
+			networks: TKERouteENI,
+		},
+		{
+			name:     "namespace default of other namespace",
+			opts:     Options{DefaultCNI: clusterBridge, NamespaceDefaults: fakeNamespaces{networks: map[string]string{"other": "tke-route-eni"}, synced: true}},
+			pod:      newPod(nil),
+			source:   NetworksFromCluster,
+			networks: "tke-bridge",
+		},
+		{
+			name:     "cluster default route eni",
+			opts:     Options{DefaultCNI: clusterRouteENI},
+			pod:      newPod(nil),
+			inject:   true,
+			source:   NetworksFromCluster,
+			networks: TKERouteENI,
+		},
+		{
+			name:   "cluster default route eni without multus config",
+			opts:   Options{DefaultCNI: fakeDefaultCNI{defaultCNI: true}},
+			pod:    newPod(nil),
+			inject: true,
+			source: NetworksFromCluster,
+		},
+		{
+			name:     "cluster default bridge",
+			opts:     Options{DefaultCNI: clusterBridge},
+			pod:      newPod(nil),
+			source:   NetworksFromCluster,
+			networks: "tke-bridge",
+		},
+		{
+			name: "host network",
+			opts: Options{DefaultCNI: clusterRouteENI},
+			pod:  hostNetwork,
+		},
+		{
+			name:      "protected namespace",
+			opts:      Options{DefaultCNI: clusterRouteENI, ProtectedNamespaces: []string{"kube-system"}},
+			namespace: "kube-system",
+			pod:       newPod(networksAnnotation(TKERouteENI)),
+		},
+	}
+	for _, test := range tests {
+		s := NewHttpsServer(test.opts).(*httpsSvr)
+		namespace := test.namespace
+		if namespace == "" {
+			namespace = "default"
+		}
+		d := s.decide(namespace, test.pod, false)
+		if d.inject != test.inject || d.source != test.source || d.networks != test.networks {
+			t.Errorf("%s: expect inject %t networks %q from %q, got %t %q from %q",
+				test.name, test.inject, test.networks, test.source, d.inject, d.networks, d.source)
+		}
+		if d.inject && (d.resource != UnderlayIPResource || d.quantity.Value() != 1) {
+			t.Errorf("%s: expect 1 %s, got %s %s", test.name, UnderlayIPResource, d.quantity.String(), d.resource)
+		}
+	}
+}
+
+// describePatches returns "op path value" of every patch.
+func describePatches(patches []ThingSpec) []string {
+	var described []string
+	for _, p := range patches {
+		described = append(described, fmt.Sprintf("%s %s %s", p.Op, p.Path, p.Value))
+	}
+	return described
+}
+
+func TestReviewPinNetworks(t *testing.T) {
+	namespaceDefaults := fakeNamespaces{networks: map[string]string{"default": "tke-bridge"}}
+	tests := []struct {
+		name    string
+		opts    Options
+		pod     *corev1.Pod
+		patches []string
+	}{
+		{
+			name:    "namespace default",
+			opts:    Options{DefaultCNI: clusterRouteENI, NamespaceDefaults: namespaceDefaults, PinNetworks: true},
+			pod:     newPod(nil),
+			patches: []string{`add /metadata/annotations {"tke.cloud.tencent.com/networks":"tke-bridge"}`},
+		},
+		{
+			name: "cluster default into existing annotations",
+			opts: Options{DefaultCNI: clusterRouteENI, PinNetworks: true},
+			pod:  newPod(map[string]string{"app": "x"}),
+			patches: []string{
+				`add /metadata/annotations/tke.cloud.tencent.com~1networks "tke-route-eni"`,
+				`replace /spec/containers/0/resources {"limits":{"tke.cloud.tencent.com/eni-ip":"1"}}`,
+			},
+		},
+		{
+			name: "pod annotation is kept",
+			opts: Options{DefaultCNI: clusterBridge, PinNetworks: true},
+			pod:  newPod(networksAnnotation("tke-bridge")),
+		},
+		{
+			name: "unknown cluster networks",
+			opts: Options{DefaultCNI: fakeDefaultCNI{}, PinNetworks: true},
+			pod:  newPod(nil),
+		},
+		{
+			name: "disabled",
+			opts: Options{DefaultCNI: clusterBridge},
+			pod:  newPod(nil),
+		},
+	}
+	for _, test := range tests {
+		s := NewHttpsServer(test.opts).(*httpsSvr)
+		_, patches, err := s.review(context.Background(), "default", test.pod, "", "pod", false)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if described := describePatches(patches); !reflect.DeepEqual(described, test.patches) {
+			t.Errorf("%s: expect patches %q, got %q", test.name, test.patches, described)
+		}
+	}
+}
+
+type fakeEligibility struct {
+	eligible, known bool
+}
+
+func (f fakeEligibility) HasEligibleNode(pod *corev1.Pod) (bool, bool) { return f.eligible, f.known }
+
+func TestDecideNodeCheck(t *testing.T) {
+	tests := []struct {
+		name      string
+		check     string
+		nodes     fakeEligibility
+		inject    bool
+		skipped   bool
+		rejection bool
+	}{
+		{"off", NodeCheckOff, fakeEligibility{}, true, false, false},
+		{"eligible", NodeCheckReject, fakeEligibility{eligible: true, known: true}, true, false, false},
+		{"unknown", NodeCheckReject, fakeEligibility{}, true, false, false},
+		{"skip", NodeCheckSkip, fakeEligibility{known: true}, false, true, false},
+		{"reject", NodeCheckReject, fakeEligibility{known: true}, true, false, true},
+	}
+	for _, test := range tests {
+		s := NewHttpsServer(Options{DefaultCNI: clusterRouteENI, NodeCheck: test.check, NodeEligibility: test.nodes}).(*httpsSvr)
+		d := s.decide("default", newPod(nil), false)
+		if d.inject != test.inject || d.skipped != test.skipped || (d.rejection != "") != test.rejection {
+			t.Errorf("%s: expect inject %t skipped %t rejection %t, got %t %t %q",
+				test.name, test.inject, test.skipped, test.rejection, d.inject, d.skipped, d.rejection)
+		}
+	}
+}
+
+type fakeVirtualNodes struct {
+	virtual, mayRun bool
+}
+
+func (f fakeVirtualNodes) VirtualNode(pod *corev1.Pod) (string, bool) {
+	return "nodeSelector type=virtual-kubelet", f.virtual
+}
+
+func (f fakeVirtualNodes) MayRunOnVirtualNode(pod *corev1.Pod) (string, bool) {
+	return "toleration of virtual-kubelet.io/provider", f.mayRun
+}
+
+func TestDecideVirtualNode(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     Options
+		nodes    fakeVirtualNodes
+		inject   bool
+		skipped  bool
+		warnings int
+	}{
+		{"not virtual", Options{DefaultCNI: clusterRouteENI}, fakeVirtualNodes{}, true, false, 0},
+		{"virtual", Options{DefaultCNI: clusterRouteENI}, fakeVirtualNodes{virtual: true, mayRun: true}, false, true, 0},
+		{"may run on virtual", Options{DefaultCNI: clusterRouteENI}, fakeVirtualNodes{mayRun: true}, true, false, 1},
+		{"not route eni", Options{DefaultCNI: clusterBridge}, fakeVirtualNodes{virtual: true}, false, false, 0},
+	}
+	for _, test := range tests {
+		test.opts.VirtualNodes = test.nodes
+		s := NewHttpsServer(test.opts).(*httpsSvr)
+		d := s.decide("default", newPod(nil), false)
+		if d.inject != test.inject || d.skipped != test.skipped || len(d.warnings) != test.warnings {
+			t.Errorf("%s: expect inject %t skipped %t %d warnings, got %t %t %q",
+				test.name, test.inject, test.skipped, test.warnings, d.inject, d.skipped, d.warnings)
+		}
+	}
+}
+
+type fakeHeadroom struct {
+	free  int64
+	known bool
+}
+
+func (f fakeHeadroom) Headroom(pod *corev1.Pod) (int64, bool) { return f.free, f.known }
+
+func TestDecideHeadroomCheck(t *testing.T) {
+	tests := []struct {
+		name      string
+		check     string
+		headroom  fakeHeadroom
+		warnings  int
+		rejection bool
+	}{
+		{"off", HeadroomCheckOff, fakeHeadroom{known: true}, 0, false},
+		{"enough", HeadroomCheckReject, fakeHeadroom{free: 1, known: true}, 0, false},
+		{"unknown", HeadroomCheckReject, fakeHeadroom{}, 0, false},
+		{"warn", HeadroomCheckWarn, fakeHeadroom{known: true}, 1, false},
+		{"reject", HeadroomCheckReject, fakeHeadroom{known: true}, 0, true},
+	}
+	for _, test := range tests {
+		s := NewHttpsServer(Options{DefaultCNI: clusterRouteENI, HeadroomCheck: test.check, Headroom: test.headroom}).(*httpsSvr)
+		d := s.decide("default", newPod(nil), false)
+		if !d.inject || len(d.warnings) != test.warnings || (d.rejection != "") != test.rejection {
+			t.Errorf("%s: expect inject, %d warnings, rejection %t, got %t %q %q",
+				test.name, test.warnings, test.rejection, d.inject, d.warnings, d.rejection)
+		}
+	}
+
+	// nodes are checked first, a skipped pod needs no headroom
+	s := NewHttpsServer(Options{
+		DefaultCNI:      clusterRouteENI,
+		NodeCheck:       NodeCheckSkip,
+		NodeEligibility: fakeEligibility{known: true},
+		HeadroomCheck:   HeadroomCheckReject,
+		Headroom:        fakeHeadroom{known: true},
+	}).(*httpsSvr)
+	if d := s.decide("default", newPod(nil), false); !d.skipped || d.rejection != "" {
+		t.Errorf("expect skipped by node check without rejection, got skipped %t %q", d.skipped, d.rejection)
+	}
+}
+
+type fakePolicies struct {
+	match  *PolicyMatch
+	unsure string
+}
+
+func (f fakePolicies) Match(namespace string, pod *corev1.Pod, networks []string) (*PolicyMatch, string) {
+	return f.match, f.unsure
+}
+
+func (f fakePolicies) Matched(name string) {}
+
+func TestDecideUnsure(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   Options
+		pod    *corev1.Pod
+		unsure bool
+	}{
+		{"synced namespace", Options{DefaultCNI: clusterBridge, NamespaceDefaults: fakeNamespaces{synced: true}}, newPod(nil), false},
+		{"namespace not synced", Options{DefaultCNI: clusterBridge, NamespaceDefaults: fakeNamespaces{}}, newPod(nil), true},
+		{"namespace not synced with pod annotation", Options{DefaultCNI: clusterBridge, NamespaceDefaults: fakeNamespaces{}}, newPod(networksAnnotation("tke-bridge")), false},
+		{"degraded cluster default", Options{DefaultCNI: fakeDefaultCNI{networks: "tke-bridge", degraded: "multus config is not found"}}, newPod(nil), true},
+		{"degraded cluster default with pod annotation", Options{DefaultCNI: fakeDefaultCNI{degraded: "multus config is not found"}}, newPod(networksAnnotation("tke-bridge")), false},
+		{"policies not listed", Options{DefaultCNI: clusterBridge, Policies: fakePolicies{unsure: "EniIPPolicies are not listed yet"}}, newPod(nil), true},
+	}
+	for _, test := range tests {
+		s := NewHttpsServer(test.opts).(*httpsSvr)
+		if d := s.decide("default", test.pod, false); (d.unsure != "") != test.unsure {
+			t.Errorf("%s: expect unsure %t, got %q", test.name, test.unsure, d.unsure)
+		}
+	}
+}
+
+func TestReviewStripStale(t *testing.T) {
+	withENIIP := func(annotations map[string]string) *corev1.Pod {
+		pod := newPod(annotations)
+		pod.Spec.Containers[0].Resources.Limits = corev1.ResourceList{UnderlayIPResource: resource.MustParse("1")}
+		return pod
+	}
+	skip := fakePolicies{match: &PolicyMatch{Name: "skip", Action: PolicySkip}}
+	tests := []struct {
+		name    string
+		opts    Options
+		pod     *corev1.Pod
+		patches []string
+	}{
+		{
+			name:    "not route eni",
+			opts:    Options{DefaultCNI: clusterRouteENI, StripStale: true},
+			pod:     withENIIP(networksAnnotation("tke-bridge")),
+			patches: []string{"remove /spec/containers/0/resources/limits/tke.cloud.tencent.com~1eni-ip null"},
+		},
+		{
+			name: "disabled",
+			opts: Options{DefaultCNI: clusterRouteENI},
+			pod:  withENIIP(networksAnnotation("tke-bridge")),
+		},
+		{
+			name: "namespace not synced",
+			opts: Options{DefaultCNI: clusterBridge, NamespaceDefaults: fakeNamespaces{}, StripStale: true},
+			pod:  withENIIP(nil),
+		},
+		{
+			name: "degraded cluster default",
+			opts: Options{DefaultCNI: fakeDefaultCNI{networks: "tke-bridge", degraded: "multus config is not found"}, StripStale: true},
+			pod:  withENIIP(nil),
+		},
+		{
+			name: "skipped by policy",
+			opts: Options{DefaultCNI: clusterRouteENI, Policies: skip, StripStale: true},
+			pod:  withENIIP(networksAnnotation("tke-bridge")),
+		},
+		{
+			name: "skipped for virtual node",
+			opts: Options{DefaultCNI: clusterRouteENI, VirtualNodes: fakeVirtualNodes{virtual: true}, StripStale: true},
+			pod:  withENIIP(nil),
+		},
+	}
+	for _, test := range tests {
+		s := NewHttpsServer(test.opts).(*httpsSvr)
+		_, patches, err := s.review(context.Background(), "default", test.pod, "", "pod", false)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if described := describePatches(patches); !reflect.DeepEqual(described, test.patches) {
+			t.Errorf("%s: expect patches %q, got %q", test.name, test.patches, described)
+		}
+	}
+}
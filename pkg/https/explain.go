@@ -0,0 +1,127 @@
+package https
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// Result explains how a pod or workload is mutated.
+type Result struct {
+	// Inject is whether eni-ip is requested.
+	Inject         bool   `json:"inject"`
+	Networks       string `json:"networks,omitempty"`
+	NetworksSource string `json:"networksSource,omitempty"`
+	Reason         string `json:"reason,omitempty"`
+	// Policy is the EniIPPolicy deciding the object, if any.
+	Policy string `json:"policy,omitempty"`
+	// Resource and Quantity limited by the first container if Inject.
+	Resource corev1.ResourceName `json:"resource,omitempty"`
+	Quantity string              `json:"quantity,omitempty"`
+	// Skipped is whether the object is left unchanged though it may use
+	// tke-route-eni, e.g. bound for virtual nodes.
+	Skipped bool `json:"skipped,omitempty"`
+	// Protected is whether the namespace is protected, its objects are
+	// never mutated.
+	Protected bool `json:"protected,omitempty"`
+	// Rejection is the message the object is denied with, if not empty.
+	Rejection string `json:"rejection,omitempty"`
+	// Patch is the JSON patch the webhook responds with, nil if unchanged.
+	// It may replace fields apiserver defaults, see ManifestPatch.
+	Patch json.RawMessage `json:"patch,omitempty"`
+	// Stripped are containers whose stale eni-ip is removed.
+	Stripped []string `json:"stripped,omitempty"`
+	// Warnings are returned to the client creating the object.
+	Warnings []string `json:"warnings,omitempty"`
+	// Steps explain how the decision is reached, in order.
+	Steps []string `json:"steps,omitempty"`
+}
+
+// Explain runs the admission logic on obj, a pod or a workload with a pod template.
+func (s *httpsSvr) Explain(namespace string, obj runtime.Object) (*Result, error) {
+	return s.explain(namespace, obj, false)
+}
+
+func (s *httpsSvr) ExplainRunning(pod *corev1.Pod) (*Result, error) {
+	return s.explain(pod.Namespace, pod, true)
+}
+
+func (s *httpsSvr) explain(namespace string, obj runtime.Object, running bool) (*Result, error) {
+	var pod *corev1.Pod
+	var prefix, kind string
+	if p, ok := obj.(*corev1.Pod); ok {
+		pod, kind = p, "pod"
+	} else {
+		for gvr, tr := range templateResources {
+			if reflect.TypeOf(tr.newObject()) != reflect.TypeOf(obj) {
+				continue
+			}
+			template := tr.template(obj)
+			pod = &corev1.Pod{ObjectMeta: template.ObjectMeta, Spec: template.Spec}
+			prefix, kind = tr.path, gvr.Resource
+			break
+		}
+	}
+	if pod == nil {
+		return nil, fmt.Errorf("unsupported object %T", obj)
+	}
+	if len(pod.Spec.Containers) == 0 {
+		return nil, fmt.Errorf("no container in %s", kind)
+	}
+	if accessor, err := meta.Accessor(obj); err == nil {
+		if accessor.GetNamespace() != "" {
+			namespace = accessor.GetNamespace()
+		}
+		if pod.Name == "" {
+			pod.Name = accessor.GetName()
+		}
+	}
+
+	d, patches, err := s.review(context.Background(), namespace, pod, prefix, kind, running)
+	if err != nil {
+		return nil, err
+	}
+	result := &Result{
+		Inject:         d.inject,
+		Networks:       d.networks,
+		NetworksSource: d.source,
+		Reason:         d.reason,
+		Policy:         d.policy,
+		Skipped:        d.skipped,
+		Protected:      d.protected,
+		Rejection:      d.rejection,
+		Stripped:       d.stripped,
+		Warnings:       d.warnings,
+		Steps:          d.steps,
+	}
+	if d.inject {
+		result.Resource, result.Quantity = d.resource, d.quantity.String()
+	}
+	if len(patches) > 0 {
+		if result.Patch, err = json.Marshal(patches); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// ManifestPatch returns a copy of patch applicable to a manifest rather than
+// an object defaulted by apiserver. Manifests may omit resources, which
+// replace requires, while add sets them either way.
+func ManifestPatch(patch json.RawMessage) (json.RawMessage, error) {
+	var patches []ThingSpec
+	if err := json.Unmarshal(patch, &patches); err != nil {
+		return nil, err
+	}
+	for i := range patches {
+		if patches[i].Op == PatchOPType {
+			patches[i].Op = "add"
+		}
+	}
+	return json.Marshal(patches)
+}
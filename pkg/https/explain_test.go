@@ -0,0 +1,44 @@
+package https
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/jsonpatch"
+)
+
+func TestExplainPatch(t *testing.T) {
+	s := NewHttpsServer(Options{DefaultCNI: clusterRouteENI})
+	result, err := s.Explain("default", newPod(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var patches []ThingSpec
+	if err := json.Unmarshal(result.Patch, &patches); err != nil {
+		t.Fatal(err)
+	}
+	// the live patch is returned as the webhook responds with it
+	if len(patches) != 1 || patches[0].Op != PatchOPType || patches[0].Path != "/spec/containers/0/resources" {
+		t.Fatalf("patch %s, want %s of the first container resources", result.Patch, PatchOPType)
+	}
+
+	manifest := `{"metadata":{"name":"pod"},"spec":{"containers":[{"name":"c"}]}}`
+	if _, err := jsonpatch.Apply([]byte(manifest), result.Patch); err == nil {
+		t.Error("replace applies to a manifest without resources")
+	}
+	patch, err := ManifestPatch(result.Patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutated, err := jsonpatch.Apply([]byte(manifest), patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(mutated), `"limits":{"tke.cloud.tencent.com/eni-ip":"1"}`) {
+		t.Errorf("mutated manifest %s has no eni-ip limit", mutated)
+	}
+	if !strings.Contains(string(result.Patch), `"op":"replace"`) {
+		t.Errorf("ManifestPatch modifies the live patch %s", result.Patch)
+	}
+}
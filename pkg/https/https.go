@@ -1,14 +1,15 @@
 package https
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"net/http"
-	"reflect"
+	"strconv"
 	"strings"
 
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/metrics"
 	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/schema"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/tracing"
 
 	"k8s.io/api/admission/v1beta1"
 	corev1 "k8s.io/api/core/v1"
@@ -26,8 +27,22 @@ const (
 	PatchOPType        = "replace"
 	UnderlayIPJsonPath = "/spec/containers/0/resources"
 	UnderlayIPResource = "tke.cloud.tencent.com/eni-ip"
+
+	AnnotationsJsonPath    = "/metadata/annotations"
+	ReadinessGatesJsonPath = "/spec/readinessGates"
+
+	// SkippedAuditAnnotation records why a tke-route-eni pod is not injected.
+	SkippedAuditAnnotation = "eni-ip-skipped"
+	// WarningsAuditAnnotation records the warnings returned to the client,
+	// which apiservers before 1.19 drop.
+	WarningsAuditAnnotation = "eni-ip-warnings"
+	// StrippedAuditAnnotation records containers whose eni-ip is removed.
+	StrippedAuditAnnotation = "eni-ip-stripped"
 )
 
+var protectedAdmissions = metrics.NewCounterVec("protected_namespace_admissions_total",
+	"Admissions of objects in protected namespaces, which the namespaceSelector should have excluded.", "namespace")
+
 func toAdmissionResponse(err error) *v1beta1.AdmissionResponse {
 	return &v1beta1.AdmissionResponse{
 		Result: &metav1.Status{
@@ -42,171 +57,482 @@ type ThingSpec struct {
 	Value json.RawMessage `json:"value"`
 }
 
-func getPatchData(res corev1.ResourceRequirements) ([]byte, error) {
-	if res.Limits == nil {
-		res.Limits = make(corev1.ResourceList)
+// eniIPQuantity is the eni-ip requested and limited by a tke-route-eni pod.
+var eniIPQuantity = resource.NewQuantity(1, resource.DecimalSI)
+
+// hasLimit returns whether res already limits and requests quantity of name
+// as resourcesPatch does, so that patching it again changes nothing.
+func hasLimit(res corev1.ResourceRequirements, name corev1.ResourceName, quantity resource.Quantity) bool {
+	limit, ok := res.Limits[name]
+	if !ok || limit.Cmp(quantity) != 0 {
+		return false
 	}
-	res.Limits[UnderlayIPResource] = *resource.NewQuantity(1, resource.DecimalSI)
-	replaceBytes, err := json.Marshal(res)
-	if err != nil {
-		return nil, err
+	if request, ok := res.Requests[name]; ok && request.Cmp(quantity) != 0 {
+		return false
 	}
+	return true
+}
 
-	things := make([]ThingSpec, 1)
-	things[0].Op = PatchOPType
-	things[0].Path = UnderlayIPJsonPath
-	things[0].Value = replaceBytes
-	patchBytes, err := json.Marshal(things)
-	if err != nil {
-		return nil, err
+// PodHasENIIP returns whether any container of pod limits eni-ip, pods
+// admitted without the webhook have none.
+func PodHasENIIP(pod *corev1.Pod) bool {
+	for _, c := range pod.Spec.Containers {
+		if _, ok := c.Resources.Limits[UnderlayIPResource]; ok {
+			return true
+		}
 	}
-	return patchBytes, nil
+	return false
 }
 
-type admitFunc func(v1beta1.AdmissionReview) *v1beta1.AdmissionResponse
+// resourcesPatch limits quantity of resource name in res.
+func resourcesPatch(prefix string, res corev1.ResourceRequirements, name corev1.ResourceName, quantity resource.Quantity) (ThingSpec, error) {
+	// copy so that the pod being reviewed is not modified
+	limits := make(corev1.ResourceList, len(res.Limits)+1)
+	for n, q := range res.Limits {
+		limits[n] = q
+	}
+	limits[name] = quantity
+	res.Limits = limits
+	if _, ok := res.Requests[name]; ok {
+		// a request other than the limit is invalid for extended resources
+		requests := make(corev1.ResourceList, len(res.Requests))
+		for n, q := range res.Requests {
+			requests[n] = q
+		}
+		requests[name] = quantity
+		res.Requests = requests
+	}
+	replaceBytes, err := json.Marshal(res)
+	if err != nil {
+		return ThingSpec{}, err
+	}
+
+	return ThingSpec{
+		Op:    PatchOPType,
+		Path:  prefix + UnderlayIPJsonPath,
+		Value: replaceBytes,
+	}, nil
+}
 
-func valueToStringGenerated(v interface{}) string {
-	rv := reflect.ValueOf(v)
-	if rv.IsNil() {
-		return "nil"
+// annotationPatch sets annotation key to value, annotations are the existing ones.
+func annotationPatch(prefix string, annotations map[string]string, key, value string) ThingSpec {
+	if annotations == nil {
+		valueBytes, _ := json.Marshal(map[string]string{key: value})
+		return ThingSpec{Op: "add", Path: prefix + AnnotationsJsonPath, Value: valueBytes}
 	}
-	pv := reflect.Indirect(rv).Interface()
-	return fmt.Sprintf("*%v", pv)
+	valueBytes, _ := json.Marshal(value)
+	return ThingSpec{Op: "add", Path: prefix + AnnotationsJsonPath + "/" + escapeJsonPointer(key), Value: valueBytes}
 }
 
-func formatResponse(this *v1beta1.AdmissionResponse) string {
-	if this == nil {
-		return "nil"
+// readinessGatePatch adds conditionType to readiness gates of pod, ok is false
+// if it is there already.
+func readinessGatePatch(prefix string, pod *corev1.Pod, conditionType string) (ThingSpec, bool) {
+	for _, gate := range pod.Spec.ReadinessGates {
+		if string(gate.ConditionType) == conditionType {
+			return ThingSpec{}, false
+		}
 	}
-	keysForAuditAnnotations := make([]string, 0, len(this.AuditAnnotations))
-	for k := range this.AuditAnnotations {
-		keysForAuditAnnotations = append(keysForAuditAnnotations, k)
+	gate := corev1.PodReadinessGate{ConditionType: corev1.PodConditionType(conditionType)}
+	if len(pod.Spec.ReadinessGates) == 0 {
+		valueBytes, _ := json.Marshal([]corev1.PodReadinessGate{gate})
+		return ThingSpec{Op: "add", Path: prefix + ReadinessGatesJsonPath, Value: valueBytes}, true
 	}
-	mapStringForAuditAnnotations := "map[string]string{"
-	for _, k := range keysForAuditAnnotations {
-		mapStringForAuditAnnotations += fmt.Sprintf("%v: %v,", k, this.AuditAnnotations[k])
+	valueBytes, _ := json.Marshal(gate)
+	return ThingSpec{Op: "add", Path: prefix + ReadinessGatesJsonPath + "/-", Value: valueBytes}, true
+}
+
+// stripPatches remove eni-ip from limits and requests of every container and
+// init container, and return the names of containers changed.
+func stripPatches(prefix string, spec *corev1.PodSpec) ([]ThingSpec, []string) {
+	var patches []ThingSpec
+	var stripped []string
+	strip := func(path string, containers []corev1.Container) {
+		for i, c := range containers {
+			changed := false
+			if _, ok := c.Resources.Limits[UnderlayIPResource]; ok {
+				patches = append(patches, ThingSpec{Op: "remove", Path: fmt.Sprintf("%s%s/%d/resources/limits/%s", prefix, path, i, escapeJsonPointer(string(UnderlayIPResource)))})
+				changed = true
+			}
+			if _, ok := c.Resources.Requests[UnderlayIPResource]; ok {
+				patches = append(patches, ThingSpec{Op: "remove", Path: fmt.Sprintf("%s%s/%d/resources/requests/%s", prefix, path, i, escapeJsonPointer(string(UnderlayIPResource)))})
+				changed = true
+			}
+			if changed {
+				stripped = append(stripped, c.Name)
+			}
+		}
 	}
-	mapStringForAuditAnnotations += "}"
-	s := strings.Join([]string{`&AdmissionResponse{`,
-		`UID:` + fmt.Sprintf("%v", this.UID) + `,`,
-		`Allowed:` + fmt.Sprintf("%v", this.Allowed) + `,`,
-		`Result:` + strings.Replace(fmt.Sprintf("%v", this.Result), "Status", "k8s_io_apimachinery_pkg_apis_meta_v1.Status", 1) + `,`,
-		`Patch:` + string(this.Patch) + `,`,
-		`PatchType:` + valueToStringGenerated(this.PatchType) + `,`,
-		`AuditAnnotations:` + mapStringForAuditAnnotations + `,`,
-		`}`,
-	}, "")
-	return s
+	strip("/spec/initContainers", spec.InitContainers)
+	strip("/spec/containers", spec.Containers)
+	return patches, stripped
+}
+
+// escapeJsonPointer escapes s as a JSON pointer reference token, see RFC 6901.
+func escapeJsonPointer(s string) string {
+	return strings.Replace(strings.Replace(s, "~", "~0", -1), "/", "~1", -1)
+}
+
+// admitFunc returns the response and warnings of ar.
+type admitFunc func(ctx context.Context, ar v1beta1.AdmissionReview) (*v1beta1.AdmissionResponse, []string)
+
+// admissionResponse adds warnings to v1beta1.AdmissionResponse. Apiservers
+// since 1.19 return them to clients, kubectl prints them, older apiservers
+// ignore the field.
+type admissionResponse struct {
+	*v1beta1.AdmissionResponse
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// admissionReview is v1beta1.AdmissionReview with warnings in the response.
+type admissionReview struct {
+	metav1.TypeMeta `json:",inline"`
+	Response        *admissionResponse `json:"response,omitempty"`
 }
 
 type HttpsServer interface {
-	ServeHttps(w http.ResponseWriter, r *http.Request)
+	// PodMutator adds eni-ip to pods using tke-route-eni.
+	PodMutator() Mutator
+	// TemplateMutator adds eni-ip to pod templates of workloads, see
+	// mutateTemplates.
+	TemplateMutator() Mutator
+	// Explain runs the same logic on a pod or workload outside of admission.
+	Explain(namespace string, obj runtime.Object) (*Result, error)
+	// ExplainRunning explains a running pod, which is not admitted again,
+	// so nodes and headroom are not checked.
+	ExplainRunning(pod *corev1.Pod) (*Result, error)
 }
 
-func NewHttpsServer(defaultCNI bool) HttpsServer {
-	return &httpsSvr{defaultCNI: defaultCNI}
+// DefaultCNI tells whether tke-route-eni is default cni, it may change while serving.
+type DefaultCNI interface {
+	DefaultCNI() bool
+	// DefaultNetworks returns the cluster default networks, empty if unknown.
+	DefaultNetworks() string
+	// Degraded returns why DefaultCNI is a fallback rather than resolved,
+	// empty if it is resolved.
+	Degraded() string
+}
+
+// NamespaceDefaults returns the default networks of pods in a namespace.
+type NamespaceDefaults interface {
+	DefaultNetworks(namespace string) (string, bool)
+	// Known returns whether namespace is known, the namespace may have
+	// default networks not returned by DefaultNetworks otherwise.
+	Known(namespace string) bool
+}
+
+// NodeEligibility tells whether a pod may be scheduled onto a node advertising
+// eni-ip, known is false if it can not tell.
+type NodeEligibility interface {
+	HasEligibleNode(pod *corev1.Pod) (eligible bool, known bool)
+}
+
+// VirtualNodeDetector tells why a pod is bound for virtual nodes, which never
+// advertise eni-ip, or why it may be scheduled onto them otherwise.
+type VirtualNodeDetector interface {
+	VirtualNode(pod *corev1.Pod) (reason string, ok bool)
+	MayRunOnVirtualNode(pod *corev1.Pod) (reason string, ok bool)
+}
+
+// Headroom tells how much eni-ip is free on nodes a pod may be scheduled onto,
+// known is false if it can not tell.
+type Headroom interface {
+	Headroom(pod *corev1.Pod) (free int64, known bool)
+}
+
+// Actions of policies.
+const (
+	PolicyInject = "Inject"
+	PolicySkip   = "Skip"
+	PolicyReject = "Reject"
+)
+
+// PolicyHostNetwork is the network hostNetwork pods are matched against
+// policies with.
+const PolicyHostNetwork = "hostNetwork"
+
+// PolicyMatch is the policy deciding how a pod requests eni-ip.
+type PolicyMatch struct {
+	Name     string              `json:"name"`
+	Action   string              `json:"action"`
+	Resource corev1.ResourceName `json:"resource,omitempty"`
+	Quantity resource.Quantity   `json:"quantity"`
+	Message  string              `json:"message,omitempty"`
+}
+
+// Inputs of a decision besides the request, see Mutation.Inputs.
+const (
+	InputDefaultCNI        = "defaultCNI"
+	InputDefaultNetworks   = "defaultNetworks"
+	InputNamespaceNetworks = "namespaceNetworks"
+	InputNetworks          = "networks"
+	InputNetworksSource    = "networksSource"
+	// InputPolicy is the JSON of the matching PolicyMatch.
+	InputPolicy = "policy"
+)
+
+// Policies matches pods against declarative policies, which take precedence
+// over the networks of pods.
+type Policies interface {
+	// Match returns the policy deciding pod using networks, nil if none does.
+	// unsure tells why a policy selecting pod may be missed, e.g. before
+	// policies are listed, empty otherwise.
+	Match(namespace string, pod *corev1.Pod, networks []string) (match *PolicyMatch, unsure string)
+	// Matched records an admission decided by the policy called name.
+	Matched(name string)
+}
+
+// What to do with tke-route-eni pods when no node they may be scheduled onto
+// has free eni-ip.
+const (
+	HeadroomCheckOff    = "off"
+	HeadroomCheckWarn   = "warn"
+	HeadroomCheckReject = "reject"
+)
+
+// What to do with tke-route-eni pods which no eligible node can be scheduled onto.
+const (
+	NodeCheckOff    = "off"
+	NodeCheckSkip   = "skip"
+	NodeCheckReject = "reject"
+)
+
+// Options holds what mutating pods depends on besides pods themselves.
+type Options struct {
+	DefaultCNI DefaultCNI
+	// NamespaceDefaults is optional, pods fall back to DefaultCNI without it.
+	NamespaceDefaults NamespaceDefaults
+	// PinNetworks writes the resolved networks into the networks annotation
+	// of pods without it, so that tke-cni-agent agrees with the admission.
+	PinNetworks bool
+	// NodeEligibility is required unless NodeCheck is off.
+	NodeEligibility NodeEligibility
+	NodeCheck       string
+	// VirtualNodes is optional, pods bound for virtual nodes are not injected.
+	VirtualNodes VirtualNodeDetector
+	// Headroom is required unless HeadroomCheck is off.
+	Headroom      Headroom
+	HeadroomCheck string
+	// ReadinessGate is added to readiness gates of tke-route-eni pods if not
+	// empty, a controller sets the condition once the ENI networking works.
+	ReadinessGate string
+	// StripStale removes eni-ip from pods not using tke-route-eni, e.g. pods
+	// copied from other clusters, which can not be scheduled onto nodes
+	// without eni-ip otherwise.
+	StripStale bool
+	// ProtectedNamespaces, like the one of the webhook itself, are admitted
+	// unchanged even if the namespaceSelector fails to exclude them.
+	ProtectedNamespaces []string
+	// Policies is optional, pods are decided by their networks without it.
+	Policies Policies
+	// Resource and Quantity are limited by tke-route-eni pods not decided by
+	// a policy, they default to one tke.cloud.tencent.com/eni-ip.
+	Resource corev1.ResourceName
+	Quantity *resource.Quantity
+}
+
+func NewHttpsServer(opts Options) HttpsServer {
+	protected := make(map[string]bool)
+	for _, namespace := range opts.ProtectedNamespaces {
+		protected[namespace] = true
+	}
+	s := &httpsSvr{
+		protected:         protected,
+		policies:          opts.Policies,
+		defaultCNI:        opts.DefaultCNI,
+		namespaceDefaults: opts.NamespaceDefaults,
+		pinNetworks:       opts.PinNetworks,
+		nodeEligibility:   opts.NodeEligibility,
+		nodeCheck:         opts.NodeCheck,
+		virtualNodes:      opts.VirtualNodes,
+		headroom:          opts.Headroom,
+		headroomCheck:     opts.HeadroomCheck,
+		stripStale:        opts.StripStale,
+		readinessGate:     opts.ReadinessGate,
+		resource:          opts.Resource,
+		quantity:          *eniIPQuantity,
+	}
+	if s.resource == "" {
+		s.resource = UnderlayIPResource
+	}
+	if opts.Quantity != nil {
+		s.quantity = *opts.Quantity
+	}
+	return s
 }
 
 type httpsSvr struct {
-	defaultCNI bool
+	protected         map[string]bool
+	policies          Policies
+	defaultCNI        DefaultCNI
+	namespaceDefaults NamespaceDefaults
+	pinNetworks       bool
+	nodeEligibility   NodeEligibility
+	nodeCheck         string
+	virtualNodes      VirtualNodeDetector
+	headroom          Headroom
+	headroomCheck     string
+	stripStale        bool
+	readinessGate     string
+	resource          corev1.ResourceName
+	quantity          resource.Quantity
 }
 
-// mutate pods using tke-route-eni.
-func (s *httpsSvr) mutatePods(ar v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
+// mutatePods mutates pods using tke-route-eni.
+func (s *httpsSvr) mutatePods(ctx context.Context, req *v1beta1.AdmissionRequest) (*Mutation, error) {
 	glog.V(2).Info("mutating pods")
 	podResource := metav1.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"}
-	if ar.Request.Resource != podResource {
-		glog.Errorf("expect resource to be %s", podResource)
-		return nil
+	if req.Resource != podResource {
+		return nil, fmt.Errorf("expect resource to be %s, got %s", podResource, req.Resource)
 	}
 
-	raw := ar.Request.Object.Raw
 	pod := corev1.Pod{}
 	deserializer := schema.Codecs.UniversalDeserializer()
-	if _, _, err := deserializer.Decode(raw, nil, &pod); err != nil {
-		glog.Error(err)
-		return toAdmissionResponse(err)
-	}
-	reviewResponse := v1beta1.AdmissionResponse{}
-	reviewResponse.Allowed = true
-	if pod.Spec.HostNetwork {
-		glog.V(3).Infof("hostNetwork pod %s/%s, just return", pod.Namespace, pod.Name)
-		return &reviewResponse
-	}
-
-	var toAdd bool
-	networks, ok := pod.Annotations[CNINetworksAnnotation]
-	if ok {
-		if strings.Contains(networks, TKERouteENI) {
-			toAdd = true
-		}
-	} else {
-		if s.defaultCNI {
-			toAdd = true
-		}
+	if _, _, err := deserializer.Decode(req.Object.Raw, nil, &pod); err != nil {
+		return nil, err
 	}
-	if !toAdd {
-		glog.V(3).Infof("not %s pod %s/%s, just return", TKERouteENI, pod.Namespace, pod.Name)
-		return &reviewResponse
+	namespace := pod.Namespace
+	if namespace == "" {
+		namespace = req.Namespace
 	}
+	return s.mutate(ctx, namespace, &pod, "", "pod")
+}
 
-	pd, err := getPatchData(pod.Spec.Containers[0].Resources)
+// mutate pod, or a pod template whose pod spec is at prefix of the object.
+// kind is used in logs.
+func (s *httpsSvr) mutate(ctx context.Context, namespace string, pod *corev1.Pod, prefix, kind string) (*Mutation, error) {
+	d, patches, err := s.review(ctx, namespace, pod, prefix, kind, false)
 	if err != nil {
-		glog.Error(err)
-		return toAdmissionResponse(err)
+		return nil, err
+	}
+	if d.protected {
+		glog.Warningf("%s %s/%s in protected namespace is sent to the webhook, check the namespaceSelector", kind, namespace, pod.Name)
+		protectedAdmissions.Inc(namespace)
 	}
-	reviewResponse.Patch = pd
-	pt := v1beta1.PatchTypeJSONPatch
-	reviewResponse.PatchType = &pt
-	return &reviewResponse
+	if d.policy != "" {
+		s.policies.Matched(d.policy)
+	}
+	m := &Mutation{Warnings: d.warnings, Denial: d.rejection, Reason: d.summary(), Inputs: s.inputs(d)}
+	if d.rejection != "" {
+		return m, nil
+	}
+
+	if d.skipped || len(d.warnings) > 0 || len(d.stripped) > 0 {
+		m.AuditAnnotations = make(map[string]string)
+	}
+	if d.skipped {
+		m.AuditAnnotations[SkippedAuditAnnotation] = d.reason
+	}
+	if len(d.stripped) > 0 {
+		m.AuditAnnotations[StrippedAuditAnnotation] = fmt.Sprintf("%s, removed from containers %s", d.reason, strings.Join(d.stripped, ","))
+	}
+	if len(d.warnings) > 0 {
+		m.AuditAnnotations[WarningsAuditAnnotation] = strings.Join(d.warnings, "; ")
+	}
+	m.Patches = patches
+	return m, nil
 }
 
-func (s *httpsSvr) serve(w http.ResponseWriter, r *http.Request, admit admitFunc) {
-	var body []byte
-	if r.Body != nil {
-		if data, err := ioutil.ReadAll(r.Body); err == nil {
-			body = data
+// inputs returns what d is decided with besides the pod.
+func (s *httpsSvr) inputs(d decision) map[string]string {
+	inputs := map[string]string{
+		InputDefaultCNI:      strconv.FormatBool(s.defaultCNI.DefaultCNI()),
+		InputDefaultNetworks: s.defaultCNI.DefaultNetworks(),
+		InputNetworks:        d.networks,
+		InputNetworksSource:  d.source,
+	}
+	if d.source == NetworksFromNamespace {
+		inputs[InputNamespaceNetworks] = d.networks
+	}
+	if d.match != nil {
+		if data, err := json.Marshal(d.match); err == nil {
+			inputs[InputPolicy] = string(data)
 		}
 	}
+	return inputs
+}
 
-	// verify the content type is accurate
-	contentType := r.Header.Get("Content-Type")
-	if contentType != "application/json" {
-		glog.Errorf("contentType=%s, expect application/json", contentType)
-		return
+// review decides how to mutate pod and returns the patches to apply, see
+// decide for running.
+func (s *httpsSvr) review(ctx context.Context, namespace string, pod *corev1.Pod, prefix, kind string, running bool) (decision, []ThingSpec, error) {
+	_, span := tracing.Start(ctx, "decide")
+	d := s.decide(namespace, pod, running)
+	span.SetAttribute("eni_ip.inject", d.inject)
+	span.SetAttribute("eni_ip.reason", d.summary())
+	span.SetAttribute("eni_ip.networks", d.networks)
+	span.SetAttribute("eni_ip.networks_source", d.source)
+	if d.policy != "" {
+		span.SetAttribute("eni_ip.policy", d.policy)
 	}
-
-	glog.V(4).Info(fmt.Sprintf("handling request: %s", string(body)))
-	var reviewResponse *v1beta1.AdmissionResponse
-	ar := v1beta1.AdmissionReview{}
-	deserializer := schema.Codecs.UniversalDeserializer()
-	if _, _, err := deserializer.Decode(body, nil, &ar); err != nil {
-		glog.Error(err)
-		reviewResponse = toAdmissionResponse(err)
-	} else {
-		reviewResponse = admit(ar)
+	span.End()
+	if d.protected {
+		return d, nil, nil
 	}
-
-	glog.V(2).Info(fmt.Sprintf("sending response: %s", formatResponse(reviewResponse)))
-	response := v1beta1.AdmissionReview{}
-	if reviewResponse != nil {
-		response.Response = reviewResponse
-		response.Response.UID = ar.Request.UID
+	if d.rejection != "" {
+		glog.V(3).Infof("reject %s %s/%s: %s", kind, namespace, pod.Name, d.rejection)
+		return d, nil, nil
 	}
-	// reset the Object and OldObject, they are not needed in a response.
-	ar.Request.Object = runtime.RawExtension{}
-	ar.Request.OldObject = runtime.RawExtension{}
-
-	resp, err := json.Marshal(response)
-	if err != nil {
-		glog.Error(err)
+	var patches []ThingSpec
+	_, span = tracing.Start(ctx, "patches")
+	defer func() {
+		span.SetAttribute("eni_ip.patches", len(patches))
+		span.End()
+	}()
+	if s.pinNetworks && !d.skipped && d.source != NetworksFromPod && d.networks != "" {
+		glog.V(3).Infof("pin networks %s from %s on %s %s/%s", d.networks, d.source, kind, namespace, pod.Name)
+		patches = append(patches, annotationPatch(prefix, pod.Annotations, CNINetworksAnnotation, d.networks))
+		d.step("pin networks %q into %s", d.networks, CNINetworksAnnotation)
 	}
-
-	if _, err := w.Write(resp); err != nil {
-		glog.Error(err)
+	injector := TKERouteENI
+	if d.policy != "" {
+		injector = "EniIPPolicy " + d.policy
+	}
+	if d.inject && hasLimit(pod.Spec.Containers[0].Resources, d.resource, d.quantity) {
+		glog.V(3).Infof("%s %s %s/%s already has %s", injector, kind, namespace, pod.Name, d.resource)
+		d.step("first container already limits %s %s", d.quantity.String(), d.resource)
+	} else if d.inject {
+		glog.V(3).Infof("%s %s %s/%s, networks from %s", injector, kind, namespace, pod.Name, d.source)
+		patch, err := resourcesPatch(prefix, pod.Spec.Containers[0].Resources, d.resource, d.quantity)
+		if err != nil {
+			return d, nil, err
+		}
+		patches = append(patches, patch)
+		d.warnings = append(d.warnings, injectedWarning(d, pod, kind))
+		d.step("limit %s %s on the first container", d.quantity.String(), d.resource)
+	} else if s.stripStale && !d.skipped && d.unsure != "" {
+		glog.V(3).Infof("%s %s %s/%s, not stripping %s: %s", d.reason, kind, namespace, pod.Name, UnderlayIPResource, d.unsure)
+		if PodHasENIIP(pod) {
+			d.step("not stripping %s, %s", UnderlayIPResource, d.unsure)
+		}
+	} else if s.stripStale && !d.skipped {
+		var strip []ThingSpec
+		if strip, d.stripped = stripPatches(prefix, &pod.Spec); len(strip) > 0 {
+			glog.V(3).Infof("%s %s %s/%s, strip %s from containers %s", d.reason, kind, namespace, pod.Name, UnderlayIPResource, strings.Join(d.stripped, ","))
+			patches = append(patches, strip...)
+			d.warnings = append(d.warnings, strippedWarning(d, pod, kind))
+			d.step("strip stale %s from containers %s", UnderlayIPResource, strings.Join(d.stripped, ","))
+		} else {
+			glog.V(3).Infof("%s %s %s/%s, just return", d.reason, kind, namespace, pod.Name)
+		}
+	} else {
+		glog.V(3).Infof("%s %s %s/%s, just return", d.reason, kind, namespace, pod.Name)
+		if warning := notInjectedWarning(d, pod, kind); warning != "" {
+			d.warnings = append(d.warnings, warning)
+		}
+	}
+	if d.inject && s.readinessGate != "" {
+		if patch, ok := readinessGatePatch(prefix, pod, s.readinessGate); ok {
+			glog.V(3).Infof("add readiness gate %s to %s %s/%s", s.readinessGate, kind, namespace, pod.Name)
+			patches = append(patches, patch)
+			d.step("add readiness gate %s", s.readinessGate)
+		}
 	}
+	return d, patches, nil
+}
+
+func (s *httpsSvr) PodMutator() Mutator {
+	return MutatorFunc(s.mutatePods)
 }
 
-func (s *httpsSvr) ServeHttps(w http.ResponseWriter, r *http.Request) {
-	s.serve(w, r, s.mutatePods)
+func (s *httpsSvr) TemplateMutator() Mutator {
+	return MutatorFunc(s.mutateTemplates)
 }
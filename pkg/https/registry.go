@@ -0,0 +1,427 @@
+package https
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/jsonpatch"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/logging"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/metrics"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/schema"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/tracing"
+
+	"github.com/golang/glog"
+	"k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// Results of handlers in admission metrics.
+const (
+	ResultAllowed = "allowed"
+	ResultPatched = "patched"
+	ResultDenied  = "denied"
+	ResultError   = "error"
+)
+
+var (
+	admissions = metrics.NewCounterVec("admissions_total",
+		"Admission requests handled by handlers of paths, by result.", "path", "handler", "result")
+	admissionSeconds = metrics.NewCounterVec("admission_duration_seconds_total",
+		"Seconds spent by handlers of paths, divide by admissions_total for the average.", "path", "handler")
+)
+
+// Mutation is what a Mutator makes of an admission request.
+type Mutation struct {
+	// Patches are JSON patch operations against the object as mutated by
+	// earlier mutators of the same path.
+	Patches []ThingSpec
+	// Warnings are returned to the client.
+	Warnings []string
+	// AuditAnnotations are recorded in audit events of the request.
+	AuditAnnotations map[string]string
+	// Denial denies the request with it as the message if not empty.
+	Denial string
+	// Reason tells why the mutator decided so, it is logged.
+	Reason string
+	// Inputs are what the mutator decided with besides the request, like
+	// the default cni, they are recorded so that replays decide alike.
+	Inputs map[string]string
+}
+
+// Mutator mutates objects of admission requests, a nil mutation admits the
+// object unchanged.
+type Mutator interface {
+	Mutate(ctx context.Context, req *v1beta1.AdmissionRequest) (*Mutation, error)
+}
+
+// MutatorFunc adapts a function to a Mutator.
+type MutatorFunc func(ctx context.Context, req *v1beta1.AdmissionRequest) (*Mutation, error)
+
+func (f MutatorFunc) Mutate(ctx context.Context, req *v1beta1.AdmissionRequest) (*Mutation, error) {
+	return f(ctx, req)
+}
+
+// Validator admits or denies admission requests without changing objects.
+type Validator interface {
+	// Validate returns a non empty denial to deny req.
+	Validate(ctx context.Context, req *v1beta1.AdmissionRequest) (denial string, warnings []string, err error)
+}
+
+// ValidatorFunc adapts a function to a Validator.
+type ValidatorFunc func(ctx context.Context, req *v1beta1.AdmissionRequest) (string, []string, error)
+
+func (f ValidatorFunc) Validate(ctx context.Context, req *v1beta1.AdmissionRequest) (string, []string, error) {
+	return f(ctx, req)
+}
+
+// handler is either a mutator or a validator.
+type handler struct {
+	name      string
+	mutator   Mutator
+	validator Validator
+}
+
+// Registry serves admission paths, each running a chain of named mutators
+// and validators in registration order. Every handler sees the object as
+// patched by earlier mutators, and the patches of all mutators are returned
+// as one JSON patch.
+type Registry struct {
+	mu       sync.RWMutex
+	chains   map[string][]handler
+	paths    []string
+	tracer   *tracing.Tracer
+	recorder Recorder
+}
+
+// Recorder records admissions with their decision and reason, it must not
+// block admissions.
+type Recorder interface {
+	Record(path string, req *v1beta1.AdmissionRequest, response *v1beta1.AdmissionResponse, warnings []string, decision, reason string, inputs map[string]string)
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{chains: make(map[string][]handler)}
+}
+
+// RegisterMutator appends m named name to the chain of path.
+func (r *Registry) RegisterMutator(path, name string, m Mutator) {
+	r.register(path, handler{name: name, mutator: m})
+}
+
+// RegisterValidator appends v named name to the chain of path.
+func (r *Registry) RegisterValidator(path, name string, v Validator) {
+	r.register(path, handler{name: name, validator: v})
+}
+
+func (r *Registry) register(path string, h handler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, existing := range r.chains[path] {
+		if existing.name == h.name {
+			panic(fmt.Sprintf("handler %s registered twice on %s", h.name, path))
+		}
+	}
+	if _, ok := r.chains[path]; !ok {
+		r.paths = append(r.paths, path)
+	}
+	r.chains[path] = append(r.chains[path], h)
+}
+
+// SetTracer traces admissions served by Install with t, nil disables it.
+func (r *Registry) SetTracer(t *tracing.Tracer) {
+	r.mu.Lock()
+	r.tracer = t
+	r.mu.Unlock()
+}
+
+// SetRecorder records admissions by Admit with rec, nil disables it.
+func (r *Registry) SetRecorder(rec Recorder) {
+	r.mu.Lock()
+	r.recorder = rec
+	r.mu.Unlock()
+}
+
+// Paths returns the registered paths in registration order.
+func (r *Registry) Paths() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]string(nil), r.paths...)
+}
+
+// Install serves all registered paths on mux, paths registered later are
+// not served.
+func (r *Registry) Install(mux *http.ServeMux) {
+	r.mu.RLock()
+	tracer := r.tracer
+	r.mu.RUnlock()
+	for _, path := range r.Paths() {
+		path := path
+		glog.Infof("Serving admissions on %s", path)
+		mux.HandleFunc(path, func(w http.ResponseWriter, req *http.Request) {
+			serve(w, req, tracer, func(ctx context.Context, ar v1beta1.AdmissionReview) (*v1beta1.AdmissionResponse, []string) {
+				return r.Admit(ctx, path, ar.Request)
+			})
+		})
+	}
+}
+
+// Admit runs the chain of path on req and returns the response and warnings,
+// handlers are traced as children of the span of ctx.
+func (r *Registry) Admit(ctx context.Context, path string, req *v1beta1.AdmissionRequest) (*v1beta1.AdmissionResponse, []string) {
+	if req == nil {
+		return toAdmissionResponse(fmt.Errorf("no request in admission review")), nil
+	}
+	start := time.Now()
+	response, warnings, o := r.admit(ctx, path, req)
+	logAdmission(ctx, path, req, response, warnings, o, time.Since(start))
+	r.mu.RLock()
+	recorder := r.recorder
+	r.mu.RUnlock()
+	if recorder != nil {
+		recorder.Record(path, req, response, warnings, o.result, strings.Join(o.reasons, "; "), o.inputs)
+	}
+	return response, warnings
+}
+
+// outcome is how a chain decided a request, for logs and records.
+type outcome struct {
+	result  string
+	reasons []string
+	// inputs of mutators, the first one wins on conflicts
+	inputs map[string]string
+}
+
+func (r *Registry) admit(ctx context.Context, path string, req *v1beta1.AdmissionRequest) (*v1beta1.AdmissionResponse, []string, outcome) {
+	r.mu.RLock()
+	chain := r.chains[path]
+	r.mu.RUnlock()
+
+	// handlers get a copy whose object is patched by earlier mutators
+	current := *req
+	var patches []ThingSpec
+	var warnings []string
+	var auditAnnotations map[string]string
+	var o outcome
+	for _, h := range chain {
+		start := time.Now()
+		hctx, span := tracing.Start(ctx, h.name)
+		m, err := h.run(hctx, &current)
+		admissionSeconds.Add(time.Since(start).Seconds(), path, h.name)
+		if err != nil {
+			span.SetError(err.Error())
+		} else if m != nil {
+			span.SetAttribute("handler.patches", len(m.Patches))
+			span.SetAttribute("handler.denied", m.Denial != "")
+		}
+		span.End()
+		if err != nil {
+			glog.Errorf("%s on %s failed: %v", h.name, path, err)
+			admissions.Inc(path, h.name, ResultError)
+			o.result, o.reasons = ResultError, append(o.reasons, fmt.Sprintf("%s: %v", h.name, err))
+			return toAdmissionResponse(fmt.Errorf("%s: %v", h.name, err)), warnings, o
+		}
+		if m == nil {
+			admissions.Inc(path, h.name, ResultAllowed)
+			continue
+		}
+		if m.Reason != "" {
+			o.reasons = append(o.reasons, fmt.Sprintf("%s: %s", h.name, m.Reason))
+		}
+		for key, value := range m.Inputs {
+			if o.inputs == nil {
+				o.inputs = make(map[string]string)
+			}
+			if _, ok := o.inputs[key]; !ok {
+				o.inputs[key] = value
+			}
+		}
+		warnings = append(warnings, m.Warnings...)
+		for key, value := range m.AuditAnnotations {
+			if auditAnnotations == nil {
+				auditAnnotations = make(map[string]string)
+			}
+			if _, ok := auditAnnotations[key]; ok {
+				glog.Warningf("Audit annotation %s of %s on %s conflicts with an earlier handler, dropped", key, h.name, path)
+				continue
+			}
+			auditAnnotations[key] = value
+		}
+		if m.Denial != "" {
+			admissions.Inc(path, h.name, ResultDenied)
+			if m.Reason != m.Denial {
+				o.reasons = append(o.reasons, fmt.Sprintf("%s: %s", h.name, m.Denial))
+			}
+			o.result = ResultDenied
+			return &v1beta1.AdmissionResponse{
+				Result: &metav1.Status{
+					Status:  metav1.StatusFailure,
+					Reason:  metav1.StatusReasonForbidden,
+					Code:    http.StatusForbidden,
+					Message: m.Denial,
+				},
+				AuditAnnotations: auditAnnotations,
+			}, warnings, o
+		}
+		if len(m.Patches) == 0 {
+			admissions.Inc(path, h.name, ResultAllowed)
+			continue
+		}
+
+		// applying the patches checks they are valid against the object
+		// later handlers see, so that the merged patch applies as a whole
+		_, span = tracing.Start(ctx, "apply patches")
+		data, err := json.Marshal(m.Patches)
+		if err == nil {
+			current.Object.Raw, err = jsonpatch.Apply(current.Object.Raw, data)
+		}
+		span.SetAttribute("handler", h.name)
+		if err != nil {
+			span.SetError(err.Error())
+		}
+		span.End()
+		if err != nil {
+			glog.Errorf("Patches of %s on %s do not apply: %v", h.name, path, err)
+			admissions.Inc(path, h.name, ResultError)
+			o.result, o.reasons = ResultError, append(o.reasons, fmt.Sprintf("%s: invalid patches: %v", h.name, err))
+			return toAdmissionResponse(fmt.Errorf("%s: invalid patches: %v", h.name, err)), warnings, o
+		}
+		current.Object.Object = nil
+		patches = append(patches, m.Patches...)
+		admissions.Inc(path, h.name, ResultPatched)
+	}
+
+	o.result = ResultAllowed
+	response := &v1beta1.AdmissionResponse{Allowed: true, AuditAnnotations: auditAnnotations}
+	if len(patches) > 0 {
+		data, err := json.Marshal(patches)
+		if err != nil {
+			o.result, o.reasons = ResultError, append(o.reasons, err.Error())
+			return toAdmissionResponse(err), warnings, o
+		}
+		pt := v1beta1.PatchTypeJSONPatch
+		response.Patch, response.PatchType = data, &pt
+		o.result = ResultPatched
+	}
+	return response, warnings, o
+}
+
+// logAdmission logs one line per admission request, with fields correlating
+// it to the apiserver audit log.
+func logAdmission(ctx context.Context, path string, req *v1beta1.AdmissionRequest, response *v1beta1.AdmissionResponse, warnings []string, o outcome, latency time.Duration) {
+	var obj struct {
+		Metadata struct {
+			Name         string `json:"name"`
+			GenerateName string `json:"generateName"`
+		} `json:"metadata"`
+	}
+	json.Unmarshal(req.Object.Raw, &obj)
+	name := req.Name
+	if name == "" {
+		name = obj.Metadata.Name
+	}
+	fields := logging.Fields{
+		"uid":          string(req.UID),
+		"path":         path,
+		"kind":         req.Kind.Kind,
+		"operation":    string(req.Operation),
+		"namespace":    req.Namespace,
+		"name":         name,
+		"generateName": obj.Metadata.GenerateName,
+		"decision":     o.result,
+		"reason":       strings.Join(o.reasons, "; "),
+		"latencyMs":    float64(latency.Nanoseconds()) / 1e6,
+		"patchBytes":   len(response.Patch),
+		"warnings":     len(warnings),
+	}
+	span := tracing.FromContext(ctx)
+	for key, value := range fields {
+		span.SetAttribute("admission."+key, value)
+	}
+	if o.result == ResultError {
+		span.SetError(fields["reason"].(string))
+		logging.Error("admission", fields)
+		return
+	}
+	logging.Info(2, "admission", fields)
+}
+
+// run runs the mutator or validator, a validator denial is a mutation
+// without patches.
+func (h handler) run(ctx context.Context, req *v1beta1.AdmissionRequest) (*Mutation, error) {
+	if h.mutator != nil {
+		return h.mutator.Mutate(ctx, req)
+	}
+	denial, warnings, err := h.validator.Validate(ctx, req)
+	if err != nil || (denial == "" && len(warnings) == 0) {
+		return nil, err
+	}
+	return &Mutation{Denial: denial, Warnings: warnings}, nil
+}
+
+func serve(w http.ResponseWriter, r *http.Request, tracer *tracing.Tracer, admit admitFunc) {
+	ctx, span := tracer.StartRequest(r, "admission")
+	defer span.End()
+
+	var body []byte
+	if r.Body != nil {
+		if data, err := ioutil.ReadAll(r.Body); err == nil {
+			body = data
+		}
+	}
+
+	// verify the content type is accurate
+	contentType := r.Header.Get("Content-Type")
+	if contentType != "application/json" {
+		glog.Errorf("contentType=%s, expect application/json", contentType)
+		return
+	}
+
+	var reviewResponse *v1beta1.AdmissionResponse
+	var warnings []string
+	ar := v1beta1.AdmissionReview{}
+	deserializer := schema.Codecs.UniversalDeserializer()
+	_, decodeSpan := tracing.Start(ctx, "decode")
+	_, _, err := deserializer.Decode(body, nil, &ar)
+	decodeSpan.SetAttribute("body_bytes", len(body))
+	decodeSpan.End()
+	if err != nil {
+		span.SetError(err.Error())
+		logging.Error("invalid admission review", logging.Fields{"error": err.Error(), "bodyBytes": len(body)})
+		reviewResponse = toAdmissionResponse(err)
+	} else {
+		if glog.V(4) && ar.Request != nil {
+			logging.Info(4, "admission review", logging.Fields{"uid": string(ar.Request.UID), "body": logging.Redact(body)})
+		}
+		reviewResponse, warnings = admit(ctx, ar)
+	}
+
+	response := admissionReview{}
+	if reviewResponse != nil {
+		response.Response = &admissionResponse{AdmissionResponse: reviewResponse, Warnings: warnings}
+		if ar.Request != nil {
+			response.Response.UID = ar.Request.UID
+		}
+	}
+	// reset the Object and OldObject, they are not needed in a response.
+	if ar.Request != nil {
+		ar.Request.Object = runtime.RawExtension{}
+		ar.Request.OldObject = runtime.RawExtension{}
+	}
+
+	resp, err := json.Marshal(response)
+	if err != nil {
+		glog.Error(err)
+	}
+
+	if _, err := w.Write(resp); err != nil {
+		glog.Error(err)
+	}
+}
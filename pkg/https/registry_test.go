@@ -0,0 +1,180 @@
+package https
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"k8s.io/api/admission/v1beta1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+type record struct {
+	path, decision, reason string
+	inputs                 map[string]string
+}
+
+type fakeRecorder struct {
+	records []record
+}
+
+func (f *fakeRecorder) Record(path string, req *v1beta1.AdmissionRequest, response *v1beta1.AdmissionResponse, warnings []string, decision, reason string, inputs map[string]string) {
+	f.records = append(f.records, record{path, decision, reason, inputs})
+}
+
+// annotate returns a mutator adding annotation key=value, it fails unless
+// the object has the annotations of earlier mutators.
+func annotate(key, value string, earlier ...string) Mutator {
+	return MutatorFunc(func(ctx context.Context, req *v1beta1.AdmissionRequest) (*Mutation, error) {
+		var obj struct {
+			Metadata struct {
+				Annotations map[string]string `json:"annotations"`
+			} `json:"metadata"`
+		}
+		if err := json.Unmarshal(req.Object.Raw, &obj); err != nil {
+			return nil, err
+		}
+		for _, e := range earlier {
+			if _, ok := obj.Metadata.Annotations[e]; !ok {
+				return nil, fmt.Errorf("annotation %s of an earlier mutator is not found", e)
+			}
+		}
+		patch := ThingSpec{Op: "add", Path: "/metadata/annotations/" + key, Value: json.RawMessage(`"` + value + `"`)}
+		if obj.Metadata.Annotations == nil {
+			patch = ThingSpec{Op: "add", Path: "/metadata/annotations", Value: json.RawMessage(`{"` + key + `":"` + value + `"}`)}
+		}
+		return &Mutation{
+			Patches:          []ThingSpec{patch},
+			Warnings:         []string{key + " is annotated"},
+			AuditAnnotations: map[string]string{"annotated": key},
+			Reason:           "annotate " + key,
+			Inputs:           map[string]string{"value": value, key: value},
+		}, nil
+	})
+}
+
+func deny(denial string) Validator {
+	return ValidatorFunc(func(ctx context.Context, req *v1beta1.AdmissionRequest) (string, []string, error) {
+		return denial, nil, nil
+	})
+}
+
+func TestRegistryAdmit(t *testing.T) {
+	notCalled := MutatorFunc(func(ctx context.Context, req *v1beta1.AdmissionRequest) (*Mutation, error) {
+		return nil, fmt.Errorf("called after a denial")
+	})
+	failed := MutatorFunc(func(ctx context.Context, req *v1beta1.AdmissionRequest) (*Mutation, error) {
+		return nil, fmt.Errorf("boom")
+	})
+	invalid := MutatorFunc(func(ctx context.Context, req *v1beta1.AdmissionRequest) (*Mutation, error) {
+		return &Mutation{Patches: []ThingSpec{{Op: "remove", Path: "/spec/missing"}}}, nil
+	})
+	unchanged := MutatorFunc(func(ctx context.Context, req *v1beta1.AdmissionRequest) (*Mutation, error) {
+		return nil, nil
+	})
+
+	r := NewRegistry()
+	r.RegisterMutator("/chain", "a", annotate("a", "1"))
+	r.RegisterMutator("/chain", "unchanged", unchanged)
+	r.RegisterValidator("/chain", "allow", deny(""))
+	r.RegisterMutator("/chain", "b", annotate("b", "2", "a"))
+	r.RegisterMutator("/deny", "a", annotate("a", "1"))
+	r.RegisterValidator("/deny", "deny", deny("not allowed"))
+	r.RegisterMutator("/deny", "b", notCalled)
+	r.RegisterMutator("/error", "failed", failed)
+	r.RegisterMutator("/invalid", "a", annotate("a", "1"))
+	r.RegisterMutator("/invalid", "invalid", invalid)
+	r.RegisterMutator("/empty", "unchanged", unchanged)
+	recorder := &fakeRecorder{}
+	r.SetRecorder(recorder)
+
+	if paths := r.Paths(); !reflect.DeepEqual(paths, []string{"/chain", "/deny", "/error", "/invalid", "/empty"}) {
+		t.Errorf("unexpected paths %v", paths)
+	}
+
+	tests := []struct {
+		path     string
+		allowed  bool
+		patch    string
+		warnings []string
+		audit    map[string]string
+		decision string
+		reason   string
+		inputs   map[string]string
+		// message of the response status on denials and errors
+		message string
+	}{
+		{
+			path:     "/chain",
+			allowed:  true,
+			patch:    `[{"op":"add","path":"/metadata/annotations","value":{"a":"1"}},{"op":"add","path":"/metadata/annotations/b","value":"2"}]`,
+			warnings: []string{"a is annotated", "b is annotated"},
+			// the audit annotation of b conflicts with a and is dropped
+			audit:    map[string]string{"annotated": "a"},
+			decision: ResultPatched,
+			reason:   "a: annotate a; b: annotate b",
+			inputs:   map[string]string{"value": "1", "a": "1", "b": "2"},
+		},
+		{
+			path:     "/deny",
+			warnings: []string{"a is annotated"},
+			audit:    map[string]string{"annotated": "a"},
+			decision: ResultDenied,
+			reason:   "a: annotate a; deny: not allowed",
+			inputs:   map[string]string{"value": "1", "a": "1"},
+			message:  "not allowed",
+		},
+		{path: "/error", decision: ResultError, reason: "failed: boom", message: "failed: boom"},
+		{
+			path:     "/invalid",
+			warnings: []string{"a is annotated"},
+			decision: ResultError,
+			reason:   "a: annotate a; invalid: invalid patches: failed to remove /spec/missing: missing not found",
+			inputs:   map[string]string{"value": "1", "a": "1"},
+			message:  "invalid: invalid patches: failed to remove /spec/missing: missing not found",
+		},
+		{path: "/empty", allowed: true, decision: ResultAllowed},
+		{path: "/unknown", allowed: true, decision: ResultAllowed},
+	}
+	for _, test := range tests {
+		recorder.records = nil
+		req := &v1beta1.AdmissionRequest{Object: runtime.RawExtension{Raw: []byte(`{"metadata":{"name":"pod"},"spec":{}}`)}}
+		response, warnings := r.Admit(context.Background(), test.path, req)
+		if response.Allowed != test.allowed || string(response.Patch) != test.patch {
+			t.Errorf("%s: expect allowed %t patch %s, got %t %s", test.path, test.allowed, test.patch, response.Allowed, response.Patch)
+		}
+		if !reflect.DeepEqual(warnings, test.warnings) {
+			t.Errorf("%s: expect warnings %q, got %q", test.path, test.warnings, warnings)
+		}
+		if !reflect.DeepEqual(response.AuditAnnotations, test.audit) {
+			t.Errorf("%s: expect audit annotations %v, got %v", test.path, test.audit, response.AuditAnnotations)
+		}
+		if test.message != "" && (response.Result == nil || response.Result.Message != test.message) {
+			t.Errorf("%s: expect message %q, got %+v", test.path, test.message, response.Result)
+		}
+		if test.decision == ResultDenied && response.Result != nil && response.Result.Code != http.StatusForbidden {
+			t.Errorf("%s: expect code %d, got %d", test.path, http.StatusForbidden, response.Result.Code)
+		}
+		expect := []record{{test.path, test.decision, test.reason, test.inputs}}
+		if !reflect.DeepEqual(recorder.records, expect) {
+			t.Errorf("%s: expect records %+v, got %+v", test.path, expect, recorder.records)
+		}
+		if string(req.Object.Raw) != `{"metadata":{"name":"pod"},"spec":{}}` {
+			t.Errorf("%s: request object is modified: %s", test.path, req.Object.Raw)
+		}
+	}
+}
+
+func TestRegistryRegisterTwice(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expect panic registering a handler twice")
+		}
+	}()
+	r := NewRegistry()
+	r.RegisterValidator("/validate", "v", deny(""))
+	r.RegisterMutator("/validate", "v", annotate("a", "1"))
+}
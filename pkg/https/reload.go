@@ -0,0 +1,53 @@
+package https
+
+import (
+	"context"
+	"sync/atomic"
+
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// ReloadableServer is an HttpsServer whose options are replaced while
+// serving, every admission runs entirely with either the old or the new
+// options.
+type ReloadableServer struct {
+	current atomic.Value
+}
+
+// NewReloadableServer returns a server of opts.
+func NewReloadableServer(opts Options) *ReloadableServer {
+	r := &ReloadableServer{}
+	r.Update(opts)
+	return r
+}
+
+// Update replaces the options of r.
+func (r *ReloadableServer) Update(opts Options) {
+	r.current.Store(NewHttpsServer(opts))
+}
+
+func (r *ReloadableServer) server() HttpsServer {
+	return r.current.Load().(HttpsServer)
+}
+
+func (r *ReloadableServer) PodMutator() Mutator {
+	return MutatorFunc(func(ctx context.Context, req *v1beta1.AdmissionRequest) (*Mutation, error) {
+		return r.server().PodMutator().Mutate(ctx, req)
+	})
+}
+
+func (r *ReloadableServer) TemplateMutator() Mutator {
+	return MutatorFunc(func(ctx context.Context, req *v1beta1.AdmissionRequest) (*Mutation, error) {
+		return r.server().TemplateMutator().Mutate(ctx, req)
+	})
+}
+
+func (r *ReloadableServer) Explain(namespace string, obj runtime.Object) (*Result, error) {
+	return r.server().Explain(namespace, obj)
+}
+
+func (r *ReloadableServer) ExplainRunning(pod *corev1.Pod) (*Result, error) {
+	return r.server().ExplainRunning(pod)
+}
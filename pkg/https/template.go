@@ -0,0 +1,96 @@
+package https
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/schema"
+
+	"github.com/golang/glog"
+	"k8s.io/api/admission/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// JSON paths of pod templates in workloads.
+const (
+	TemplateJsonPath        = "/spec/template"
+	CronJobTemplateJsonPath = "/spec/jobTemplate/spec/template"
+)
+
+// templateResource describes where the pod template of a workload resource is.
+type templateResource struct {
+	newObject func() runtime.Object
+	template  func(obj runtime.Object) *corev1.PodTemplateSpec
+	path      string
+	// immutable templates are only mutated on creation.
+	immutable bool
+}
+
+var templateResources = map[metav1.GroupVersionResource]templateResource{
+	{Group: "apps", Version: "v1", Resource: "deployments"}: {
+		newObject: func() runtime.Object { return &appsv1.Deployment{} },
+		template:  func(obj runtime.Object) *corev1.PodTemplateSpec { return &obj.(*appsv1.Deployment).Spec.Template },
+		path:      TemplateJsonPath,
+	},
+	{Group: "apps", Version: "v1", Resource: "statefulsets"}: {
+		newObject: func() runtime.Object { return &appsv1.StatefulSet{} },
+		template:  func(obj runtime.Object) *corev1.PodTemplateSpec { return &obj.(*appsv1.StatefulSet).Spec.Template },
+		path:      TemplateJsonPath,
+	},
+	{Group: "apps", Version: "v1", Resource: "daemonsets"}: {
+		newObject: func() runtime.Object { return &appsv1.DaemonSet{} },
+		template:  func(obj runtime.Object) *corev1.PodTemplateSpec { return &obj.(*appsv1.DaemonSet).Spec.Template },
+		path:      TemplateJsonPath,
+	},
+	{Group: "apps", Version: "v1", Resource: "replicasets"}: {
+		newObject: func() runtime.Object { return &appsv1.ReplicaSet{} },
+		template:  func(obj runtime.Object) *corev1.PodTemplateSpec { return &obj.(*appsv1.ReplicaSet).Spec.Template },
+		path:      TemplateJsonPath,
+	},
+	{Group: "batch", Version: "v1", Resource: "jobs"}: {
+		newObject: func() runtime.Object { return &batchv1.Job{} },
+		template:  func(obj runtime.Object) *corev1.PodTemplateSpec { return &obj.(*batchv1.Job).Spec.Template },
+		path:      TemplateJsonPath,
+		immutable: true,
+	},
+	{Group: "batch", Version: "v1beta1", Resource: "cronjobs"}: {
+		newObject: func() runtime.Object { return &batchv1beta1.CronJob{} },
+		template: func(obj runtime.Object) *corev1.PodTemplateSpec {
+			return &obj.(*batchv1beta1.CronJob).Spec.JobTemplate.Spec.Template
+		},
+		path: CronJobTemplateJsonPath,
+	},
+}
+
+// mutate pod templates of workloads using tke-route-eni, so that the
+// injected eni-ip is visible on workloads before any pod is created.
+func (s *httpsSvr) mutateTemplates(ctx context.Context, req *v1beta1.AdmissionRequest) (*Mutation, error) {
+	glog.V(2).Info("mutating pod templates")
+	tr, ok := templateResources[req.Resource]
+	if !ok {
+		return nil, fmt.Errorf("unexpected resource %s", req.Resource)
+	}
+	if tr.immutable && req.Operation != v1beta1.Create {
+		return nil, nil
+	}
+
+	obj := tr.newObject()
+	deserializer := schema.Codecs.UniversalDeserializer()
+	if _, _, err := deserializer.Decode(req.Object.Raw, nil, obj); err != nil {
+		return nil, err
+	}
+	template := tr.template(obj)
+	if len(template.Spec.Containers) == 0 {
+		return nil, fmt.Errorf("no container in pod template of %s", req.Resource.Resource)
+	}
+
+	namespace := req.Namespace
+	pod := &corev1.Pod{ObjectMeta: template.ObjectMeta, Spec: template.Spec}
+	pod.Name = req.Name
+	return s.mutate(ctx, namespace, pod, tr.path, req.Resource.Resource)
+}
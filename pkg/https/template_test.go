@@ -0,0 +1,143 @@
+package https
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// workload returns a manifest of kind whose pod template has annotations and
+// containers.
+func workload(apiVersion, kind, annotations, containers string) []byte {
+	template := fmt.Sprintf(`{"metadata":{"annotations":%s},"spec":{"containers":%s}}`, annotations, containers)
+	spec := fmt.Sprintf(`{"template":%s}`, template)
+	if kind == "CronJob" {
+		spec = fmt.Sprintf(`{"schedule":"* * * * *","jobTemplate":{"spec":%s}}`, spec)
+	}
+	return []byte(fmt.Sprintf(`{"apiVersion":%q,"kind":%q,"metadata":{"name":"app"},"spec":%s}`, apiVersion, kind, spec))
+}
+
+func TestMutateTemplates(t *testing.T) {
+	s := NewHttpsServer(Options{DefaultCNI: clusterRouteENI}).(*httpsSvr)
+	containers := `[{"name":"c"}]`
+	tests := []struct {
+		name        string
+		resource    metav1.GroupVersionResource
+		kind        string
+		operation   v1beta1.Operation
+		annotations string
+		containers  string
+
+		expectErr bool
+		// path is the patched path, empty if not patched.
+		path string
+	}{
+		{
+			name:     "deployment",
+			resource: metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"},
+			kind:     "Deployment",
+			path:     TemplateJsonPath + UnderlayIPJsonPath,
+		},
+		{
+			name:     "statefulset",
+			resource: metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "statefulsets"},
+			kind:     "StatefulSet",
+			path:     TemplateJsonPath + UnderlayIPJsonPath,
+		},
+		{
+			name:     "daemonset",
+			resource: metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "daemonsets"},
+			kind:     "DaemonSet",
+			path:     TemplateJsonPath + UnderlayIPJsonPath,
+		},
+		{
+			name:     "replicaset",
+			resource: metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "replicasets"},
+			kind:     "ReplicaSet",
+			path:     TemplateJsonPath + UnderlayIPJsonPath,
+		},
+		{
+			name:     "job",
+			resource: metav1.GroupVersionResource{Group: "batch", Version: "v1", Resource: "jobs"},
+			kind:     "Job",
+			path:     TemplateJsonPath + UnderlayIPJsonPath,
+		},
+		{
+			name:      "job update",
+			resource:  metav1.GroupVersionResource{Group: "batch", Version: "v1", Resource: "jobs"},
+			kind:      "Job",
+			operation: v1beta1.Update,
+		},
+		{
+			name:     "cronjob",
+			resource: metav1.GroupVersionResource{Group: "batch", Version: "v1beta1", Resource: "cronjobs"},
+			kind:     "CronJob",
+			path:     CronJobTemplateJsonPath + UnderlayIPJsonPath,
+		},
+		{
+			name:      "deployment update",
+			resource:  metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"},
+			kind:      "Deployment",
+			operation: v1beta1.Update,
+			path:      TemplateJsonPath + UnderlayIPJsonPath,
+		},
+		{
+			name:        "not route eni",
+			resource:    metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"},
+			kind:        "Deployment",
+			annotations: `{"tke.cloud.tencent.com/networks":"tke-bridge"}`,
+		},
+		{
+			name:      "unexpected resource",
+			resource:  metav1.GroupVersionResource{Group: "apps", Version: "v1beta1", Resource: "deployments"},
+			kind:      "Deployment",
+			expectErr: true,
+		},
+		{
+			name:       "no container",
+			resource:   metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"},
+			kind:       "Deployment",
+			containers: `[]`,
+			expectErr:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			operation, annotations, cs := test.operation, test.annotations, test.containers
+			if operation == "" {
+				operation = v1beta1.Create
+			}
+			if annotations == "" {
+				annotations = "null"
+			}
+			if cs == "" {
+				cs = containers
+			}
+			apiVersion := test.resource.Group + "/" + test.resource.Version
+			req := &v1beta1.AdmissionRequest{
+				Name:      "app",
+				Namespace: "default",
+				Resource:  test.resource,
+				Operation: operation,
+				Object:    runtime.RawExtension{Raw: workload(apiVersion, test.kind, annotations, cs)},
+			}
+			m, err := s.mutateTemplates(context.Background(), req)
+			if (err != nil) != test.expectErr {
+				t.Fatalf("error = %v, want error %v", err, test.expectErr)
+			}
+			var paths []string
+			if m != nil {
+				for _, p := range m.Patches {
+					paths = append(paths, p.Path)
+				}
+			}
+			if test.path == "" && len(paths) > 0 || test.path != "" && (len(paths) != 1 || paths[0] != test.path) {
+				t.Errorf("patched %v, want %q", paths, test.path)
+			}
+		})
+	}
+}
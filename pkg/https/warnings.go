@@ -0,0 +1,93 @@
+package https
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// subject names what is mutated in warnings, kind is pod or a workload resource.
+func subject(kind string) string {
+	if kind == "pod" {
+		return "pod"
+	}
+	return fmt.Sprintf("pod template of %s", kind)
+}
+
+// networksFrom describes where the networks of d come from.
+func networksFrom(d decision) string {
+	switch d.source {
+	case NetworksFromPod:
+		return fmt.Sprintf("annotation %s=%q", CNINetworksAnnotation, d.networks)
+	case NetworksFromNamespace:
+		return fmt.Sprintf("namespace default networks %q", d.networks)
+	case NetworksFromCluster:
+		if d.networks != "" {
+			return fmt.Sprintf("cluster default networks %q", d.networks)
+		}
+		return "cluster default cni"
+	}
+	return ""
+}
+
+// injectedWarning tells the eni-ip added to or changed on the first container.
+func injectedWarning(d decision, pod *corev1.Pod, kind string) string {
+	c := pod.Spec.Containers[0]
+	limit, hasLimit := c.Resources.Limits[d.resource]
+	request, hasRequest := c.Resources.Requests[d.resource]
+	why := fmt.Sprintf("it uses %s by %s", TKERouteENI, networksFrom(d))
+	need := fmt.Sprintf("%s pods need exactly %s", TKERouteENI, d.quantity.String())
+	if d.policy != "" {
+		why = fmt.Sprintf("it is selected by EniIPPolicy %s", d.policy)
+		need = fmt.Sprintf("EniIPPolicy %s sets %s", d.policy, d.quantity.String())
+	}
+	if !hasLimit && !hasRequest {
+		return fmt.Sprintf("added %s limit %s to container %q of the %s, %s",
+			d.resource, d.quantity.String(), c.Name, subject(kind), why)
+	}
+	var was string
+	if hasLimit {
+		was = fmt.Sprintf("limit %s", limit.String())
+	}
+	if hasRequest {
+		if was != "" {
+			was += ", "
+		}
+		was += fmt.Sprintf("request %s", request.String())
+	}
+	return fmt.Sprintf("changed %s of container %q of the %s from %s to %s, %s",
+		d.resource, c.Name, subject(kind), was, d.quantity.String(), need)
+}
+
+// notInjectedWarning tells why eni-ip is not added, it is empty unless the
+// pod uses tke-route-eni or requests eni-ip by hand, warning every other pod
+// would be noise.
+func notInjectedWarning(d decision, pod *corev1.Pod, kind string) string {
+	if d.skipped && d.routeENI {
+		return fmt.Sprintf("%s not added to the %s although it uses %s by %s: %s",
+			UnderlayIPResource, subject(kind), TKERouteENI, networksFrom(d), d.reason)
+	}
+	if !PodHasENIIP(pod) {
+		return ""
+	}
+	return fmt.Sprintf("the %s requests %s but does not use %s, %s; it is left unchanged",
+		subject(kind), UnderlayIPResource, TKERouteENI, notRouteENI(d, pod))
+}
+
+// strippedWarning tells the eni-ip removed from containers not using tke-route-eni.
+func strippedWarning(d decision, pod *corev1.Pod, kind string) string {
+	return fmt.Sprintf("removed %s from containers %s of the %s, it does not use %s, %s",
+		UnderlayIPResource, strings.Join(d.stripped, ","), subject(kind), TKERouteENI, notRouteENI(d, pod))
+}
+
+// notRouteENI tells why a pod does not use tke-route-eni.
+func notRouteENI(d decision, pod *corev1.Pod) string {
+	why := d.reason
+	if pod.Spec.HostNetwork {
+		why = "it uses hostNetwork"
+	} else if from := networksFrom(d); from != "" {
+		why = fmt.Sprintf("%s does not include %s", from, TKERouteENI)
+	}
+	return why
+}
@@ -0,0 +1,126 @@
+package https
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// withENIIP returns a pod whose first container has eni-ip limit and request,
+// empty ones are not set.
+func withENIIP(limit, request string) *corev1.Pod {
+	pod := newPod(nil)
+	res := &pod.Spec.Containers[0].Resources
+	if limit != "" {
+		res.Limits = corev1.ResourceList{UnderlayIPResource: resource.MustParse(limit)}
+	}
+	if request != "" {
+		res.Requests = corev1.ResourceList{UnderlayIPResource: resource.MustParse(request)}
+	}
+	return pod
+}
+
+func TestWarnings(t *testing.T) {
+	inject := decision{inject: true, routeENI: true, source: NetworksFromNamespace, networks: "tke-route-eni",
+		resource: UnderlayIPResource, quantity: resource.MustParse("1")}
+	policy := inject
+	policy.policy = "gpu"
+	policy.quantity = resource.MustParse("2")
+	hostNetwork := withENIIP("1", "")
+	hostNetwork.Spec.HostNetwork = true
+	tests := []struct {
+		name    string
+		warning func(d decision, pod *corev1.Pod, kind string) string
+		d       decision
+		pod     *corev1.Pod
+		kind    string
+		expect  string
+	}{
+		{
+			name:    "added",
+			warning: injectedWarning,
+			d:       inject,
+			pod:     newPod(nil),
+			kind:    "pod",
+			expect:  `added tke.cloud.tencent.com/eni-ip limit 1 to container "c" of the pod, it uses tke-route-eni by namespace default networks "tke-route-eni"`,
+		},
+		{
+			name:    "added to template",
+			warning: injectedWarning,
+			d:       decision{inject: true, source: NetworksFromCluster, resource: UnderlayIPResource, quantity: resource.MustParse("1")},
+			pod:     newPod(nil),
+			kind:    "deployments",
+			expect:  `added tke.cloud.tencent.com/eni-ip limit 1 to container "c" of the pod template of deployments, it uses tke-route-eni by cluster default cni`,
+		},
+		{
+			name:    "changed",
+			warning: injectedWarning,
+			d:       inject,
+			pod:     withENIIP("2", "3"),
+			kind:    "pod",
+			expect:  `changed tke.cloud.tencent.com/eni-ip of container "c" of the pod from limit 2, request 3 to 1, tke-route-eni pods need exactly 1`,
+		},
+		{
+			name:    "changed by policy",
+			warning: injectedWarning,
+			d:       policy,
+			pod:     withENIIP("", "1"),
+			kind:    "pod",
+			expect:  `changed tke.cloud.tencent.com/eni-ip of container "c" of the pod from request 1 to 2, EniIPPolicy gpu sets 2`,
+		},
+		{
+			name:    "added by policy",
+			warning: injectedWarning,
+			d:       policy,
+			pod:     newPod(nil),
+			kind:    "pod",
+			expect:  `added tke.cloud.tencent.com/eni-ip limit 2 to container "c" of the pod, it is selected by EniIPPolicy gpu`,
+		},
+		{
+			name:    "skipped",
+			warning: notInjectedWarning,
+			d:       decision{routeENI: true, skipped: true, source: NetworksFromPod, networks: "tke-route-eni", reason: "bound for virtual node"},
+			pod:     newPod(nil),
+			kind:    "pod",
+			expect:  `tke.cloud.tencent.com/eni-ip not added to the pod although it uses tke-route-eni by annotation tke.cloud.tencent.com/networks="tke-route-eni": bound for virtual node`,
+		},
+		{
+			name:    "not route eni",
+			warning: notInjectedWarning,
+			d:       decision{source: NetworksFromPod, networks: "tke-bridge"},
+			pod:     newPod(nil),
+		},
+		{
+			name:    "eni-ip by hand",
+			warning: notInjectedWarning,
+			d:       decision{source: NetworksFromPod, networks: "tke-bridge"},
+			pod:     withENIIP("1", ""),
+			kind:    "pod",
+			expect:  `the pod requests tke.cloud.tencent.com/eni-ip but does not use tke-route-eni, annotation tke.cloud.tencent.com/networks="tke-bridge" does not include tke-route-eni; it is left unchanged`,
+		},
+		{
+			name:    "eni-ip by hand with host network",
+			warning: notInjectedWarning,
+			d:       decision{reason: "host network"},
+			pod:     hostNetwork,
+			kind:    "pod",
+			expect:  `the pod requests tke.cloud.tencent.com/eni-ip but does not use tke-route-eni, it uses hostNetwork; it is left unchanged`,
+		},
+		{
+			name:    "stripped",
+			warning: strippedWarning,
+			d:       decision{source: NetworksFromNamespace, networks: "tke-bridge", stripped: []string{"c", "sidecar"}},
+			pod:     withENIIP("1", ""),
+			kind:    "statefulsets",
+			expect:  `removed tke.cloud.tencent.com/eni-ip from containers c,sidecar of the pod template of statefulsets, it does not use tke-route-eni, namespace default networks "tke-bridge" does not include tke-route-eni`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if warning := test.warning(test.d, test.pod, test.kind); warning != test.expect {
+				t.Errorf("warning\n%q, want\n%q", warning, test.expect)
+			}
+		})
+	}
+}
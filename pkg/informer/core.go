@@ -0,0 +1,35 @@
+package informer
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+)
+
+// NewNamespaceInformer returns an informer of all namespaces.
+func NewNamespaceInformer(clientset kubernetes.Interface) *Informer {
+	return New("namespaces", func(options metav1.ListOptions) (runtime.Object, error) {
+		return clientset.CoreV1().Namespaces().List(options)
+	}, func(options metav1.ListOptions) (watch.Interface, error) {
+		return clientset.CoreV1().Namespaces().Watch(options)
+	})
+}
+
+// NewNodeInformer returns an informer of all nodes.
+func NewNodeInformer(clientset kubernetes.Interface) *Informer {
+	return New("nodes", func(options metav1.ListOptions) (runtime.Object, error) {
+		return clientset.CoreV1().Nodes().List(options)
+	}, func(options metav1.ListOptions) (watch.Interface, error) {
+		return clientset.CoreV1().Nodes().Watch(options)
+	})
+}
+
+// NewPodInformer returns an informer of all pods.
+func NewPodInformer(clientset kubernetes.Interface) *Informer {
+	return New("pods", func(options metav1.ListOptions) (runtime.Object, error) {
+		return clientset.CoreV1().Pods(metav1.NamespaceAll).List(options)
+	}, func(options metav1.ListOptions) (watch.Interface, error) {
+		return clientset.CoreV1().Pods(metav1.NamespaceAll).Watch(options)
+	})
+}
@@ -0,0 +1,290 @@
+package informer
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+const (
+	minWatchTimeout = 5 * time.Minute
+	relistPeriod    = time.Second
+)
+
+// ListFunc lists all objects of a resource.
+type ListFunc func(options metav1.ListOptions) (runtime.Object, error)
+
+// WatchFunc watches a resource from options.ResourceVersion.
+type WatchFunc func(options metav1.ListOptions) (watch.Interface, error)
+
+// EventHandler is notified after the store changes, any func may be nil.
+type EventHandler struct {
+	OnAdd    func(obj runtime.Object)
+	OnUpdate func(oldObj, newObj runtime.Object)
+	OnDelete func(obj runtime.Object)
+}
+
+// Informer keeps an in memory copy of a resource by listing and watching it,
+// so that admissions can be served without calling apiserver.
+type Informer struct {
+	name  string
+	list  ListFunc
+	watch WatchFunc
+
+	mu       sync.RWMutex
+	items    map[string]runtime.Object
+	synced   bool
+	handlers []EventHandler
+}
+
+// New returns an informer of the resource called name.
+func New(name string, list ListFunc, watch WatchFunc) *Informer {
+	return &Informer{
+		name:  name,
+		list:  list,
+		watch: watch,
+		items: make(map[string]runtime.Object),
+	}
+}
+
+// Key returns namespace/name of namespaced objects and name of cluster objects.
+func Key(obj runtime.Object) (string, error) {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return "", err
+	}
+	if accessor.GetNamespace() == "" {
+		return accessor.GetName(), nil
+	}
+	return accessor.GetNamespace() + "/" + accessor.GetName(), nil
+}
+
+// Name returns the name of the resource.
+func (i *Informer) Name() string {
+	return i.name
+}
+
+// AddEventHandler registers h, it should be called before Run.
+func (i *Informer) AddEventHandler(h EventHandler) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.handlers = append(i.handlers, h)
+}
+
+// Run lists and watches the resource until stopCh is closed.
+func (i *Informer) Run(stopCh <-chan struct{}) {
+	wait.Until(func() {
+		if err := i.listAndWatch(stopCh); err != nil {
+			glog.Warningf("Failed to list and watch %s, will retry: %v", i.name, err)
+		}
+	}, relistPeriod, stopCh)
+}
+
+// HasSynced returns whether the resource has been listed once.
+func (i *Informer) HasSynced() bool {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return i.synced
+}
+
+// WaitForSync blocks until the resource is listed or stopCh is closed.
+func (i *Informer) WaitForSync(stopCh <-chan struct{}) bool {
+	err := wait.PollImmediateUntil(100*time.Millisecond, func() (bool, error) {
+		return i.HasSynced(), nil
+	}, stopCh)
+	return err == nil
+}
+
+// Get returns the object of key, see Key.
+func (i *Informer) Get(key string) (runtime.Object, bool) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	obj, ok := i.items[key]
+	return obj, ok
+}
+
+// List returns all objects. They are shared with the informer and must not
+// be modified.
+func (i *Informer) List() []runtime.Object {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	objs := make([]runtime.Object, 0, len(i.items))
+	for _, obj := range i.items {
+		objs = append(objs, obj)
+	}
+	return objs
+}
+
+func (i *Informer) listAndWatch(stopCh <-chan struct{}) error {
+	list, err := i.list(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	listMeta, err := meta.ListAccessor(list)
+	if err != nil {
+		return err
+	}
+	objs, err := meta.ExtractList(list)
+	if err != nil {
+		return err
+	}
+	if err := i.replace(objs); err != nil {
+		return err
+	}
+
+	resourceVersion := listMeta.GetResourceVersion()
+	for {
+		select {
+		case <-stopCh:
+			return nil
+		default:
+		}
+		timeout := int64((minWatchTimeout + time.Duration(rand.Int63n(int64(minWatchTimeout)))).Seconds())
+		w, err := i.watch(metav1.ListOptions{
+			ResourceVersion: resourceVersion,
+			TimeoutSeconds:  &timeout,
+		})
+		if err != nil {
+			return err
+		}
+		resourceVersion, err = i.handleWatch(w, resourceVersion, stopCh)
+		if err != nil || resourceVersion == "" {
+			return err
+		}
+	}
+}
+
+// handleWatch applies events of w and returns the last seen resource version.
+func (i *Informer) handleWatch(w watch.Interface, resourceVersion string, stopCh <-chan struct{}) (string, error) {
+	defer w.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return resourceVersion, nil
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				return resourceVersion, nil
+			}
+			if event.Type == watch.Error {
+				err := k8serrors.FromObject(event.Object)
+				if k8serrors.IsGone(err) || k8serrors.IsResourceExpired(err) {
+					glog.V(4).Infof("Watch of %s expired, relist: %v", i.name, err)
+					return "", nil
+				}
+				return resourceVersion, err
+			}
+			accessor, err := meta.Accessor(event.Object)
+			if err != nil {
+				return resourceVersion, fmt.Errorf("unexpected watch event object %T: %v", event.Object, err)
+			}
+			resourceVersion = accessor.GetResourceVersion()
+			switch event.Type {
+			case watch.Added, watch.Modified:
+				i.update(event.Object)
+			case watch.Deleted:
+				i.delete(event.Object)
+			}
+		}
+	}
+}
+
+func (i *Informer) replace(objs []runtime.Object) error {
+	items := make(map[string]runtime.Object, len(objs))
+	for _, obj := range objs {
+		key, err := Key(obj)
+		if err != nil {
+			return err
+		}
+		items[key] = obj
+	}
+
+	i.mu.Lock()
+	old := i.items
+	i.items = items
+	i.synced = true
+	handlers := i.handlers
+	i.mu.Unlock()
+
+	for key, obj := range items {
+		if oldObj, ok := old[key]; ok {
+			notifyUpdate(handlers, oldObj, obj)
+		} else {
+			notifyAdd(handlers, obj)
+		}
+	}
+	for key, obj := range old {
+		if _, ok := items[key]; !ok {
+			notifyDelete(handlers, obj)
+		}
+	}
+	return nil
+}
+
+func (i *Informer) update(obj runtime.Object) {
+	key, err := Key(obj)
+	if err != nil {
+		glog.Errorf("Failed to get key of %s: %v", i.name, err)
+		return
+	}
+	i.mu.Lock()
+	oldObj, exists := i.items[key]
+	i.items[key] = obj
+	handlers := i.handlers
+	i.mu.Unlock()
+
+	if exists {
+		notifyUpdate(handlers, oldObj, obj)
+	} else {
+		notifyAdd(handlers, obj)
+	}
+}
+
+func (i *Informer) delete(obj runtime.Object) {
+	key, err := Key(obj)
+	if err != nil {
+		glog.Errorf("Failed to get key of %s: %v", i.name, err)
+		return
+	}
+	i.mu.Lock()
+	_, exists := i.items[key]
+	delete(i.items, key)
+	handlers := i.handlers
+	i.mu.Unlock()
+
+	if exists {
+		notifyDelete(handlers, obj)
+	}
+}
+
+func notifyAdd(handlers []EventHandler, obj runtime.Object) {
+	for _, h := range handlers {
+		if h.OnAdd != nil {
+			h.OnAdd(obj)
+		}
+	}
+}
+
+func notifyUpdate(handlers []EventHandler, oldObj, newObj runtime.Object) {
+	for _, h := range handlers {
+		if h.OnUpdate != nil {
+			h.OnUpdate(oldObj, newObj)
+		}
+	}
+}
+
+func notifyDelete(handlers []EventHandler, obj runtime.Object) {
+	for _, h := range handlers {
+		if h.OnDelete != nil {
+			h.OnDelete(obj)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package jsonpatch
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Operation is a JSON patch operation, see RFC 6902.
+type Operation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// Apply applies the add, replace and remove operations of patch to doc.
+func Apply(doc, patch []byte) ([]byte, error) {
+	var ops []Operation
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return nil, fmt.Errorf("invalid json patch: %v", err)
+	}
+	var root interface{}
+	if err := json.Unmarshal(doc, &root); err != nil {
+		return nil, fmt.Errorf("invalid json document: %v", err)
+	}
+	for _, op := range ops {
+		var err error
+		if root, err = apply(root, op); err != nil {
+			return nil, fmt.Errorf("failed to %s %s: %v", op.Op, op.Path, err)
+		}
+	}
+	return json.Marshal(root)
+}
+
+func apply(root interface{}, op Operation) (interface{}, error) {
+	var value interface{}
+	if op.Op == "add" || op.Op == "replace" {
+		if err := json.Unmarshal(op.Value, &value); err != nil {
+			return nil, fmt.Errorf("invalid value: %v", err)
+		}
+	} else if op.Op != "remove" {
+		return nil, fmt.Errorf("unsupported op")
+	}
+	if op.Path == "" {
+		if op.Op == "remove" {
+			return nil, nil
+		}
+		return value, nil
+	}
+	if !strings.HasPrefix(op.Path, "/") {
+		return nil, fmt.Errorf("path must start with /")
+	}
+
+	tokens := strings.Split(op.Path[1:], "/")
+	for i := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(tokens[i], "~1", "/", -1), "~0", "~", -1)
+	}
+	return applyAt(root, tokens, op.Op, value)
+}
+
+// applyAt applies op at tokens relative to node, and returns the new node as
+// arrays may be reallocated.
+func applyAt(node interface{}, tokens []string, op string, value interface{}) (interface{}, error) {
+	token := tokens[0]
+	if len(tokens) > 1 {
+		c, err := child(node, token)
+		if err != nil {
+			return nil, err
+		}
+		if c, err = applyAt(c, tokens[1:], op, value); err != nil {
+			return nil, err
+		}
+		switch n := node.(type) {
+		case map[string]interface{}:
+			n[token] = c
+		case []interface{}:
+			index, _ := strconv.Atoi(token)
+			n[index] = c
+		}
+		return node, nil
+	}
+
+	switch n := node.(type) {
+	case map[string]interface{}:
+		if _, ok := n[token]; !ok && op != "add" {
+			return nil, fmt.Errorf("%s not found", token)
+		}
+		if op == "remove" {
+			delete(n, token)
+		} else {
+			n[token] = value
+		}
+		return n, nil
+	case []interface{}:
+		if token == "-" && op == "add" {
+			return append(n, value), nil
+		}
+		index, err := strconv.Atoi(token)
+		if err != nil || index < 0 || index > len(n) || index == len(n) && op != "add" {
+			return nil, fmt.Errorf("invalid array index %s", token)
+		}
+		switch op {
+		case "add":
+			n = append(n, nil)
+			copy(n[index+1:], n[index:])
+			n[index] = value
+		case "replace":
+			n[index] = value
+		case "remove":
+			n = append(n[:index], n[index+1:]...)
+		}
+		return n, nil
+	default:
+		return nil, fmt.Errorf("parent of %s is not an object or array", token)
+	}
+}
+
+func child(parent interface{}, token string) (interface{}, error) {
+	switch p := parent.(type) {
+	case map[string]interface{}:
+		c, ok := p[token]
+		if !ok {
+			return nil, fmt.Errorf("%s not found", token)
+		}
+		return c, nil
+	case []interface{}:
+		index, err := strconv.Atoi(token)
+		if err != nil || index < 0 || index >= len(p) {
+			return nil, fmt.Errorf("invalid array index %s", token)
+		}
+		return p[index], nil
+	default:
+		return nil, fmt.Errorf("%s is not in an object or array", token)
+	}
+}
@@ -0,0 +1,125 @@
+package jsonpatch
+
+import "testing"
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name      string
+		doc       string
+		patch     string
+		expect    string
+		expectErr bool
+	}{
+		{
+			name:   "add object member",
+			doc:    `{"metadata":{"name":"pod"}}`,
+			patch:  `[{"op":"add","path":"/metadata/annotations","value":{"a":"b"}}]`,
+			expect: `{"metadata":{"annotations":{"a":"b"},"name":"pod"}}`,
+		},
+		{
+			name:   "add replaces existing member",
+			doc:    `{"a":1}`,
+			patch:  `[{"op":"add","path":"/a","value":2}]`,
+			expect: `{"a":2}`,
+		},
+		{
+			name:   "escaped slash",
+			doc:    `{"annotations":{}}`,
+			patch:  `[{"op":"add","path":"/annotations/tke.cloud.tencent.com~1networks","value":"tke-route-eni"}]`,
+			expect: `{"annotations":{"tke.cloud.tencent.com/networks":"tke-route-eni"}}`,
+		},
+		{
+			name:   "escaped tilde",
+			doc:    `{"a~b":1}`,
+			patch:  `[{"op":"replace","path":"/a~0b","value":2}]`,
+			expect: `{"a~b":2}`,
+		},
+		{
+			name:   "tilde zero one is tilde one",
+			doc:    `{"~1":1,"/":2}`,
+			patch:  `[{"op":"remove","path":"/~01"}]`,
+			expect: `{"/":2}`,
+		},
+		{
+			name:   "remove escaped member",
+			doc:    `{"limits":{"cpu":"1","tke.cloud.tencent.com/eni-ip":"1"}}`,
+			patch:  `[{"op":"remove","path":"/limits/tke.cloud.tencent.com~1eni-ip"}]`,
+			expect: `{"limits":{"cpu":"1"}}`,
+		},
+		{
+			name:   "array add at index",
+			doc:    `{"a":[1,3]}`,
+			patch:  `[{"op":"add","path":"/a/1","value":2}]`,
+			expect: `{"a":[1,2,3]}`,
+		},
+		{
+			name:   "array add at end index",
+			doc:    `{"a":[1]}`,
+			patch:  `[{"op":"add","path":"/a/1","value":2}]`,
+			expect: `{"a":[1,2]}`,
+		},
+		{
+			name:   "array append",
+			doc:    `{"a":[1]}`,
+			patch:  `[{"op":"add","path":"/a/-","value":{"b":2}}]`,
+			expect: `{"a":[1,{"b":2}]}`,
+		},
+		{
+			name:   "array remove",
+			doc:    `{"a":[1,2,3]}`,
+			patch:  `[{"op":"remove","path":"/a/1"}]`,
+			expect: `{"a":[1,3]}`,
+		},
+		{
+			name:   "array replace",
+			doc:    `{"a":[1,2]}`,
+			patch:  `[{"op":"replace","path":"/a/0","value":0}]`,
+			expect: `{"a":[0,2]}`,
+		},
+		{
+			name:   "nested array",
+			doc:    `{"spec":{"containers":[{"name":"c"}]}}`,
+			patch:  `[{"op":"add","path":"/spec/containers/0/resources","value":{"limits":{"tke.cloud.tencent.com/eni-ip":"1"}}}]`,
+			expect: `{"spec":{"containers":[{"name":"c","resources":{"limits":{"tke.cloud.tencent.com/eni-ip":"1"}}}]}}`,
+		},
+		{
+			name:   "operations in order",
+			doc:    `{"a":[1]}`,
+			patch:  `[{"op":"add","path":"/a/-","value":2},{"op":"remove","path":"/a/0"},{"op":"add","path":"/b","value":true}]`,
+			expect: `{"a":[2],"b":true}`,
+		},
+		{
+			name:   "replace root",
+			doc:    `{"a":1}`,
+			patch:  `[{"op":"replace","path":"","value":{"b":2}}]`,
+			expect: `{"b":2}`,
+		},
+		{name: "replace missing member", doc: `{}`, patch: `[{"op":"replace","path":"/a","value":1}]`, expectErr: true},
+		{name: "remove missing member", doc: `{}`, patch: `[{"op":"remove","path":"/a"}]`, expectErr: true},
+		{name: "missing parent", doc: `{}`, patch: `[{"op":"add","path":"/a/b","value":1}]`, expectErr: true},
+		{name: "array index out of range", doc: `{"a":[1]}`, patch: `[{"op":"add","path":"/a/2","value":1}]`, expectErr: true},
+		{name: "array remove end", doc: `{"a":[1]}`, patch: `[{"op":"remove","path":"/a/1"}]`, expectErr: true},
+		{name: "array index not a number", doc: `{"a":[1]}`, patch: `[{"op":"replace","path":"/a/x","value":1}]`, expectErr: true},
+		{name: "parent is a value", doc: `{"a":1}`, patch: `[{"op":"add","path":"/a/b","value":1}]`, expectErr: true},
+		{name: "unsupported op", doc: `{"a":1}`, patch: `[{"op":"move","from":"/a","path":"/b"}]`, expectErr: true},
+		{name: "relative path", doc: `{"a":1}`, patch: `[{"op":"remove","path":"a"}]`, expectErr: true},
+		{name: "invalid patch", doc: `{}`, patch: `{"op":"remove"}`, expectErr: true},
+		{name: "invalid document", doc: `{`, patch: `[]`, expectErr: true},
+	}
+	for _, test := range tests {
+		patched, err := Apply([]byte(test.doc), []byte(test.patch))
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("%s: expect error, got %s", test.name, patched)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if string(patched) != test.expect {
+			t.Errorf("%s: expect %s, got %s", test.name, test.expect, patched)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package leaderelection
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+	coordinationv1beta1 "k8s.io/api/coordination/v1beta1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Config of a lease based leader election.
+type Config struct {
+	Client    kubernetes.Interface
+	Namespace string
+	Name      string
+	// Identity of this candidate, defaults to hostname with a random suffix.
+	Identity string
+
+	// LeaseDuration is how long other candidates wait before taking over a
+	// lease not renewed.
+	LeaseDuration time.Duration
+	// RenewDeadline is how long the leader keeps retrying to renew before
+	// giving up leadership, it must be less than LeaseDuration.
+	RenewDeadline time.Duration
+	// RetryPeriod is how often candidates try to acquire or renew the lease.
+	RetryPeriod time.Duration
+
+	// OnStartedLeading is run in a goroutine on becoming leader, stop is
+	// closed on losing leadership.
+	OnStartedLeading func(stop <-chan struct{})
+	// OnStoppedLeading may be nil.
+	OnStoppedLeading func()
+}
+
+// DefaultConfig returns a config with the timings of kube-controller-manager.
+func DefaultConfig(client kubernetes.Interface, namespace, name string) Config {
+	return Config{
+		Client:        client,
+		Namespace:     namespace,
+		Name:          name,
+		LeaseDuration: 15 * time.Second,
+		RenewDeadline: 10 * time.Second,
+		RetryPeriod:   2 * time.Second,
+	}
+}
+
+type elector struct {
+	Config
+	// observedRecord and observedTime avoid depending on clock skew between
+	// candidates, a lease expires LeaseDuration after it is seen changing.
+	observedRecord string
+	observedTime   time.Time
+}
+
+// Run campaigns for leadership until stopCh is closed. Leadership may be
+// gained and lost several times.
+func Run(c Config, stopCh <-chan struct{}) error {
+	if c.RenewDeadline >= c.LeaseDuration || c.RetryPeriod >= c.RenewDeadline {
+		return fmt.Errorf("leader election needs retry period < renew deadline < lease duration")
+	}
+	if c.Identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return err
+		}
+		c.Identity = fmt.Sprintf("%s_%08x", hostname, rand.New(rand.NewSource(time.Now().UnixNano())).Uint32())
+	}
+	e := &elector{Config: c}
+	for {
+		if !e.acquire(stopCh) {
+			return nil
+		}
+		glog.Infof("%s became leader of lease %s/%s", e.Identity, e.Namespace, e.Name)
+		leading := make(chan struct{})
+		go e.OnStartedLeading(leading)
+		stopped := e.renew(stopCh)
+		close(leading)
+		if e.OnStoppedLeading != nil {
+			e.OnStoppedLeading()
+		}
+		if stopped {
+			e.release()
+			return nil
+		}
+		glog.Warningf("%s lost leadership of lease %s/%s", e.Identity, e.Namespace, e.Name)
+	}
+}
+
+// acquire blocks until the lease is acquired, it returns false if stopCh is
+// closed before.
+func (e *elector) acquire(stopCh <-chan struct{}) bool {
+	ticker := time.NewTicker(e.RetryPeriod)
+	defer ticker.Stop()
+	for {
+		if e.tryAcquireOrRenew() {
+			return true
+		}
+		select {
+		case <-stopCh:
+			return false
+		case <-ticker.C:
+		}
+	}
+}
+
+// renew keeps renewing the lease until failing for RenewDeadline, it returns
+// true if stopCh is closed before.
+func (e *elector) renew(stopCh <-chan struct{}) bool {
+	ticker := time.NewTicker(e.RetryPeriod)
+	defer ticker.Stop()
+	renewed := time.Now()
+	for {
+		select {
+		case <-stopCh:
+			return true
+		case <-ticker.C:
+		}
+		if e.tryAcquireOrRenew() {
+			renewed = time.Now()
+		} else if time.Since(renewed) > e.RenewDeadline {
+			return false
+		}
+	}
+}
+
+func (e *elector) tryAcquireOrRenew() bool {
+	leases := e.Client.CoordinationV1beta1().Leases(e.Namespace)
+	now := metav1.NewMicroTime(time.Now())
+	duration := int32(e.LeaseDuration / time.Second)
+	lease, err := leases.Get(e.Name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		transitions := int32(0)
+		_, err = leases.Create(&coordinationv1beta1.Lease{
+			ObjectMeta: metav1.ObjectMeta{Namespace: e.Namespace, Name: e.Name},
+			Spec: coordinationv1beta1.LeaseSpec{
+				HolderIdentity:       &e.Identity,
+				LeaseDurationSeconds: &duration,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+				LeaseTransitions:     &transitions,
+			},
+		})
+		if err != nil {
+			glog.Warningf("Failed to create lease %s/%s: %v", e.Namespace, e.Name, err)
+			return false
+		}
+		return true
+	}
+	if err != nil {
+		glog.Warningf("Failed to get lease %s/%s: %v", e.Namespace, e.Name, err)
+		return false
+	}
+
+	var holder string
+	if lease.Spec.HolderIdentity != nil {
+		holder = *lease.Spec.HolderIdentity
+	}
+	record := fmt.Sprintf("%s/%s", holder, lease.ResourceVersion)
+	if record != e.observedRecord {
+		e.observedRecord, e.observedTime = record, now.Time
+	}
+	leaseDuration := e.LeaseDuration
+	if lease.Spec.LeaseDurationSeconds != nil {
+		leaseDuration = time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second
+	}
+	if holder != "" && holder != e.Identity && e.observedTime.Add(leaseDuration).After(now.Time) {
+		glog.V(5).Infof("Lease %s/%s is held by %s", e.Namespace, e.Name, holder)
+		return false
+	}
+
+	if holder != e.Identity {
+		transitions := int32(1)
+		if lease.Spec.LeaseTransitions != nil {
+			transitions = *lease.Spec.LeaseTransitions + 1
+		}
+		lease.Spec.LeaseTransitions = &transitions
+		lease.Spec.AcquireTime = &now
+	}
+	lease.Spec.HolderIdentity = &e.Identity
+	lease.Spec.LeaseDurationSeconds = &duration
+	lease.Spec.RenewTime = &now
+	if _, err := leases.Update(lease); err != nil {
+		glog.Warningf("Failed to update lease %s/%s: %v", e.Namespace, e.Name, err)
+		return false
+	}
+	return true
+}
+
+// release gives up the lease so that another candidate takes over without
+// waiting for it to expire.
+func (e *elector) release() {
+	leases := e.Client.CoordinationV1beta1().Leases(e.Namespace)
+	lease, err := leases.Get(e.Name, metav1.GetOptions{})
+	if err != nil || lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != e.Identity {
+		return
+	}
+	holder := ""
+	lease.Spec.HolderIdentity = &holder
+	if _, err := leases.Update(lease); err != nil {
+		glog.Warningf("Failed to release lease %s/%s: %v", e.Namespace, e.Name, err)
+	}
+}
@@ -0,0 +1,212 @@
+package leaderelection
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	coordinationv1beta1 "k8s.io/api/coordination/v1beta1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	coordinationv1beta1client "k8s.io/client-go/kubernetes/typed/coordination/v1beta1"
+)
+
+var leaseResource = schema.GroupResource{Group: "coordination.k8s.io", Resource: "leases"}
+
+// fakeClient stores a single lease, updates with a stale resourceVersion
+// conflict like apiserver, other calls panic.
+type fakeClient struct {
+	kubernetes.Interface
+	mu      sync.Mutex
+	lease   *coordinationv1beta1.Lease
+	version int
+	// interfere updates the lease by another candidate before each update.
+	interfere bool
+}
+
+func (c *fakeClient) CoordinationV1beta1() coordinationv1beta1client.CoordinationV1beta1Interface {
+	return fakeCoordination{client: c}
+}
+
+func (c *fakeClient) holder() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lease == nil || c.lease.Spec.HolderIdentity == nil {
+		return ""
+	}
+	return *c.lease.Spec.HolderIdentity
+}
+
+type fakeCoordination struct {
+	coordinationv1beta1client.CoordinationV1beta1Interface
+	client *fakeClient
+}
+
+func (f fakeCoordination) Leases(namespace string) coordinationv1beta1client.LeaseInterface {
+	return fakeLeases{client: f.client}
+}
+
+type fakeLeases struct {
+	coordinationv1beta1client.LeaseInterface
+	client *fakeClient
+}
+
+func (l fakeLeases) Get(name string, options metav1.GetOptions) (*coordinationv1beta1.Lease, error) {
+	l.client.mu.Lock()
+	defer l.client.mu.Unlock()
+	if l.client.lease == nil {
+		return nil, k8serrors.NewNotFound(leaseResource, name)
+	}
+	return l.client.lease.DeepCopy(), nil
+}
+
+func (l fakeLeases) Create(lease *coordinationv1beta1.Lease) (*coordinationv1beta1.Lease, error) {
+	l.client.mu.Lock()
+	defer l.client.mu.Unlock()
+	if l.client.lease != nil {
+		return nil, k8serrors.NewAlreadyExists(leaseResource, lease.Name)
+	}
+	return l.client.store(lease), nil
+}
+
+func (l fakeLeases) Update(lease *coordinationv1beta1.Lease) (*coordinationv1beta1.Lease, error) {
+	l.client.mu.Lock()
+	defer l.client.mu.Unlock()
+	if l.client.interfere && l.client.lease != nil {
+		l.client.store(l.client.lease)
+	}
+	if l.client.lease == nil || l.client.lease.ResourceVersion != lease.ResourceVersion {
+		return nil, k8serrors.NewConflict(leaseResource, lease.Name, nil)
+	}
+	return l.client.store(lease), nil
+}
+
+func (c *fakeClient) store(lease *coordinationv1beta1.Lease) *coordinationv1beta1.Lease {
+	c.version++
+	c.lease = lease.DeepCopy()
+	c.lease.ResourceVersion = strconv.Itoa(c.version)
+	return c.lease.DeepCopy()
+}
+
+func heldBy(holder string, transitions int32) *coordinationv1beta1.Lease {
+	duration := int32(15)
+	return &coordinationv1beta1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "lease", ResourceVersion: "1"},
+		Spec: coordinationv1beta1.LeaseSpec{
+			HolderIdentity:       &holder,
+			LeaseDurationSeconds: &duration,
+			LeaseTransitions:     &transitions,
+		},
+	}
+}
+
+func TestTryAcquireOrRenew(t *testing.T) {
+	tests := []struct {
+		name  string
+		lease *coordinationv1beta1.Lease
+		// observedAgo is how long ago the elector saw the lease unchanged,
+		// zero if it has never seen it.
+		observedAgo time.Duration
+		interfere   bool
+
+		acquired    bool
+		holder      string
+		transitions int32
+	}{
+		{name: "create", acquired: true, holder: "me"},
+		{name: "renew own", lease: heldBy("me", 2), acquired: true, holder: "me", transitions: 2},
+		{name: "held by other", lease: heldBy("other", 2), holder: "other", transitions: 2},
+		{name: "held by other seen recently", lease: heldBy("other", 2), observedAgo: 5 * time.Second, holder: "other", transitions: 2},
+		{name: "expired", lease: heldBy("other", 2), observedAgo: time.Minute, acquired: true, holder: "me", transitions: 3},
+		{name: "released", lease: heldBy("", 2), acquired: true, holder: "me", transitions: 3},
+		{name: "conflict", lease: heldBy("me", 2), interfere: true, holder: "me", transitions: 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := &fakeClient{lease: test.lease, version: 1, interfere: test.interfere}
+			e := &elector{Config: DefaultConfig(client, "kube-system", "lease")}
+			e.Identity = "me"
+			if test.observedAgo > 0 {
+				e.observedRecord = *test.lease.Spec.HolderIdentity + "/" + test.lease.ResourceVersion
+				e.observedTime = time.Now().Add(-test.observedAgo)
+			}
+			if acquired := e.tryAcquireOrRenew(); acquired != test.acquired {
+				t.Errorf("acquired = %v, want %v", acquired, test.acquired)
+			}
+			if holder := client.holder(); holder != test.holder {
+				t.Errorf("holder = %q, want %q", holder, test.holder)
+			}
+			lease := client.lease
+			if lease.Spec.LeaseTransitions == nil || *lease.Spec.LeaseTransitions != test.transitions {
+				t.Errorf("transitions = %v, want %d", lease.Spec.LeaseTransitions, test.transitions)
+			}
+			if test.acquired && (lease.Spec.RenewTime == nil || time.Since(lease.Spec.RenewTime.Time) > time.Second) {
+				t.Errorf("renew time %v is not updated", lease.Spec.RenewTime)
+			}
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	client := &fakeClient{}
+	c := Config{
+		Client:        client,
+		Namespace:     "kube-system",
+		Name:          "lease",
+		Identity:      "me",
+		LeaseDuration: time.Second,
+		RenewDeadline: 500 * time.Millisecond,
+		RetryPeriod:   10 * time.Millisecond,
+	}
+	started := make(chan struct{})
+	leadingStopped := make(chan struct{})
+	c.OnStartedLeading = func(stop <-chan struct{}) {
+		close(started)
+		<-stop
+		close(leadingStopped)
+	}
+	stopCh := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- Run(c, stopCh) }()
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not leading")
+	}
+	// renewing changes the resourceVersion
+	client.mu.Lock()
+	version := client.version
+	client.mu.Unlock()
+	time.Sleep(100 * time.Millisecond)
+	client.mu.Lock()
+	renewed := client.version > version
+	client.mu.Unlock()
+	if !renewed {
+		t.Error("lease is not renewed")
+	}
+
+	close(stopCh)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-leadingStopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("leading is not stopped")
+	}
+	if holder := client.holder(); holder != "" {
+		t.Errorf("holder = %q after stopping, want released", holder)
+	}
+}
+
+func TestRunInvalidTimings(t *testing.T) {
+	c := DefaultConfig(&fakeClient{}, "kube-system", "lease")
+	c.RetryPeriod = c.RenewDeadline
+	if err := Run(c, make(chan struct{})); err == nil {
+		t.Error("Run accepts retry period equal to renew deadline")
+	}
+}
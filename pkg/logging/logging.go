@@ -0,0 +1,125 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Formats of structured logs.
+const (
+	// FormatText logs through glog as a message followed by key=value pairs.
+	FormatText = "text"
+	// FormatJSON writes one JSON object per line to stdout, with ts, level
+	// and msg besides the fields, so that log pipelines can index them.
+	FormatJSON = "json"
+)
+
+// Fields of a structured log, keys are sorted in the output.
+type Fields map[string]interface{}
+
+var (
+	mu     sync.Mutex
+	format           = FormatText
+	out    io.Writer = os.Stdout
+)
+
+// SetFormat sets the format of structured logs, glog logs are unchanged.
+func SetFormat(f string) error {
+	switch f {
+	case FormatText, FormatJSON:
+	default:
+		return fmt.Errorf("unknown log format %q, expect one of %s and %s", f, FormatText, FormatJSON)
+	}
+	mu.Lock()
+	format = f
+	mu.Unlock()
+	return nil
+}
+
+// Info logs msg with fields if glog verbosity is at least level.
+func Info(level glog.Level, msg string, fields Fields) {
+	if glog.V(level) {
+		write("info", msg, fields)
+	}
+}
+
+// Warning logs msg with fields.
+func Warning(msg string, fields Fields) {
+	write("warning", msg, fields)
+}
+
+// Error logs msg with fields.
+func Error(msg string, fields Fields) {
+	write("error", msg, fields)
+}
+
+func write(level, msg string, fields Fields) {
+	mu.Lock()
+	defer mu.Unlock()
+	if format == FormatJSON {
+		entry := make(map[string]interface{}, len(fields)+3)
+		for k, v := range fields {
+			entry[k] = v
+		}
+		entry["ts"] = time.Now().UTC().Format(time.RFC3339Nano)
+		entry["level"] = level
+		entry["msg"] = msg
+		data, err := marshal(entry)
+		if err != nil {
+			glog.Errorf("Failed to encode log %q: %v", msg, err)
+			return
+		}
+		out.Write(append(data, '\n'))
+		return
+	}
+
+	line := msg + formatText(fields)
+	switch level {
+	case "error":
+		glog.ErrorDepth(2, line)
+	case "warning":
+		glog.WarningDepth(2, line)
+	default:
+		glog.InfoDepth(2, line)
+	}
+}
+
+// formatText formats fields as sorted key=value pairs, values with spaces
+// or quotes are quoted.
+func formatText(fields Fields) string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	for _, k := range keys {
+		value := fmt.Sprint(fields[k])
+		if strings.ContainsAny(value, " \"=\n") || value == "" {
+			value = fmt.Sprintf("%q", value)
+		}
+		fmt.Fprintf(&buf, " %s=%s", k, value)
+	}
+	return buf.String()
+}
+
+// marshal encodes v as JSON without escaping HTML characters, logs are not
+// embedded in HTML.
+func marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
@@ -0,0 +1,106 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Redacted replaces sensitive values in logs.
+const Redacted = "<redacted>"
+
+// Redactions of Redact.
+const (
+	// RedactEnv replaces env values of containers, references are kept.
+	RedactEnv = "env"
+	// RedactLastApplied replaces the kubectl last applied configuration,
+	// which holds the whole object including env values.
+	RedactLastApplied = "last-applied"
+	// RedactCommand replaces command and args of containers.
+	RedactCommand = "command"
+)
+
+// DefaultRedactions are applied to logged request bodies.
+var DefaultRedactions = []string{RedactEnv, RedactLastApplied}
+
+// lastAppliedAnnotation holds the whole object as applied by kubectl.
+const lastAppliedAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+
+// ParseRedactions parses comma separated redactions, none for no redaction.
+func ParseRedactions(s string) ([]string, error) {
+	var redactions []string
+	for _, r := range strings.Split(s, ",") {
+		switch r = strings.TrimSpace(r); r {
+		case "", "none":
+		case RedactEnv, RedactLastApplied, RedactCommand:
+			redactions = append(redactions, r)
+		default:
+			return nil, fmt.Errorf("unknown redaction %q, expect none or some of %s, %s and %s", r, RedactEnv, RedactLastApplied, RedactCommand)
+		}
+	}
+	return redactions, nil
+}
+
+// Redact returns the JSON data, e.g. an admission review, with the default
+// redactions applied, so that bodies can be logged. Data which is not JSON
+// is dropped entirely.
+func Redact(data []byte) string {
+	return RedactWith(data, DefaultRedactions)
+}
+
+// RedactWith returns the JSON data with redactions applied.
+func RedactWith(data []byte, redactions []string) string {
+	if len(redactions) == 0 {
+		return string(data)
+	}
+	var obj interface{}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return Redacted
+	}
+	enabled := make(map[string]bool, len(redactions))
+	for _, r := range redactions {
+		enabled[r] = true
+	}
+	redact(obj, enabled)
+	redacted, err := marshal(obj)
+	if err != nil {
+		return Redacted
+	}
+	return string(redacted)
+}
+
+func redact(obj interface{}, enabled map[string]bool) {
+	switch v := obj.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			switch {
+			case key == "env" && enabled[RedactEnv]:
+				if envs, ok := value.([]interface{}); ok {
+					for _, env := range envs {
+						if env, ok := env.(map[string]interface{}); ok {
+							if _, ok := env["value"]; ok {
+								env["value"] = Redacted
+							}
+						}
+					}
+					continue
+				}
+			case key == lastAppliedAnnotation && enabled[RedactLastApplied]:
+				v[key] = Redacted
+				continue
+			case (key == "command" || key == "args") && enabled[RedactCommand]:
+				if args, ok := value.([]interface{}); ok {
+					for i := range args {
+						args[i] = Redacted
+					}
+					continue
+				}
+			}
+			redact(value, enabled)
+		}
+	case []interface{}:
+		for _, value := range v {
+			redact(value, enabled)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package logging
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRedactWith(t *testing.T) {
+	pod := `{"metadata":{"annotations":{"kubectl.kubernetes.io/last-applied-configuration":"{\"secret\":\"x\"}","app":"<a>"}},` +
+		`"spec":{"containers":[{"args":["--password","x"],"command":["run"],"env":[{"name":"A","value":"secret"},{"name":"B","valueFrom":{"secretKeyRef":{"key":"k","name":"s"}}}]}]}}`
+	tests := []struct {
+		name       string
+		data       string
+		redactions []string
+		expect     string
+	}{
+		{name: "none", data: pod, expect: pod},
+		{
+			name:       "env",
+			data:       pod,
+			redactions: []string{RedactEnv},
+			expect: `{"metadata":{"annotations":{"app":"<a>","kubectl.kubernetes.io/last-applied-configuration":"{\"secret\":\"x\"}"}},` +
+				`"spec":{"containers":[{"args":["--password","x"],"command":["run"],"env":[{"name":"A","value":"<redacted>"},{"name":"B","valueFrom":{"secretKeyRef":{"key":"k","name":"s"}}}]}]}}`,
+		},
+		{
+			name:       "defaults",
+			data:       pod,
+			redactions: DefaultRedactions,
+			expect: `{"metadata":{"annotations":{"app":"<a>","kubectl.kubernetes.io/last-applied-configuration":"<redacted>"}},` +
+				`"spec":{"containers":[{"args":["--password","x"],"command":["run"],"env":[{"name":"A","value":"<redacted>"},{"name":"B","valueFrom":{"secretKeyRef":{"key":"k","name":"s"}}}]}]}}`,
+		},
+		{
+			name:       "command",
+			data:       pod,
+			redactions: []string{RedactCommand},
+			expect: `{"metadata":{"annotations":{"app":"<a>","kubectl.kubernetes.io/last-applied-configuration":"{\"secret\":\"x\"}"}},` +
+				`"spec":{"containers":[{"args":["<redacted>","<redacted>"],"command":["<redacted>"],"env":[{"name":"A","value":"secret"},{"name":"B","valueFrom":{"secretKeyRef":{"key":"k","name":"s"}}}]}]}}`,
+		},
+		{
+			name:       "nested in an admission review",
+			data:       `{"request":{"object":{"spec":{"initContainers":[{"env":[{"name":"A","value":"secret"}]}]}}}}`,
+			redactions: []string{RedactEnv},
+			expect:     `{"request":{"object":{"spec":{"initContainers":[{"env":[{"name":"A","value":"<redacted>"}]}]}}}}`,
+		},
+		{
+			name:       "env which is not a list",
+			data:       `{"env":{"value":"x"}}`,
+			redactions: []string{RedactEnv},
+			expect:     `{"env":{"value":"x"}}`,
+		},
+		{name: "not json", data: `{"env":`, redactions: []string{RedactEnv}, expect: Redacted},
+	}
+	for _, test := range tests {
+		if redacted := RedactWith([]byte(test.data), test.redactions); redacted != test.expect {
+			t.Errorf("%s: expect %s, got %s", test.name, test.expect, redacted)
+		}
+	}
+}
+
+func TestParseRedactions(t *testing.T) {
+	tests := []struct {
+		s          string
+		redactions []string
+		expectErr  bool
+	}{
+		{"", nil, false},
+		{"none", nil, false},
+		{"env, command", []string{RedactEnv, RedactCommand}, false},
+		{"env,secrets", nil, true},
+	}
+	for _, test := range tests {
+		redactions, err := ParseRedactions(test.s)
+		if (err != nil) != test.expectErr || !reflect.DeepEqual(redactions, test.redactions) {
+			t.Errorf("ParseRedactions(%q): expect %v error %t, got %v %v", test.s, test.redactions, test.expectErr, redactions, err)
+		}
+	}
+}
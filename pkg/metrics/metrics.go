@@ -0,0 +1,240 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Namespace prefixes every metric of the webhook.
+const Namespace = "eni_ip_webhook"
+
+var registry = &metricRegistry{}
+
+type metricRegistry struct {
+	mu      sync.Mutex
+	metrics []*metricVec
+	// snapshot is held to write all metrics, and to replace samples of
+	// several metrics at once.
+	snapshot sync.RWMutex
+}
+
+func (r *metricRegistry) register(m *metricVec) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, registered := range r.metrics {
+		if registered.name == m.name {
+			panic(fmt.Sprintf("metric %s registered twice", m.name))
+		}
+	}
+	r.metrics = append(r.metrics, m)
+}
+
+func (r *metricRegistry) write(buf *bytes.Buffer) {
+	r.mu.Lock()
+	metrics := make([]*metricVec, len(r.metrics))
+	copy(metrics, r.metrics)
+	r.mu.Unlock()
+
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].name < metrics[j].name })
+	r.snapshot.RLock()
+	defer r.snapshot.RUnlock()
+	for _, m := range metrics {
+		m.write(buf)
+	}
+}
+
+type sample struct {
+	labelValues []string
+	value       float64
+}
+
+type metricVec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mu      sync.Mutex
+	samples map[string]*sample
+}
+
+func newMetricVec(name, help, kind string, labels []string) *metricVec {
+	m := &metricVec{
+		name:    Namespace + "_" + name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		samples: make(map[string]*sample),
+	}
+	registry.register(m)
+	return m
+}
+
+func (m *metricVec) sample(labelValues []string) *sample {
+	return m.sampleOf(m.samples, labelValues)
+}
+
+func (m *metricVec) sampleOf(samples map[string]*sample, labelValues []string) *sample {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", m.name, len(m.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := samples[key]
+	if !ok {
+		s = &sample{labelValues: append([]string(nil), labelValues...)}
+		samples[key] = s
+	}
+	return s
+}
+
+func (m *metricVec) set(value float64, labelValues []string) {
+	m.mu.Lock()
+	m.sample(labelValues).value = value
+	m.mu.Unlock()
+}
+
+func (m *metricVec) add(value float64, labelValues []string) {
+	m.mu.Lock()
+	m.sample(labelValues).value += value
+	m.mu.Unlock()
+}
+
+func (m *metricVec) reset() {
+	m.replace(make(map[string]*sample))
+}
+
+func (m *metricVec) replace(samples map[string]*sample) {
+	m.mu.Lock()
+	m.samples = samples
+	m.mu.Unlock()
+}
+
+func (m *metricVec) write(buf *bytes.Buffer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(buf, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(buf, "# TYPE %s %s\n", m.name, m.kind)
+	keys := make([]string, 0, len(m.samples))
+	for k := range m.samples {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := m.samples[k]
+		buf.WriteString(m.name)
+		writeLabels(buf, m.labels, s.labelValues)
+		buf.WriteByte(' ')
+		buf.WriteString(strconv.FormatFloat(s.value, 'g', -1, 64))
+		buf.WriteByte('\n')
+	}
+}
+
+func writeLabels(buf *bytes.Buffer, labels, values []string) {
+	if len(labels) == 0 {
+		return
+	}
+	buf.WriteByte('{')
+	for i, label := range labels {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(buf, "%s=%s", label, strconv.Quote(values[i]))
+	}
+	buf.WriteByte('}')
+}
+
+// GaugeVec is a gauge partitioned by labels.
+type GaugeVec struct {
+	vec *metricVec
+}
+
+// NewGaugeVec registers a gauge named eni_ip_webhook_<name>.
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{vec: newMetricVec(name, help, "gauge", labels)}
+}
+
+// Set sets the gauge of labelValues to value.
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	g.vec.set(value, labelValues)
+}
+
+// Add adds value to the gauge of labelValues.
+func (g *GaugeVec) Add(value float64, labelValues ...string) {
+	g.vec.add(value, labelValues)
+}
+
+// Reset removes all samples.
+func (g *GaugeVec) Reset() {
+	g.vec.reset()
+}
+
+// Samples are gauge values built apart from their GaugeVec, to export a
+// fresh snapshot with Replace.
+type Samples struct {
+	vec     *metricVec
+	samples map[string]*sample
+}
+
+// NewSamples returns empty samples of g.
+func (g *GaugeVec) NewSamples() *Samples {
+	return &Samples{vec: g.vec, samples: make(map[string]*sample)}
+}
+
+// Set sets the sample of labelValues to value.
+func (s *Samples) Set(value float64, labelValues ...string) {
+	s.vec.sampleOf(s.samples, labelValues).value = value
+}
+
+// Replace swaps all samples of their gauges for samples at once, so that
+// scrapes see either the old or the new snapshot, never a partial one.
+func Replace(samples ...*Samples) {
+	registry.snapshot.Lock()
+	defer registry.snapshot.Unlock()
+	for _, s := range samples {
+		s.vec.replace(s.samples)
+	}
+}
+
+// CounterVec is a counter partitioned by labels.
+type CounterVec struct {
+	vec *metricVec
+}
+
+// NewCounterVec registers a counter named eni_ip_webhook_<name>.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{vec: newMetricVec(name, help, "counter", labels)}
+}
+
+// Inc increases the counter of labelValues by one.
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.vec.add(1, labelValues)
+}
+
+// Add increases the counter of labelValues by value, which must not be negative.
+func (c *CounterVec) Add(value float64, labelValues ...string) {
+	c.vec.add(value, labelValues)
+}
+
+// BoolToFloat converts b to a gauge value.
+func BoolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Handler serves all registered metrics.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		registry.write(&buf)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(buf.Bytes())
+	})
+}
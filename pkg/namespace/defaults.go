@@ -0,0 +1,50 @@
+package namespace
+
+import (
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/informer"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// DefaultNetworksAnnotation sets the networks of pods in the namespace which
+// do not select networks by themselves, in the same format as the pod
+// annotation tke.cloud.tencent.com/networks.
+const DefaultNetworksAnnotation = "tke.cloud.tencent.com/default-networks"
+
+// Defaults looks up namespace default networks from a namespace informer.
+type Defaults struct {
+	namespaces *informer.Informer
+}
+
+// NewDefaults returns Defaults backed by namespaces, see informer.NewNamespaceInformer.
+func NewDefaults(namespaces *informer.Informer) *Defaults {
+	return &Defaults{namespaces: namespaces}
+}
+
+// DefaultNetworks returns the default networks annotated on namespace.
+func (d *Defaults) DefaultNetworks(namespace string) (string, bool) {
+	obj, ok := d.namespaces.Get(namespace)
+	if !ok {
+		return "", false
+	}
+	ns, ok := obj.(*corev1.Namespace)
+	if !ok {
+		return "", false
+	}
+	networks, ok := ns.Annotations[DefaultNetworksAnnotation]
+	return networks, ok
+}
+
+// Known returns whether namespace is in the cache.
+func (d *Defaults) Known(namespace string) bool {
+	_, ok := d.namespaces.Get(namespace)
+	return ok
+}
+
+// Degraded reports namespace defaults are ignored before namespaces are synced.
+func (d *Defaults) Degraded() string {
+	if d.namespaces.HasSynced() {
+		return ""
+	}
+	return "namespace cache is not synced, namespace default networks are ignored"
+}
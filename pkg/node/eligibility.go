@@ -0,0 +1,124 @@
+package node
+
+import (
+	"encoding/json"
+	"reflect"
+	"sync"
+
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/informer"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// Eligibility tells whether any node a pod may be scheduled onto advertises
+// a resource. Answers are cached by the pod's node constraints, and the cache
+// is dropped whenever node labels or advertised resources change.
+type Eligibility struct {
+	nodes    *informer.Informer
+	resource corev1.ResourceName
+
+	mu    sync.Mutex
+	cache map[string]bool
+	// generation is increased on invalidation, so that answers computed from
+	// outdated nodes are not cached.
+	generation int64
+}
+
+// NewEligibility returns Eligibility of resource on nodes, see informer.NewNodeInformer.
+func NewEligibility(nodes *informer.Informer, resource corev1.ResourceName) *Eligibility {
+	e := &Eligibility{
+		nodes:    nodes,
+		resource: resource,
+		cache:    make(map[string]bool),
+	}
+	nodes.AddEventHandler(informer.EventHandler{
+		OnAdd: func(obj runtime.Object) { e.invalidate() },
+		OnUpdate: func(oldObj, newObj runtime.Object) {
+			oldNode, ok1 := oldObj.(*corev1.Node)
+			newNode, ok2 := newObj.(*corev1.Node)
+			if ok1 && ok2 && reflect.DeepEqual(oldNode.Labels, newNode.Labels) &&
+				e.advertises(oldNode) == e.advertises(newNode) {
+				return
+			}
+			e.invalidate()
+		},
+		OnDelete: func(obj runtime.Object) { e.invalidate() },
+	})
+	return e
+}
+
+// constraints are what decide the nodes a pod may be scheduled onto.
+type constraints struct {
+	NodeName     string               `json:"nodeName,omitempty"`
+	NodeSelector map[string]string    `json:"nodeSelector,omitempty"`
+	NodeAffinity *corev1.NodeSelector `json:"nodeAffinity,omitempty"`
+}
+
+func cacheKey(pod *corev1.Pod) string {
+	c := constraints{
+		NodeName:     pod.Spec.NodeName,
+		NodeSelector: pod.Spec.NodeSelector,
+	}
+	if affinity := pod.Spec.Affinity; affinity != nil && affinity.NodeAffinity != nil {
+		c.NodeAffinity = affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+	}
+	key, _ := json.Marshal(c)
+	return string(key)
+}
+
+func (e *Eligibility) invalidate() {
+	e.mu.Lock()
+	e.generation++
+	if len(e.cache) > 0 {
+		e.cache = make(map[string]bool)
+	}
+	e.mu.Unlock()
+}
+
+// advertises returns whether the device plugin of resource is registered on node.
+func (e *Eligibility) advertises(node *corev1.Node) bool {
+	_, ok := node.Status.Capacity[e.resource]
+	return ok
+}
+
+// HasEligibleNode returns whether any node matching pod advertises the
+// resource. known is false before nodes are synced.
+func (e *Eligibility) HasEligibleNode(pod *corev1.Pod) (eligible bool, known bool) {
+	if !e.nodes.HasSynced() {
+		return false, false
+	}
+	key := cacheKey(pod)
+	e.mu.Lock()
+	eligible, ok := e.cache[key]
+	generation := e.generation
+	e.mu.Unlock()
+	if ok {
+		return eligible, true
+	}
+
+	for _, obj := range e.nodes.List() {
+		node, ok := obj.(*corev1.Node)
+		if ok && e.advertises(node) && MatchesPod(pod, node) {
+			eligible = true
+			break
+		}
+	}
+	glog.V(4).Infof("Node constraints %s eligible for %s: %t", key, e.resource, eligible)
+
+	e.mu.Lock()
+	if e.generation == generation {
+		e.cache[key] = eligible
+	}
+	e.mu.Unlock()
+	return eligible, true
+}
+
+// Degraded reports node eligibility is not checked before nodes are synced.
+func (e *Eligibility) Degraded() string {
+	if e.nodes.HasSynced() {
+		return ""
+	}
+	return "node cache is not synced, node eligibility is not checked"
+}
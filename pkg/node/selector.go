@@ -0,0 +1,91 @@
+package node
+
+import (
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// MatchesPod returns whether pod can be scheduled onto node according to
+// its nodeName, nodeSelector and required node affinity.
+func MatchesPod(pod *corev1.Pod, node *corev1.Node) bool {
+	if pod.Spec.NodeName != "" && pod.Spec.NodeName != node.Name {
+		return false
+	}
+	for k, v := range pod.Spec.NodeSelector {
+		if value, ok := node.Labels[k]; !ok || value != v {
+			return false
+		}
+	}
+	affinity := pod.Spec.Affinity
+	if affinity == nil || affinity.NodeAffinity == nil || affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		return true
+	}
+	return matchesNodeSelectorTerms(affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms, node)
+}
+
+// matchesNodeSelectorTerms returns whether node matches any of terms.
+func matchesNodeSelectorTerms(terms []corev1.NodeSelectorTerm, node *corev1.Node) bool {
+	for _, term := range terms {
+		if len(term.MatchExpressions) == 0 && len(term.MatchFields) == 0 {
+			continue
+		}
+		if matchesRequirements(term.MatchExpressions, node.Labels) &&
+			matchesRequirements(term.MatchFields, map[string]string{"metadata.name": node.Name}) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesRequirements(requirements []corev1.NodeSelectorRequirement, values map[string]string) bool {
+	for _, req := range requirements {
+		value, exists := values[req.Key]
+		switch req.Operator {
+		case corev1.NodeSelectorOpIn:
+			if !exists || !contains(req.Values, value) {
+				return false
+			}
+		case corev1.NodeSelectorOpNotIn:
+			if exists && contains(req.Values, value) {
+				return false
+			}
+		case corev1.NodeSelectorOpExists:
+			if !exists {
+				return false
+			}
+		case corev1.NodeSelectorOpDoesNotExist:
+			if exists {
+				return false
+			}
+		case corev1.NodeSelectorOpGt, corev1.NodeSelectorOpLt:
+			if !exists || len(req.Values) != 1 {
+				return false
+			}
+			actual, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return false
+			}
+			expected, err := strconv.ParseInt(req.Values[0], 10, 64)
+			if err != nil {
+				return false
+			}
+			if req.Operator == corev1.NodeSelectorOpGt && actual <= expected ||
+				req.Operator == corev1.NodeSelectorOpLt && actual >= expected {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
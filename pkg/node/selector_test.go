@@ -0,0 +1,66 @@
+package node
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func requiredAffinity(terms ...corev1.NodeSelectorTerm) *corev1.Affinity {
+	return &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+		RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: terms},
+	}}
+}
+
+func expression(key string, op corev1.NodeSelectorOperator, values ...string) corev1.NodeSelectorTerm {
+	return corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{{Key: key, Operator: op, Values: values}}}
+}
+
+func TestMatchesPod(t *testing.T) {
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{
+		Name:   "node-1",
+		Labels: map[string]string{"pool": "eni", "zone": "gz-3", "cpu": "8"},
+	}}
+	tests := []struct {
+		name    string
+		spec    corev1.PodSpec
+		matches bool
+	}{
+		{"no constraint", corev1.PodSpec{}, true},
+		{"nodeName", corev1.PodSpec{NodeName: "node-1"}, true},
+		{"other nodeName", corev1.PodSpec{NodeName: "node-2"}, false},
+		{"nodeSelector", corev1.PodSpec{NodeSelector: map[string]string{"pool": "eni"}}, true},
+		{"nodeSelector other value", corev1.PodSpec{NodeSelector: map[string]string{"pool": "bridge"}}, false},
+		{"nodeSelector missing label", corev1.PodSpec{NodeSelector: map[string]string{"gpu": "true"}}, false},
+		{"affinity in", corev1.PodSpec{Affinity: requiredAffinity(expression("zone", corev1.NodeSelectorOpIn, "gz-3", "gz-4"))}, true},
+		{"affinity not in", corev1.PodSpec{Affinity: requiredAffinity(expression("zone", corev1.NodeSelectorOpNotIn, "gz-3"))}, false},
+		{"affinity exists", corev1.PodSpec{Affinity: requiredAffinity(expression("pool", corev1.NodeSelectorOpExists))}, true},
+		{"affinity does not exist", corev1.PodSpec{Affinity: requiredAffinity(expression("pool", corev1.NodeSelectorOpDoesNotExist))}, false},
+		{"affinity gt", corev1.PodSpec{Affinity: requiredAffinity(expression("cpu", corev1.NodeSelectorOpGt, "4"))}, true},
+		{"affinity lt", corev1.PodSpec{Affinity: requiredAffinity(expression("cpu", corev1.NodeSelectorOpLt, "4"))}, false},
+		{"affinity gt not a number", corev1.PodSpec{Affinity: requiredAffinity(expression("zone", corev1.NodeSelectorOpGt, "4"))}, false},
+		{
+			"affinity terms are ored",
+			corev1.PodSpec{Affinity: requiredAffinity(expression("zone", corev1.NodeSelectorOpIn, "gz-4"), expression("pool", corev1.NodeSelectorOpIn, "eni"))},
+			true,
+		},
+		{"affinity empty term matches nothing", corev1.PodSpec{Affinity: requiredAffinity(corev1.NodeSelectorTerm{})}, false},
+		{
+			"affinity match fields",
+			corev1.PodSpec{Affinity: requiredAffinity(corev1.NodeSelectorTerm{MatchFields: []corev1.NodeSelectorRequirement{{Key: "metadata.name", Operator: corev1.NodeSelectorOpIn, Values: []string{"node-1"}}}})},
+			true,
+		},
+		{
+			"nodeSelector and affinity are anded",
+			corev1.PodSpec{NodeSelector: map[string]string{"pool": "eni"}, Affinity: requiredAffinity(expression("zone", corev1.NodeSelectorOpIn, "gz-4"))},
+			false,
+		},
+	}
+	for _, test := range tests {
+		pod := &corev1.Pod{Spec: test.spec}
+		if matches := MatchesPod(pod, node); matches != test.matches {
+			t.Errorf("%s: expect %t, got %t", test.name, test.matches, matches)
+		}
+	}
+}
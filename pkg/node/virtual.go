@@ -0,0 +1,164 @@
+package node
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/informer"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// VirtualNodeAnnotation marks a pod bound for virtual nodes explicitly.
+const VirtualNodeAnnotation = "tke.cloud.tencent.com/virtual-node"
+
+// VirtualNodeRules detect pods bound for virtual nodes, like virtual kubelet
+// and TKE serverless (eklet) nodes, which never advertise eni-ip.
+type VirtualNodeRules struct {
+	// NodeSelectors are labels of virtual nodes, an empty value matches any value.
+	NodeSelectors map[string]string
+	// Tolerations are taint keys of virtual nodes, tolerating them does not
+	// bind pods to virtual nodes, see MayRunOnVirtualNode.
+	Tolerations []string
+	// Annotations are pod annotations marking pods bound for virtual nodes,
+	// an empty value matches any value.
+	Annotations map[string]string
+	// Nodes is optional, pods with nodeName are matched by the labels of
+	// their node with it.
+	Nodes *informer.Informer
+}
+
+// ParseVirtualNodeRules parses comma separated key=value or key lists.
+func ParseVirtualNodeRules(nodeSelectors, tolerations, annotations string) (*VirtualNodeRules, error) {
+	r := &VirtualNodeRules{
+		Annotations: map[string]string{VirtualNodeAnnotation: "true"},
+	}
+	var err error
+	if r.NodeSelectors, err = parseKeyValues(nodeSelectors); err != nil {
+		return nil, fmt.Errorf("invalid virtual node selectors: %v", err)
+	}
+	extra, err := parseKeyValues(annotations)
+	if err != nil {
+		return nil, fmt.Errorf("invalid virtual node annotations: %v", err)
+	}
+	for k, v := range extra {
+		r.Annotations[k] = v
+	}
+	for _, key := range strings.Split(tolerations, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			r.Tolerations = append(r.Tolerations, key)
+		}
+	}
+	return r, nil
+}
+
+func parseKeyValues(s string) (map[string]string, error) {
+	kvs := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		if key == "" {
+			return nil, fmt.Errorf("empty key in %q", kv)
+		}
+		if len(parts) == 2 {
+			kvs[key] = strings.TrimSpace(parts[1])
+		} else {
+			kvs[key] = ""
+		}
+	}
+	return kvs, nil
+}
+
+func matchesKeyValue(rules map[string]string, key, value string) bool {
+	expected, ok := rules[key]
+	return ok && (expected == "" || expected == value)
+}
+
+// VirtualNode returns why pod is bound for virtual nodes, if it is.
+func (r *VirtualNodeRules) VirtualNode(pod *corev1.Pod) (string, bool) {
+	for k, v := range pod.Annotations {
+		if matchesKeyValue(r.Annotations, k, v) {
+			return fmt.Sprintf("pod annotation %s=%s", k, v), true
+		}
+	}
+	if pod.Spec.NodeName != "" && r.Nodes != nil {
+		if obj, ok := r.Nodes.Get(pod.Spec.NodeName); ok {
+			if n, ok := obj.(*corev1.Node); ok {
+				for k, v := range n.Labels {
+					if matchesKeyValue(r.NodeSelectors, k, v) {
+						return fmt.Sprintf("nodeName %s labeled %s=%s", n.Name, k, v), true
+					}
+				}
+			}
+		}
+	}
+	for k, v := range pod.Spec.NodeSelector {
+		if matchesKeyValue(r.NodeSelectors, k, v) {
+			return fmt.Sprintf("nodeSelector %s=%s", k, v), true
+		}
+	}
+	return r.virtualNodeAffinity(pod)
+}
+
+// MayRunOnVirtualNode returns why pod not bound for virtual nodes may still
+// be scheduled onto them, i.e. it tolerates their taint.
+func (r *VirtualNodeRules) MayRunOnVirtualNode(pod *corev1.Pod) (string, bool) {
+	for _, toleration := range pod.Spec.Tolerations {
+		for _, key := range r.Tolerations {
+			// tolerations without key tolerate every taint, they are not
+			// meant for virtual nodes
+			if toleration.Key == key {
+				return fmt.Sprintf("toleration of %s", key), true
+			}
+		}
+	}
+	return "", false
+}
+
+// virtualNodeAffinity returns whether every required node affinity term selects
+// virtual node labels.
+func (r *VirtualNodeRules) virtualNodeAffinity(pod *corev1.Pod) (string, bool) {
+	affinity := pod.Spec.Affinity
+	if len(r.NodeSelectors) == 0 || affinity == nil || affinity.NodeAffinity == nil ||
+		affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		return "", false
+	}
+	terms := affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+	if len(terms) == 0 {
+		return "", false
+	}
+	var reason string
+	for _, term := range terms {
+		matched := false
+		for _, req := range term.MatchExpressions {
+			if req.Operator != corev1.NodeSelectorOpIn && req.Operator != corev1.NodeSelectorOpExists {
+				continue
+			}
+			if req.Operator == corev1.NodeSelectorOpExists && matchesKeyValue(r.NodeSelectors, req.Key, "") {
+				reason, matched = fmt.Sprintf("node affinity %s exists", req.Key), true
+				break
+			}
+			if req.Operator == corev1.NodeSelectorOpIn && len(req.Values) > 0 && r.allVirtual(req.Key, req.Values) {
+				reason, matched = fmt.Sprintf("node affinity %s in %s", req.Key, strings.Join(req.Values, ",")), true
+				break
+			}
+		}
+		if !matched {
+			return "", false
+		}
+	}
+	return reason, true
+}
+
+func (r *VirtualNodeRules) allVirtual(key string, values []string) bool {
+	for _, value := range values {
+		if !matchesKeyValue(r.NodeSelectors, key, value) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,128 @@
+package node
+
+import (
+	"testing"
+
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/informer"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// runNodes returns a synced informer of nodes, which is stopped by closing stopCh.
+func runNodes(t *testing.T, stopCh <-chan struct{}, nodes ...corev1.Node) *informer.Informer {
+	list := func(metav1.ListOptions) (runtime.Object, error) {
+		return &corev1.NodeList{Items: nodes}, nil
+	}
+	w := func(metav1.ListOptions) (watch.Interface, error) {
+		return watch.NewFake(), nil
+	}
+	i := informer.New("nodes", list, w)
+	go i.Run(stopCh)
+	if !i.WaitForSync(stopCh) {
+		t.Fatal("nodes are not synced")
+	}
+	return i
+}
+
+func TestVirtualNode(t *testing.T) {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	r, err := ParseVirtualNodeRules("type=virtual-kubelet,eklet", "virtual-kubelet.io/provider", "eks.tke.cloud.tencent.com/ds-injection")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Nodes = runNodes(t, stopCh,
+		corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "eklet-1", Labels: map[string]string{"eklet": "true"}}},
+		corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1", Labels: map[string]string{"type": "cvm"}}},
+	)
+	tolerations := []corev1.Toleration{{Key: "virtual-kubelet.io/provider", Operator: corev1.TolerationOpExists}}
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		spec        corev1.PodSpec
+		virtual     bool
+		mayRun      bool
+	}{
+		{name: "plain pod"},
+		{name: "virtual node annotation", annotations: map[string]string{VirtualNodeAnnotation: "true"}, virtual: true},
+		{name: "virtual node annotation false", annotations: map[string]string{VirtualNodeAnnotation: "false"}},
+		{name: "extra annotation any value", annotations: map[string]string{"eks.tke.cloud.tencent.com/ds-injection": "x"}, virtual: true},
+		{name: "nodeSelector", spec: corev1.PodSpec{NodeSelector: map[string]string{"type": "virtual-kubelet"}}, virtual: true},
+		{name: "nodeSelector other value", spec: corev1.PodSpec{NodeSelector: map[string]string{"type": "cvm"}}},
+		{name: "nodeSelector key any value", spec: corev1.PodSpec{NodeSelector: map[string]string{"eklet": "true"}}, virtual: true},
+		{name: "nodeName of virtual node", spec: corev1.PodSpec{NodeName: "eklet-1"}, virtual: true},
+		{name: "nodeName of other node", spec: corev1.PodSpec{NodeName: "node-1"}},
+		{name: "nodeName of unknown node", spec: corev1.PodSpec{NodeName: "node-2"}},
+		{
+			name:    "affinity in virtual values",
+			spec:    corev1.PodSpec{Affinity: requiredAffinity(expression("type", corev1.NodeSelectorOpIn, "virtual-kubelet"))},
+			virtual: true,
+		},
+		{
+			name: "affinity in mixed values",
+			spec: corev1.PodSpec{Affinity: requiredAffinity(expression("type", corev1.NodeSelectorOpIn, "virtual-kubelet", "cvm"))},
+		},
+		{
+			name:    "affinity exists",
+			spec:    corev1.PodSpec{Affinity: requiredAffinity(expression("eklet", corev1.NodeSelectorOpExists))},
+			virtual: true,
+		},
+		{
+			name: "affinity exists of key with value",
+			spec: corev1.PodSpec{Affinity: requiredAffinity(expression("type", corev1.NodeSelectorOpExists))},
+		},
+		{
+			name: "affinity with a term of other nodes",
+			spec: corev1.PodSpec{Affinity: requiredAffinity(
+				expression("type", corev1.NodeSelectorOpIn, "virtual-kubelet"),
+				expression("zone", corev1.NodeSelectorOpIn, "gz-3"),
+			)},
+		},
+		{name: "toleration only", spec: corev1.PodSpec{Tolerations: tolerations}, mayRun: true},
+		{
+			name:   "toleration without key",
+			spec:   corev1.PodSpec{Tolerations: []corev1.Toleration{{Operator: corev1.TolerationOpExists}}},
+			mayRun: false,
+		},
+		{
+			name:    "toleration and nodeSelector",
+			spec:    corev1.PodSpec{NodeSelector: map[string]string{"type": "virtual-kubelet"}, Tolerations: tolerations},
+			virtual: true,
+			mayRun:  true,
+		},
+	}
+	for _, test := range tests {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: test.annotations}, Spec: test.spec}
+		if reason, virtual := r.VirtualNode(pod); virtual != test.virtual {
+			t.Errorf("%s: expect virtual %t, got %t %q", test.name, test.virtual, virtual, reason)
+		}
+		if reason, mayRun := r.MayRunOnVirtualNode(pod); mayRun != test.mayRun {
+			t.Errorf("%s: expect may run %t, got %t %q", test.name, test.mayRun, mayRun, reason)
+		}
+	}
+}
+
+func TestParseVirtualNodeRules(t *testing.T) {
+	if _, err := ParseVirtualNodeRules("=virtual-kubelet", "", ""); err == nil {
+		t.Error("expect error of empty node selector key")
+	}
+	if _, err := ParseVirtualNodeRules("", "", "=x"); err == nil {
+		t.Error("expect error of empty annotation key")
+	}
+	r, err := ParseVirtualNodeRules(" type = virtual-kubelet , eklet ", " a , ,b ", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.NodeSelectors) != 2 || r.NodeSelectors["type"] != "virtual-kubelet" || r.NodeSelectors["eklet"] != "" {
+		t.Errorf("unexpected node selectors %v", r.NodeSelectors)
+	}
+	if len(r.Tolerations) != 2 || r.Tolerations[0] != "a" || r.Tolerations[1] != "b" {
+		t.Errorf("unexpected tolerations %v", r.Tolerations)
+	}
+	if r.Annotations[VirtualNodeAnnotation] != "true" {
+		t.Errorf("expect annotation %s=true, got %v", VirtualNodeAnnotation, r.Annotations)
+	}
+}
@@ -0,0 +1,88 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+)
+
+// client reads and writes EniIPPolicy through the REST client of the core
+// group with absolute paths, no generated client is vendored.
+type client struct {
+	rest rest.Interface
+}
+
+func newClient(cs kubernetes.Interface) *client {
+	return &client{rest: cs.CoreV1().RESTClient()}
+}
+
+func (c *client) path(segments ...string) []string {
+	return append([]string{"/apis", SchemeGroupVersion.Group, SchemeGroupVersion.Version, Resource}, segments...)
+}
+
+func (c *client) list(options metav1.ListOptions) (runtime.Object, error) {
+	data, err := c.rest.Get().AbsPath(c.path()...).VersionedParams(&options, scheme.ParameterCodec).DoRaw()
+	if err != nil {
+		return nil, err
+	}
+	list := &EniIPPolicyList{}
+	if err := json.Unmarshal(data, list); err != nil {
+		return nil, fmt.Errorf("invalid %s list: %v", Resource, err)
+	}
+	return list, nil
+}
+
+func (c *client) watch(options metav1.ListOptions) (watch.Interface, error) {
+	options.Watch = true
+	stream, err := c.rest.Get().AbsPath(c.path()...).VersionedParams(&options, scheme.ParameterCodec).Stream()
+	if err != nil {
+		return nil, err
+	}
+	return watch.NewStreamWatcher(&decoder{decoder: json.NewDecoder(stream), stream: stream}), nil
+}
+
+// updateStatus replaces the status of p, it fails with a conflict if p is
+// not the latest.
+func (c *client) updateStatus(p *EniIPPolicy) error {
+	p.APIVersion, p.Kind = SchemeGroupVersion.String(), "EniIPPolicy"
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return c.rest.Put().AbsPath(c.path(p.Name, "status")...).SetHeader("Content-Type", "application/json").Body(data).Do().Error()
+}
+
+// decoder decodes watch events of EniIPPolicy.
+type decoder struct {
+	decoder *json.Decoder
+	stream  io.ReadCloser
+}
+
+func (d *decoder) Decode() (watch.EventType, runtime.Object, error) {
+	var event struct {
+		Type   watch.EventType `json:"type"`
+		Object json.RawMessage `json:"object"`
+	}
+	if err := d.decoder.Decode(&event); err != nil {
+		return "", nil, err
+	}
+	var obj runtime.Object = &EniIPPolicy{}
+	if event.Type == watch.Error {
+		obj = &metav1.Status{}
+	}
+	if err := json.Unmarshal(event.Object, obj); err != nil {
+		return "", nil, fmt.Errorf("invalid %s watch event: %v", Resource, err)
+	}
+	return event.Type, obj, nil
+}
+
+func (d *decoder) Close() {
+	d.stream.Close()
+}
@@ -0,0 +1,320 @@
+package policy
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/https"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/informer"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/metrics"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+var policyAdmissions = metrics.NewCounterVec("policy_admissions_total",
+	"Admissions decided by EniIPPolicy, by policy.", "policy")
+
+// rule is a compiled EniIPPolicy.
+type rule struct {
+	name     string
+	priority int32
+	// err is why the policy is invalid, it matches nothing then.
+	err        error
+	namespaces labels.Selector
+	pods       labels.Selector
+	networks   map[string]bool
+	match      https.PolicyMatch
+}
+
+func compile(p *EniIPPolicy) *rule {
+	r := &rule{
+		name:       p.Name,
+		priority:   p.Spec.Priority,
+		namespaces: labels.Everything(),
+		pods:       labels.Everything(),
+		networks:   make(map[string]bool),
+		match: https.PolicyMatch{
+			Name:     p.Name,
+			Action:   p.Spec.Action,
+			Resource: p.Spec.Resource,
+			Quantity: *resource.NewQuantity(1, resource.DecimalSI),
+			Message:  p.Spec.Message,
+		},
+	}
+	switch p.Spec.Action {
+	case https.PolicyInject, https.PolicySkip, https.PolicyReject:
+	default:
+		r.err = fmt.Errorf("unknown action %q, expect one of %s, %s and %s", p.Spec.Action, https.PolicyInject, https.PolicySkip, https.PolicyReject)
+		return r
+	}
+	if r.match.Resource == "" {
+		r.match.Resource = https.UnderlayIPResource
+	}
+	if p.Spec.Quantity != nil {
+		if p.Spec.Quantity.Sign() <= 0 {
+			r.err = fmt.Errorf("quantity %s is not positive", p.Spec.Quantity)
+			return r
+		}
+		r.match.Quantity = *p.Spec.Quantity
+	}
+	var err error
+	if p.Spec.NamespaceSelector != nil {
+		if r.namespaces, err = metav1.LabelSelectorAsSelector(p.Spec.NamespaceSelector); err != nil {
+			r.err = fmt.Errorf("invalid namespaceSelector: %v", err)
+			return r
+		}
+	}
+	if p.Spec.PodSelector != nil {
+		if r.pods, err = metav1.LabelSelectorAsSelector(p.Spec.PodSelector); err != nil {
+			r.err = fmt.Errorf("invalid podSelector: %v", err)
+			return r
+		}
+	}
+	for _, network := range p.Spec.Networks {
+		r.networks[network] = true
+	}
+	return r
+}
+
+// selectsNetworks returns whether r selects pods using networks.
+func (r *rule) selectsNetworks(networks []string) bool {
+	if len(r.networks) == 0 {
+		return len(networks) != 1 || networks[0] != https.PolicyHostNetwork
+	}
+	for _, network := range networks {
+		if r.networks[network] {
+			return true
+		}
+	}
+	return false
+}
+
+// Store matches pods against EniIPPolicies kept by an informer, and records
+// how many admissions each policy decides in its status.
+type Store struct {
+	client     *client
+	policies   *informer.Informer
+	namespaces *informer.Informer
+
+	mu    sync.RWMutex
+	rules []*rule
+	// matched counts admissions by policy since the last status update.
+	matched map[string]int64
+}
+
+// NewStore returns a store of all EniIPPolicies, namespaces label pods for
+// namespaceSelectors. The informer of policies is started by Run.
+func NewStore(cs kubernetes.Interface, namespaces *informer.Informer) *Store {
+	c := newClient(cs)
+	s := &Store{
+		client:     c,
+		policies:   informer.New(Resource, c.list, c.watch),
+		namespaces: namespaces,
+		matched:    make(map[string]int64),
+	}
+	recompile := func(runtime.Object) { s.recompile() }
+	s.policies.AddEventHandler(informer.EventHandler{
+		OnAdd:    recompile,
+		OnUpdate: func(_, obj runtime.Object) { s.recompile() },
+		OnDelete: recompile,
+	})
+	return s
+}
+
+func (s *Store) recompile() {
+	var rules []*rule
+	for _, obj := range s.policies.List() {
+		if p, ok := obj.(*EniIPPolicy); ok {
+			r := compile(p)
+			if r.err != nil {
+				glog.Warningf("EniIPPolicy %s is invalid and ignored: %v", p.Name, r.err)
+			}
+			rules = append(rules, r)
+		}
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		if rules[i].priority != rules[j].priority {
+			return rules[i].priority > rules[j].priority
+		}
+		return rules[i].name < rules[j].name
+	})
+	s.mu.Lock()
+	s.rules = rules
+	s.mu.Unlock()
+}
+
+// Match returns the valid policy of the highest priority selecting pod.
+// Nothing matches while policies are not listed, or once a namespaceSelector
+// meets a namespace not in the cache, since the policy deciding pod is
+// unknown then.
+func (s *Store) Match(namespace string, pod *corev1.Pod, networks []string) (*https.PolicyMatch, string) {
+	if !s.policies.HasSynced() {
+		return nil, fmt.Sprintf("%s are not listed yet", Resource)
+	}
+	s.mu.RLock()
+	rules := s.rules
+	s.mu.RUnlock()
+
+	var namespaceLabels labels.Set
+	for _, r := range rules {
+		if r.err != nil || !r.selectsNetworks(networks) || !r.pods.Matches(labels.Set(pod.Labels)) {
+			continue
+		}
+		if !r.namespaces.Empty() {
+			if namespaceLabels == nil {
+				obj, ok := s.namespaces.Get(namespace)
+				if !ok {
+					return nil, fmt.Sprintf("labels of namespace %s are unknown to namespaceSelector of %s %s", namespace, Resource, r.name)
+				}
+				namespaceLabels = labels.Set(obj.(*corev1.Namespace).Labels)
+			}
+			if !r.namespaces.Matches(namespaceLabels) {
+				continue
+			}
+		}
+		match := r.match
+		return &match, ""
+	}
+	return nil, ""
+}
+
+// Snapshot is a compiled policy as matched by the store.
+type Snapshot struct {
+	Name     string              `json:"name"`
+	Priority int32               `json:"priority"`
+	Action   string              `json:"action"`
+	Resource corev1.ResourceName `json:"resource,omitempty"`
+	Quantity string              `json:"quantity,omitempty"`
+	// Error is why the policy is invalid and matches nothing.
+	Error string `json:"error,omitempty"`
+}
+
+// Snapshot returns the policies in the order they are matched.
+func (s *Store) Snapshot() []Snapshot {
+	s.mu.RLock()
+	rules := s.rules
+	s.mu.RUnlock()
+	snapshots := make([]Snapshot, 0, len(rules))
+	for _, r := range rules {
+		snapshot := Snapshot{Name: r.name, Priority: r.priority, Action: r.match.Action}
+		if r.err != nil {
+			snapshot.Error = r.err.Error()
+		} else if r.match.Action == https.PolicyInject {
+			snapshot.Resource, snapshot.Quantity = r.match.Resource, r.match.Quantity.String()
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots
+}
+
+// Matched records an admission decided by the policy called name.
+func (s *Store) Matched(name string) {
+	policyAdmissions.Inc(name)
+	s.mu.Lock()
+	s.matched[name]++
+	s.mu.Unlock()
+}
+
+// Degraded reports policies are unknown until listed, pods are decided by
+// their networks meanwhile.
+func (s *Store) Degraded() string {
+	if s.policies.HasSynced() {
+		return ""
+	}
+	return fmt.Sprintf("%s are not listed yet, pods are decided by their networks", Resource)
+}
+
+// Informer returns the informer of policies, it is started by Run.
+func (s *Store) Informer() *informer.Informer {
+	return s.policies
+}
+
+// Run runs the informer of policies until stopCh is closed.
+func (s *Store) Run(stopCh <-chan struct{}) {
+	s.policies.Run(stopCh)
+}
+
+// RunStatus updates status of policies every period until stopCh is closed.
+func (s *Store) RunStatus(period time.Duration, stopCh <-chan struct{}) {
+	if !s.policies.WaitForSync(stopCh) {
+		return
+	}
+	wait.Until(s.updateStatus, period, stopCh)
+}
+
+func (s *Store) updateStatus() {
+	s.mu.Lock()
+	matched := s.matched
+	s.matched = make(map[string]int64)
+	rules := make(map[string]*rule, len(s.rules))
+	for _, r := range s.rules {
+		rules[r.name] = r
+	}
+	s.mu.Unlock()
+
+	for _, obj := range s.policies.List() {
+		p := obj.DeepCopyObject().(*EniIPPolicy)
+		r, ok := rules[p.Name]
+		if !ok {
+			// not compiled yet, counts are added on the next period
+			s.mu.Lock()
+			s.matched[p.Name] += matched[p.Name]
+			s.mu.Unlock()
+			continue
+		}
+		status := p.Status
+		status.Conditions = append([]EniIPPolicyCondition(nil), status.Conditions...)
+		status.ObservedGeneration = p.Generation
+		status.MatchedAdmissions += matched[p.Name]
+		if r.err != nil {
+			setCondition(&status, ConditionValid, corev1.ConditionFalse, "Invalid", r.err.Error())
+		} else {
+			setCondition(&status, ConditionValid, corev1.ConditionTrue, "Valid", "")
+		}
+		if status.MatchedAdmissions > 0 {
+			setCondition(&status, ConditionMatched, corev1.ConditionTrue, "Matched", fmt.Sprintf("decided %d admissions", status.MatchedAdmissions))
+		} else {
+			setCondition(&status, ConditionMatched, corev1.ConditionFalse, "NotMatched", "decided no admission yet")
+		}
+		if reflect.DeepEqual(status, p.Status) {
+			continue
+		}
+		p.Status = status
+		if err := s.client.updateStatus(p); err != nil {
+			// counts are added again on the next period
+			glog.Warningf("Failed to update status of EniIPPolicy %s, will retry: %v", p.Name, err)
+			s.mu.Lock()
+			s.matched[p.Name] += matched[p.Name]
+			s.mu.Unlock()
+		}
+	}
+}
+
+// setCondition sets the condition of type t, its transition time is kept if
+// the status does not change.
+func setCondition(status *EniIPPolicyStatus, t string, conditionStatus corev1.ConditionStatus, reason, message string) {
+	condition := EniIPPolicyCondition{Type: t, Status: conditionStatus, Reason: reason, Message: message}
+	for i := range status.Conditions {
+		if status.Conditions[i].Type != t {
+			continue
+		}
+		condition.LastTransitionTime = status.Conditions[i].LastTransitionTime
+		if status.Conditions[i].Status != conditionStatus {
+			condition.LastTransitionTime = metav1.Now()
+		}
+		status.Conditions[i] = condition
+		return
+	}
+	condition.LastTransitionTime = metav1.Now()
+	status.Conditions = append(status.Conditions, condition)
+}
@@ -0,0 +1,143 @@
+package policy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/https"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/informer"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// runInformer returns a synced informer listing list, which is stopped by
+// closing stopCh.
+func runInformer(t *testing.T, stopCh <-chan struct{}, name string, list runtime.Object) *informer.Informer {
+	i := informer.New(name,
+		func(metav1.ListOptions) (runtime.Object, error) { return list, nil },
+		func(metav1.ListOptions) (watch.Interface, error) { return watch.NewFake(), nil })
+	go i.Run(stopCh)
+	if !i.WaitForSync(stopCh) {
+		t.Fatalf("%s are not synced", name)
+	}
+	return i
+}
+
+func newPolicy(name string, priority int32, action string) EniIPPolicy {
+	return EniIPPolicy{ObjectMeta: metav1.ObjectMeta{Name: name}, Spec: EniIPPolicySpec{Priority: priority, Action: action}}
+}
+
+func TestCompile(t *testing.T) {
+	two := resource.MustParse("2")
+	zero := resource.MustParse("0")
+	tests := []struct {
+		name      string
+		spec      EniIPPolicySpec
+		resource  corev1.ResourceName
+		quantity  string
+		expectErr bool
+	}{
+		{name: "defaults", spec: EniIPPolicySpec{Action: https.PolicyInject}, resource: https.UnderlayIPResource, quantity: "1"},
+		{name: "resource and quantity", spec: EniIPPolicySpec{Action: https.PolicyInject, Resource: "example.com/ip", Quantity: &two}, resource: "example.com/ip", quantity: "2"},
+		{name: "unknown action", spec: EniIPPolicySpec{Action: "Drop"}, expectErr: true},
+		{name: "zero quantity", spec: EniIPPolicySpec{Action: https.PolicyInject, Quantity: &zero}, expectErr: true},
+		{
+			name: "invalid namespaceSelector",
+			spec: EniIPPolicySpec{Action: https.PolicySkip, NamespaceSelector: &metav1.LabelSelector{
+				MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "env", Operator: "Like"}},
+			}},
+			expectErr: true,
+		},
+		{
+			name:      "invalid podSelector",
+			spec:      EniIPPolicySpec{Action: https.PolicySkip, PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "a b"}}},
+			expectErr: true,
+		},
+	}
+	for _, test := range tests {
+		r := compile(&EniIPPolicy{ObjectMeta: metav1.ObjectMeta{Name: test.name}, Spec: test.spec})
+		if (r.err != nil) != test.expectErr {
+			t.Errorf("%s: expect error %t, got %v", test.name, test.expectErr, r.err)
+			continue
+		}
+		if test.expectErr {
+			continue
+		}
+		if r.match.Resource != test.resource || r.match.Quantity.String() != test.quantity {
+			t.Errorf("%s: expect %s %s, got %s %s", test.name, test.quantity, test.resource, r.match.Quantity.String(), r.match.Resource)
+		}
+	}
+}
+
+func TestStoreMatch(t *testing.T) {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	low := newPolicy("low", 0, https.PolicyInject)
+	high := newPolicy("high", 10, https.PolicySkip)
+	high.Spec.PodSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": "skipped"}}
+	// b is matched after a of the same priority
+	b := newPolicy("b", 5, https.PolicyReject)
+	b.Spec.Networks = []string{"tke-bridge"}
+	a := newPolicy("a", 5, https.PolicyInject)
+	a.Spec.Networks = []string{"tke-bridge"}
+	a.Spec.NamespaceSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"eni": "true"}}
+	invalid := newPolicy("invalid", 100, "Drop")
+	hostNetwork := newPolicy("host-network", 1, https.PolicyReject)
+	hostNetwork.Spec.Networks = []string{https.PolicyHostNetwork}
+
+	s := &Store{
+		policies: runInformer(t, stopCh, Resource, &EniIPPolicyList{Items: []EniIPPolicy{low, high, b, a, invalid, hostNetwork}}),
+		namespaces: runInformer(t, stopCh, "namespaces", &corev1.NamespaceList{Items: []corev1.Namespace{
+			{ObjectMeta: metav1.ObjectMeta{Name: "eni", Labels: map[string]string{"eni": "true"}}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+		}}),
+		matched: make(map[string]int64),
+	}
+	s.recompile()
+
+	var order []string
+	for _, snapshot := range s.Snapshot() {
+		order = append(order, snapshot.Name)
+	}
+	if expect := "invalid high a b host-network low"; strings.Join(order, " ") != expect {
+		t.Errorf("expect policies in order %s, got %s", expect, strings.Join(order, " "))
+	}
+
+	tests := []struct {
+		name      string
+		namespace string
+		labels    map[string]string
+		networks  []string
+		policy    string
+		unsure    bool
+	}{
+		{name: "highest priority", namespace: "default", labels: map[string]string{"app": "skipped"}, networks: []string{"tke-bridge"}, policy: "high"},
+		{name: "namespaceSelector", namespace: "eni", networks: []string{"tke-bridge"}, policy: "a"},
+		{name: "namespaceSelector not matching", namespace: "default", networks: []string{"tke-bridge"}, policy: "b"},
+		{name: "unknown namespace", namespace: "new", networks: []string{"tke-bridge"}, unsure: true},
+		{name: "unknown namespace not selected", namespace: "new", networks: []string{"tke-route-eni"}, policy: "low"},
+		{name: "hostNetwork", namespace: "default", networks: []string{https.PolicyHostNetwork}, policy: "host-network"},
+		{name: "any network", namespace: "default", networks: []string{"tke-route-eni"}, policy: "low"},
+	}
+	for _, test := range tests {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: test.namespace, Labels: test.labels}}
+		m, unsure := s.Match(test.namespace, pod, test.networks)
+		name := ""
+		if m != nil {
+			name = m.Name
+		}
+		if name != test.policy || (unsure != "") != test.unsure {
+			t.Errorf("%s: expect policy %q unsure %t, got %q %q", test.name, test.policy, test.unsure, name, unsure)
+		}
+	}
+
+	unsynced := &Store{policies: informer.New(Resource, nil, nil)}
+	if m, unsure := unsynced.Match("default", &corev1.Pod{}, []string{"tke-route-eni"}); m != nil || unsure == "" {
+		t.Errorf("expect no policy and unsure before policies are listed, got %+v %q", m, unsure)
+	}
+}
@@ -0,0 +1,110 @@
+package policy
+
+import (
+	"encoding/json"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// SchemeGroupVersion of EniIPPolicy, see deploy/eniippolicy-crd.yaml.
+var SchemeGroupVersion = schema.GroupVersion{Group: "tke.cloud.tencent.com", Version: "v1alpha1"}
+
+// Resource is the plural name of EniIPPolicy.
+const Resource = "eniippolicies"
+
+// Condition types of EniIPPolicy.
+const (
+	// ConditionValid is false if selectors or action of the policy are invalid,
+	// such a policy matches nothing.
+	ConditionValid = "Valid"
+	// ConditionMatched is true once the policy decides any admission.
+	ConditionMatched = "Matched"
+)
+
+// EniIPPolicy decides whether pods it selects request eni-ip, overriding
+// the networks of pods.
+type EniIPPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   EniIPPolicySpec   `json:"spec"`
+	Status EniIPPolicyStatus `json:"status,omitempty"`
+}
+
+// EniIPPolicySpec selects pods and tells what to do with them.
+type EniIPPolicySpec struct {
+	// Priority orders policies, the matching policy of the highest priority
+	// decides, policies of the same priority are ordered by name.
+	Priority int32 `json:"priority,omitempty"`
+	// NamespaceSelector selects namespaces of pods, nil selects all.
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// PodSelector selects labels of pods, nil selects all.
+	PodSelector *metav1.LabelSelector `json:"podSelector,omitempty"`
+	// Networks selects pods using any of them, resolved from the networks
+	// annotation, namespace and cluster default networks. Empty selects all
+	// pods but hostNetwork ones, which are selected by hostNetwork.
+	Networks []string `json:"networks,omitempty"`
+	// Action is one of Inject, Skip and Reject.
+	Action string `json:"action"`
+	// Resource limited by the first container on Inject, defaults to
+	// tke.cloud.tencent.com/eni-ip.
+	Resource corev1.ResourceName `json:"resource,omitempty"`
+	// Quantity of Resource on Inject, defaults to 1.
+	Quantity *resource.Quantity `json:"quantity,omitempty"`
+	// Message tells clients why pods are rejected.
+	Message string `json:"message,omitempty"`
+}
+
+// EniIPPolicyStatus tells how the policy is used.
+type EniIPPolicyStatus struct {
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// MatchedAdmissions counts admissions decided by the policy, summed over
+	// webhook replicas.
+	MatchedAdmissions int64                  `json:"matchedAdmissions,omitempty"`
+	Conditions        []EniIPPolicyCondition `json:"conditions,omitempty"`
+}
+
+// EniIPPolicyCondition is a condition of EniIPPolicy.
+type EniIPPolicyCondition struct {
+	Type               string                 `json:"type"`
+	Status             corev1.ConditionStatus `json:"status"`
+	LastTransitionTime metav1.Time            `json:"lastTransitionTime,omitempty"`
+	Reason             string                 `json:"reason,omitempty"`
+	Message            string                 `json:"message,omitempty"`
+}
+
+// EniIPPolicyList is a list of EniIPPolicy.
+type EniIPPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []EniIPPolicy `json:"items"`
+}
+
+// DeepCopyObject copies p through JSON, policies are few and small.
+func (p *EniIPPolicy) DeepCopyObject() runtime.Object {
+	out := &EniIPPolicy{}
+	deepCopyJSON(p, out)
+	return out
+}
+
+// DeepCopyObject copies l through JSON.
+func (l *EniIPPolicyList) DeepCopyObject() runtime.Object {
+	out := &EniIPPolicyList{}
+	deepCopyJSON(l, out)
+	return out
+}
+
+func deepCopyJSON(in, out interface{}) {
+	data, err := json.Marshal(in)
+	if err != nil {
+		panic(err)
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		panic(err)
+	}
+}
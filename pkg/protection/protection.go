@@ -0,0 +1,133 @@
+package protection
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/metrics"
+
+	"github.com/golang/glog"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+var intercepted = metrics.NewGaugeVec("protected_namespace_intercepted",
+	"Whether the namespaceSelector of a webhook matches a protected namespace, which should be excluded.", "namespace", "configuration", "webhook")
+
+// Checker verifies protected namespaces, like the one of the webhook itself
+// and kube-system, are excluded by namespaceSelectors of the webhook
+// configurations. Intercepting its own namespace deadlocks the rollout of
+// the webhook once it is down.
+type Checker struct {
+	client         kubernetes.Interface
+	configurations []string
+
+	mu         sync.RWMutex
+	namespaces []string
+	problems   []string
+}
+
+// NewChecker returns a checker of namespaces against configurations, the
+// MutatingWebhookConfigurations of the webhook.
+func NewChecker(client kubernetes.Interface, configurations, namespaces []string) *Checker {
+	return &Checker{
+		client:         client,
+		configurations: configurations,
+		namespaces:     namespaces,
+	}
+}
+
+// Run checks every period until stopCh is closed, the first check is after
+// period, Check is called on startup instead.
+func (c *Checker) Run(period time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			c.Check()
+		}
+	}
+}
+
+// SetNamespaces changes the protected namespaces verified by the next check.
+func (c *Checker) SetNamespaces(namespaces []string) {
+	c.mu.Lock()
+	c.namespaces = namespaces
+	c.mu.Unlock()
+}
+
+// Check verifies namespaces once and logs misconfigurations.
+func (c *Checker) Check() {
+	c.mu.RLock()
+	namespaces := c.namespaces
+	c.mu.RUnlock()
+	namespaceLabels := make(map[string]labels.Set)
+	for _, namespace := range namespaces {
+		ns, err := c.client.CoreV1().Namespaces().Get(namespace, metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			glog.Warningf("Failed to get namespace %s: %v", namespace, err)
+			continue
+		}
+		namespaceLabels[namespace] = labels.Set(ns.Labels)
+	}
+
+	var problems []string
+	samples := intercepted.NewSamples()
+	for _, name := range c.configurations {
+		mwc, err := c.client.AdmissionregistrationV1beta1().MutatingWebhookConfigurations().Get(name, metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			// e.g. the optional template webhook is not deployed
+			continue
+		}
+		if err != nil {
+			glog.Warningf("Failed to get mutating webhook configuration %s: %v", name, err)
+			continue
+		}
+		for _, wh := range mwc.Webhooks {
+			selector := labels.Everything()
+			if wh.NamespaceSelector != nil {
+				if selector, err = metav1.LabelSelectorAsSelector(wh.NamespaceSelector); err != nil {
+					glog.Warningf("Invalid namespaceSelector of webhook %s in %s: %v", wh.Name, name, err)
+					continue
+				}
+			}
+			for _, namespace := range namespaces {
+				nsLabels, ok := namespaceLabels[namespace]
+				if !ok {
+					continue
+				}
+				matched := selector.Matches(nsLabels)
+				samples.Set(metrics.BoolToFloat(matched), namespace, name, wh.Name)
+				if matched {
+					problems = append(problems, fmt.Sprintf("namespaceSelector %s of webhook %s in %s matches protected namespace %s", selector, wh.Name, name, namespace))
+				}
+			}
+		}
+	}
+	metrics.Replace(samples)
+	sort.Strings(problems)
+	for _, problem := range problems {
+		glog.Errorf("%s, pods in it are admitted unchanged but still wait for the webhook, label it to exclude it", problem)
+	}
+	c.mu.Lock()
+	c.problems = problems
+	c.mu.Unlock()
+}
+
+// Degraded returns the misconfigurations found by the last check.
+func (c *Checker) Degraded() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return strings.Join(c.problems, "\n")
+}
@@ -0,0 +1,193 @@
+package protection
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	admissionregistrationv1beta1client "k8s.io/client-go/kubernetes/typed/admissionregistration/v1beta1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// fakeClient serves namespaces and mutating webhook configurations, other
+// calls panic.
+type fakeClient struct {
+	kubernetes.Interface
+	namespaces     map[string]map[string]string
+	configurations map[string]*admissionregistrationv1beta1.MutatingWebhookConfiguration
+	err            error
+}
+
+func (c *fakeClient) CoreV1() corev1client.CoreV1Interface {
+	return fakeCoreV1{client: c}
+}
+
+func (c *fakeClient) AdmissionregistrationV1beta1() admissionregistrationv1beta1client.AdmissionregistrationV1beta1Interface {
+	return fakeAdmissionregistration{client: c}
+}
+
+type fakeCoreV1 struct {
+	corev1client.CoreV1Interface
+	client *fakeClient
+}
+
+func (c fakeCoreV1) Namespaces() corev1client.NamespaceInterface {
+	return fakeNamespaces{client: c.client}
+}
+
+type fakeNamespaces struct {
+	corev1client.NamespaceInterface
+	client *fakeClient
+}
+
+func (n fakeNamespaces) Get(name string, options metav1.GetOptions) (*corev1.Namespace, error) {
+	labels, ok := n.client.namespaces[name]
+	if !ok {
+		return nil, k8serrors.NewNotFound(schema.GroupResource{Resource: "namespaces"}, name)
+	}
+	return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}, nil
+}
+
+type fakeAdmissionregistration struct {
+	admissionregistrationv1beta1client.AdmissionregistrationV1beta1Interface
+	client *fakeClient
+}
+
+func (a fakeAdmissionregistration) MutatingWebhookConfigurations() admissionregistrationv1beta1client.MutatingWebhookConfigurationInterface {
+	return fakeConfigurations{client: a.client}
+}
+
+type fakeConfigurations struct {
+	admissionregistrationv1beta1client.MutatingWebhookConfigurationInterface
+	client *fakeClient
+}
+
+func (c fakeConfigurations) Get(name string, options metav1.GetOptions) (*admissionregistrationv1beta1.MutatingWebhookConfiguration, error) {
+	if c.client.err != nil {
+		return nil, c.client.err
+	}
+	mwc, ok := c.client.configurations[name]
+	if !ok {
+		return nil, k8serrors.NewNotFound(schema.GroupResource{Group: "admissionregistration.k8s.io", Resource: "mutatingwebhookconfigurations"}, name)
+	}
+	return mwc, nil
+}
+
+// configuration returns a configuration of one webhook selecting namespaces
+// by selector, nil selects all.
+func configuration(name string, selector *metav1.LabelSelector) *admissionregistrationv1beta1.MutatingWebhookConfiguration {
+	return &admissionregistrationv1beta1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Webhooks: []admissionregistrationv1beta1.Webhook{{
+			Name:              name + ".tke.cloud.tencent.com",
+			NamespaceSelector: selector,
+		}},
+	}
+}
+
+var optOut = &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+	{Key: "not-add-pod-eni-ip-limit", Operator: metav1.LabelSelectorOpDoesNotExist},
+}}
+
+func TestCheck(t *testing.T) {
+	namespaces := map[string]map[string]string{
+		"tke-eni-ip-webhook": {"not-add-pod-eni-ip-limit": ""},
+		"kube-system":        nil,
+	}
+	invalid := &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+		{Key: "not-add-pod-eni-ip-limit", Operator: "Unknown"},
+	}}
+	tests := []struct {
+		name           string
+		configurations []*admissionregistrationv1beta1.MutatingWebhookConfiguration
+		protected      []string
+		err            error
+		// problems are the namespaces intercepted by the checked webhooks.
+		problems []string
+	}{
+		{
+			name:           "excluded",
+			configurations: []*admissionregistrationv1beta1.MutatingWebhookConfiguration{configuration("pods", optOut)},
+			protected:      []string{"tke-eni-ip-webhook"},
+		},
+		{
+			name:           "not labeled",
+			configurations: []*admissionregistrationv1beta1.MutatingWebhookConfiguration{configuration("pods", optOut)},
+			protected:      []string{"tke-eni-ip-webhook", "kube-system"},
+			problems:       []string{"kube-system"},
+		},
+		{
+			name:           "no selector",
+			configurations: []*admissionregistrationv1beta1.MutatingWebhookConfiguration{configuration("pods", optOut), configuration("templates", nil)},
+			protected:      []string{"tke-eni-ip-webhook"},
+			problems:       []string{"tke-eni-ip-webhook"},
+		},
+		{
+			name:           "namespace not found",
+			configurations: []*admissionregistrationv1beta1.MutatingWebhookConfiguration{configuration("pods", nil)},
+			protected:      []string{"kube-public"},
+		},
+		{
+			name:      "configuration not found",
+			protected: []string{"kube-system"},
+		},
+		{
+			name:           "invalid selector",
+			configurations: []*admissionregistrationv1beta1.MutatingWebhookConfiguration{configuration("pods", invalid)},
+			protected:      []string{"kube-system"},
+		},
+		{
+			name:      "failed to get configurations",
+			protected: []string{"kube-system"},
+			err:       fmt.Errorf("connection refused"),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := &fakeClient{
+				namespaces:     namespaces,
+				configurations: make(map[string]*admissionregistrationv1beta1.MutatingWebhookConfiguration),
+				err:            test.err,
+			}
+			for _, mwc := range test.configurations {
+				client.configurations[mwc.Name] = mwc
+			}
+			c := NewChecker(client, []string{"pods", "templates"}, test.protected)
+			c.Check()
+			degraded := c.Degraded()
+			var problems []string
+			for _, problem := range strings.Split(degraded, "\n") {
+				if problem == "" {
+					continue
+				}
+				problems = append(problems, problem[strings.LastIndex(problem, " ")+1:])
+			}
+			if strings.Join(problems, ",") != strings.Join(test.problems, ",") {
+				t.Errorf("intercepted %v, want %v: %s", problems, test.problems, degraded)
+			}
+		})
+	}
+}
+
+func TestSetNamespaces(t *testing.T) {
+	client := &fakeClient{
+		namespaces:     map[string]map[string]string{"kube-system": nil},
+		configurations: map[string]*admissionregistrationv1beta1.MutatingWebhookConfiguration{"pods": configuration("pods", optOut)},
+	}
+	c := NewChecker(client, []string{"pods"}, nil)
+	c.Check()
+	if degraded := c.Degraded(); degraded != "" {
+		t.Errorf("degraded %q without protected namespaces", degraded)
+	}
+	c.SetNamespaces([]string{"kube-system"})
+	c.Check()
+	if degraded := c.Degraded(); !strings.Contains(degraded, "kube-system") {
+		t.Errorf("degraded %q, want kube-system intercepted", degraded)
+	}
+}
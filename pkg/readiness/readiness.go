@@ -0,0 +1,270 @@
+package readiness
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/informer"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// DefaultConditionType is the readiness gate of tke-route-eni pods.
+const DefaultConditionType = "tke.cloud.tencent.com/eni-ready"
+
+// Reasons of the condition.
+const (
+	ReasonAssigned    = "ENIIPAssigned"
+	ReasonNotAssigned = "PodIPNotInENISubnet"
+)
+
+const retryPeriod = 5 * time.Second
+
+// Options of the controller.
+type Options struct {
+	// ConditionType is the readiness gate to set.
+	ConditionType corev1.PodConditionType
+	// CIDRs are ENI subnets of all nodes.
+	CIDRs []*net.IPNet
+	// NodeAnnotation is the annotation of nodes holding comma separated ENI
+	// subnets of the node, it is used besides CIDRs.
+	NodeAnnotation string
+}
+
+// ParseCIDRs parses comma separated CIDRs.
+func ParseCIDRs(s string) ([]*net.IPNet, error) {
+	var cidrs []*net.IPNet
+	for _, cidr := range strings.Split(s, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		cidrs = append(cidrs, ipNet)
+	}
+	return cidrs, nil
+}
+
+// Controller sets the readiness gate condition of pods once their IP is
+// from an ENI subnet, so that services only send traffic to pods whose ENI
+// networking is usable.
+type Controller struct {
+	client kubernetes.Interface
+	pods   *informer.Informer
+	nodes  *informer.Informer
+	opts   Options
+
+	mu sync.Mutex
+	// running is whether Run is syncing pods, pods are only tracked then,
+	// e.g. replicas not leading track none.
+	running bool
+	pending map[string]bool
+	notify  chan struct{}
+}
+
+// New returns a controller of pods in the pods informer, nodes is only
+// required with a node annotation.
+func New(client kubernetes.Interface, pods, nodes *informer.Informer, opts Options) *Controller {
+	c := &Controller{
+		client:  client,
+		pods:    pods,
+		nodes:   nodes,
+		opts:    opts,
+		pending: make(map[string]bool),
+		notify:  make(chan struct{}, 1),
+	}
+	pods.AddEventHandler(informer.EventHandler{
+		OnAdd:    c.enqueue,
+		OnUpdate: func(_, obj runtime.Object) { c.enqueue(obj) },
+	})
+	if opts.NodeAnnotation != "" {
+		nodes.AddEventHandler(informer.EventHandler{
+			OnUpdate: c.nodeUpdated,
+		})
+	}
+	return c
+}
+
+// nodeUpdated syncs pods of a node again when its ENI subnets change.
+func (c *Controller) nodeUpdated(oldObj, newObj runtime.Object) {
+	oldNode, ok := oldObj.(*corev1.Node)
+	newNode, ok2 := newObj.(*corev1.Node)
+	if !ok || !ok2 || oldNode.Annotations[c.opts.NodeAnnotation] == newNode.Annotations[c.opts.NodeAnnotation] {
+		return
+	}
+	for _, obj := range c.pods.List() {
+		if pod, ok := obj.(*corev1.Pod); ok && pod.Spec.NodeName == newNode.Name {
+			c.enqueue(pod)
+		}
+	}
+}
+
+func (c *Controller) enqueue(obj runtime.Object) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok || !c.gated(pod) {
+		return
+	}
+	c.add(pod.Namespace + "/" + pod.Name)
+}
+
+func (c *Controller) add(key string) {
+	c.mu.Lock()
+	if !c.running {
+		c.mu.Unlock()
+		return
+	}
+	c.pending[key] = true
+	c.mu.Unlock()
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+// gated returns whether pod has the readiness gate and the condition is not
+// true yet.
+func (c *Controller) gated(pod *corev1.Pod) bool {
+	found := false
+	for _, gate := range pod.Spec.ReadinessGates {
+		if gate.ConditionType == c.opts.ConditionType {
+			found = true
+			break
+		}
+	}
+	if !found || pod.DeletionTimestamp != nil {
+		return false
+	}
+	condition := c.condition(pod)
+	return condition == nil || condition.Status != corev1.ConditionTrue
+}
+
+func (c *Controller) condition(pod *corev1.Pod) *corev1.PodCondition {
+	for i := range pod.Status.Conditions {
+		if pod.Status.Conditions[i].Type == c.opts.ConditionType {
+			return &pod.Status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// Run syncs pods until stopCh is closed, pods changed while not running are
+// synced on the next run.
+func (c *Controller) Run(stopCh <-chan struct{}) {
+	if !c.pods.WaitForSync(stopCh) {
+		return
+	}
+	if c.opts.NodeAnnotation != "" && !c.nodes.WaitForSync(stopCh) {
+		return
+	}
+	glog.Infof("Setting readiness gate %s of pods", c.opts.ConditionType)
+	c.setRunning(true)
+	defer c.setRunning(false)
+	for _, obj := range c.pods.List() {
+		c.enqueue(obj)
+	}
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-c.notify:
+		}
+		c.mu.Lock()
+		pending := c.pending
+		c.pending = make(map[string]bool)
+		c.mu.Unlock()
+		for key := range pending {
+			key := key
+			if err := c.sync(key); err != nil {
+				glog.Warningf("Failed to set readiness gate of pod %s, will retry: %v", key, err)
+				time.AfterFunc(retryPeriod, func() { c.add(key) })
+			}
+		}
+	}
+}
+
+// setRunning starts or stops tracking pods, pending pods are dropped on stop
+// since all pods are listed on the next run.
+func (c *Controller) setRunning(running bool) {
+	c.mu.Lock()
+	c.running = running
+	c.pending = make(map[string]bool)
+	c.mu.Unlock()
+}
+
+func (c *Controller) sync(key string) error {
+	obj, ok := c.pods.Get(key)
+	if !ok {
+		return nil
+	}
+	pod := obj.(*corev1.Pod)
+	if !c.gated(pod) || pod.Status.PodIP == "" {
+		return nil
+	}
+
+	status, reason, message := corev1.ConditionFalse, ReasonNotAssigned, ""
+	ip := net.ParseIP(pod.Status.PodIP)
+	if cidr := c.eniCIDR(pod, ip); cidr != nil {
+		status, reason = corev1.ConditionTrue, ReasonAssigned
+		message = fmt.Sprintf("pod IP %s is in ENI subnet %s", ip, cidr)
+	} else {
+		message = fmt.Sprintf("pod IP %s is not in any ENI subnet", pod.Status.PodIP)
+	}
+	if old := c.condition(pod); old != nil && old.Status == status && old.Reason == reason && old.Message == message {
+		return nil
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"uid": pod.UID},
+		"status": map[string]interface{}{
+			"conditions": []corev1.PodCondition{{
+				Type:               c.opts.ConditionType,
+				Status:             status,
+				LastTransitionTime: metav1.Now(),
+				Reason:             reason,
+				Message:            message,
+			}},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := c.client.CoreV1().Pods(pod.Namespace).Patch(pod.Name, types.StrategicMergePatchType, patch, "status"); err != nil {
+		return err
+	}
+	glog.V(3).Infof("Set %s of pod %s to %s: %s", c.opts.ConditionType, key, status, message)
+	return nil
+}
+
+// eniCIDR returns the ENI subnet containing ip, nil if none does.
+func (c *Controller) eniCIDR(pod *corev1.Pod, ip net.IP) *net.IPNet {
+	if ip == nil {
+		return nil
+	}
+	cidrs := c.opts.CIDRs
+	if c.opts.NodeAnnotation != "" && pod.Spec.NodeName != "" {
+		if obj, ok := c.nodes.Get(pod.Spec.NodeName); ok {
+			nodeCIDRs, err := ParseCIDRs(obj.(*corev1.Node).Annotations[c.opts.NodeAnnotation])
+			if err != nil {
+				glog.Warningf("Invalid %s of node %s: %v", c.opts.NodeAnnotation, pod.Spec.NodeName, err)
+			}
+			cidrs = append(nodeCIDRs, cidrs...)
+		}
+	}
+	for _, cidr := range cidrs {
+		if cidr.Contains(ip) {
+			return cidr
+		}
+	}
+	return nil
+}
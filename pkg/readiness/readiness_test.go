@@ -0,0 +1,223 @@
+package readiness
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/informer"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// fakeClient records patched pod status and sends the patched pods to
+// patched if not nil, other calls panic.
+type fakeClient struct {
+	kubernetes.Interface
+	err     error
+	patches map[string]corev1.PodCondition
+	patched chan string
+}
+
+func (c *fakeClient) CoreV1() corev1client.CoreV1Interface {
+	return fakeCoreV1{client: c}
+}
+
+type fakeCoreV1 struct {
+	corev1client.CoreV1Interface
+	client *fakeClient
+}
+
+func (c fakeCoreV1) Pods(namespace string) corev1client.PodInterface {
+	return fakePods{client: c.client, namespace: namespace}
+}
+
+type fakePods struct {
+	corev1client.PodInterface
+	client    *fakeClient
+	namespace string
+}
+
+func (p fakePods) Patch(name string, pt types.PatchType, data []byte, subresources ...string) (*corev1.Pod, error) {
+	if p.client.err != nil {
+		return nil, p.client.err
+	}
+	if len(subresources) != 1 || subresources[0] != "status" {
+		return nil, fmt.Errorf("patched %v of pod %s, want status", subresources, name)
+	}
+	var patch struct {
+		Status struct {
+			Conditions []corev1.PodCondition `json:"conditions"`
+		} `json:"status"`
+	}
+	if err := json.Unmarshal(data, &patch); err != nil {
+		return nil, err
+	}
+	if len(patch.Status.Conditions) != 1 {
+		return nil, fmt.Errorf("patched conditions %s, want one", data)
+	}
+	p.client.patches[p.namespace+"/"+name] = patch.Status.Conditions[0]
+	if p.client.patched != nil {
+		p.client.patched <- p.namespace + "/" + name
+	}
+	return &corev1.Pod{}, nil
+}
+
+func runInformer(t *testing.T, stopCh <-chan struct{}, name string, list runtime.Object) *informer.Informer {
+	i := informer.New(name,
+		func(metav1.ListOptions) (runtime.Object, error) { return list, nil },
+		func(metav1.ListOptions) (watch.Interface, error) { return watch.NewFake(), nil })
+	go i.Run(stopCh)
+	if !i.WaitForSync(stopCh) {
+		t.Fatalf("%s are not synced", name)
+	}
+	return i
+}
+
+// gatedPod returns a pod on node-1 with the readiness gate, ip empty means it
+// has no IP yet and status empty means it has no condition.
+func gatedPod(name, ip string, status corev1.ConditionStatus) corev1.Pod {
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+		Spec: corev1.PodSpec{
+			NodeName:       "node-1",
+			ReadinessGates: []corev1.PodReadinessGate{{ConditionType: DefaultConditionType}},
+		},
+		Status: corev1.PodStatus{PodIP: ip},
+	}
+	if status != "" {
+		reason := ReasonAssigned
+		if status != corev1.ConditionTrue {
+			reason = ReasonNotAssigned
+		}
+		pod.Status.Conditions = []corev1.PodCondition{{
+			Type:    DefaultConditionType,
+			Status:  status,
+			Reason:  reason,
+			Message: fmt.Sprintf("pod IP %s is not in any ENI subnet", ip),
+		}}
+	}
+	return pod
+}
+
+func TestParseCIDRs(t *testing.T) {
+	tests := []struct {
+		s         string
+		expect    []string
+		expectErr bool
+	}{
+		{s: ""},
+		{s: "10.0.0.0/16", expect: []string{"10.0.0.0/16"}},
+		{s: " 10.0.0.0/16, ,10.1.2.3/24 ", expect: []string{"10.0.0.0/16", "10.1.2.0/24"}},
+		{s: "10.0.0.0", expectErr: true},
+	}
+	for _, test := range tests {
+		cidrs, err := ParseCIDRs(test.s)
+		if (err != nil) != test.expectErr {
+			t.Errorf("%q: error = %v, want error %v", test.s, err, test.expectErr)
+			continue
+		}
+		var got []string
+		for _, cidr := range cidrs {
+			got = append(got, cidr.String())
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.expect) {
+			t.Errorf("%q: cidrs %v, want %v", test.s, got, test.expect)
+		}
+	}
+}
+
+func TestSync(t *testing.T) {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	notGated := gatedPod("not-gated", "10.0.0.5", "")
+	notGated.Spec.ReadinessGates = nil
+	deleting := gatedPod("deleting", "10.0.0.6", "")
+	deleting.DeletionTimestamp = &metav1.Time{}
+	pods := runInformer(t, stopCh, "pods", &corev1.PodList{Items: []corev1.Pod{
+		gatedPod("eni", "10.0.0.2", ""),
+		gatedPod("node-eni", "192.168.1.2", ""),
+		gatedPod("not-eni", "172.16.0.2", ""),
+		gatedPod("no-ip", "", ""),
+		gatedPod("ready", "10.0.0.3", corev1.ConditionTrue),
+		gatedPod("unchanged", "172.16.0.3", corev1.ConditionFalse),
+		gatedPod("now-eni", "10.0.0.4", corev1.ConditionFalse),
+		notGated,
+		deleting,
+	}})
+	nodes := runInformer(t, stopCh, "nodes", &corev1.NodeList{Items: []corev1.Node{{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-1", Annotations: map[string]string{"eni-subnets": "192.168.1.0/24"}},
+	}}})
+	_, cidr, _ := net.ParseCIDR("10.0.0.0/16")
+	client := &fakeClient{}
+	c := New(client, pods, nodes, Options{
+		ConditionType:  DefaultConditionType,
+		CIDRs:          []*net.IPNet{cidr},
+		NodeAnnotation: "eni-subnets",
+	})
+
+	tests := []struct {
+		name string
+		err  error
+		// status is the patched condition, empty if not patched.
+		status    corev1.ConditionStatus
+		expectErr bool
+	}{
+		{name: "eni", status: corev1.ConditionTrue},
+		{name: "node-eni", status: corev1.ConditionTrue},
+		{name: "not-eni", status: corev1.ConditionFalse},
+		{name: "no-ip"},
+		{name: "ready"},
+		{name: "unchanged"},
+		{name: "now-eni", status: corev1.ConditionTrue},
+		{name: "not-gated"},
+		{name: "deleting"},
+		{name: "not-found"},
+		{name: "eni", err: fmt.Errorf("conflict"), expectErr: true},
+	}
+	for _, test := range tests {
+		client.err = test.err
+		client.patches = make(map[string]corev1.PodCondition)
+		key := "default/" + test.name
+		if err := c.sync(key); (err != nil) != test.expectErr {
+			t.Errorf("%s: error = %v, want error %v", test.name, err, test.expectErr)
+			continue
+		}
+		condition, patched := client.patches[key]
+		if test.status == "" {
+			if patched {
+				t.Errorf("%s: patched %+v, want not patched", test.name, condition)
+			}
+			continue
+		}
+		if !patched || condition.Type != DefaultConditionType || condition.Status != test.status {
+			t.Errorf("%s: patched %+v, want %s %s", test.name, condition, DefaultConditionType, test.status)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	pods := runInformer(t, stopCh, "pods", &corev1.PodList{Items: []corev1.Pod{gatedPod("eni", "10.0.0.2", "")}})
+	_, cidr, _ := net.ParseCIDR("10.0.0.0/16")
+	client := &fakeClient{patches: make(map[string]corev1.PodCondition), patched: make(chan string, 1)}
+	c := New(client, pods, nil, Options{ConditionType: DefaultConditionType, CIDRs: []*net.IPNet{cidr}})
+	go c.Run(stopCh)
+	select {
+	case key := <-client.patched:
+		if condition := client.patches[key]; key != "default/eni" || condition.Status != corev1.ConditionTrue {
+			t.Errorf("patched %s to %+v, want default/eni true", key, condition)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("listed pods are not synced")
+	}
+}
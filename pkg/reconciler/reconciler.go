@@ -0,0 +1,303 @@
+package reconciler
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/events"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/https"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/informer"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/metrics"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/schema"
+
+	"github.com/golang/glog"
+	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/reference"
+)
+
+// Reasons of events raised by the reconciler.
+const (
+	ReasonMissingENIIP = "MissingENIIP"
+	ReasonDeletedPod   = "DeletedPodMissingENIIP"
+)
+
+var (
+	unmutatedPods = metrics.NewGaugeVec("unmutated_pods",
+		"Running "+https.TKERouteENI+" pods without "+https.UnderlayIPResource+", e.g. admitted while the webhook was unavailable.", "namespace")
+	deletedPods = metrics.NewCounterVec("unmutated_pods_deleted_total",
+		"Pods without "+https.UnderlayIPResource+" deleted so that their controllers re-create them through the webhook.", "namespace")
+)
+
+// Explainer decides how a pod should have been mutated, see https.HttpsServer.
+type Explainer interface {
+	Explain(namespace string, obj runtime.Object) (*https.Result, error)
+}
+
+// Options of the reconciler.
+type Options struct {
+	// Period between two passes over all pods.
+	Period time.Duration
+	// DeletePods deletes unmutated pods owned by a controller.
+	DeletePods bool
+	// MaxDeletions limits pods deleted per pass, so that a webhook still
+	// unavailable does not make controllers churn every pod.
+	MaxDeletions int
+	// Configurations are the MutatingWebhookConfigurations of the webhook.
+	// Pods in namespaces none of their pod webhooks select, e.g. labeled
+	// not-add-pod-eni-ip-limit, are never mutated and not reconciled. Empty
+	// reconciles pods of all namespaces.
+	Configurations []string
+}
+
+// Reconciler finds tke-route-eni pods admitted without eni-ip, which use IPs
+// the scheduler does not account for.
+type Reconciler struct {
+	client     kubernetes.Interface
+	pods       *informer.Informer
+	namespaces *informer.Informer
+	explainer  Explainer
+	recorder   *events.Recorder
+	opts       Options
+
+	// reported pods are not raised events again.
+	reported map[types.UID]bool
+}
+
+// New returns a reconciler of pods in the pods informer, namespaces are
+// matched against namespaceSelectors of opts.Configurations.
+func New(client kubernetes.Interface, pods, namespaces *informer.Informer, explainer Explainer, recorder *events.Recorder, opts Options) *Reconciler {
+	return &Reconciler{
+		client:     client,
+		pods:       pods,
+		namespaces: namespaces,
+		explainer:  explainer,
+		recorder:   recorder,
+		opts:       opts,
+		reported:   make(map[types.UID]bool),
+	}
+}
+
+// Run reconciles pods every period until stopCh is closed.
+func (r *Reconciler) Run(stopCh <-chan struct{}) {
+	defer unmutatedPods.Reset()
+	if !r.pods.WaitForSync(stopCh) || !r.namespaces.WaitForSync(stopCh) {
+		return
+	}
+	glog.Infof("Reconciling pods without %s every %s", https.UnderlayIPResource, r.opts.Period)
+	wait.Until(r.reconcile, r.opts.Period, stopCh)
+}
+
+func (r *Reconciler) reconcile() {
+	selectors, err := r.namespaceSelectors()
+	if err != nil {
+		// without the selectors pods opted out of the webhook may be deleted
+		glog.Warningf("Skip reconciling pods: %v", err)
+		return
+	}
+	counts := make(map[string]int)
+	seen := make(map[types.UID]bool)
+	deletions := 0
+	for _, obj := range r.pods.List() {
+		pod, ok := obj.(*corev1.Pod)
+		if !ok || !r.intercepted(pod.Namespace, selectors) {
+			continue
+		}
+		result := r.unmutated(pod)
+		if result == nil {
+			continue
+		}
+		counts[pod.Namespace]++
+		seen[pod.UID] = true
+		if !r.reported[pod.UID] {
+			r.report(pod)
+			r.reported[pod.UID] = true
+		}
+		if r.opts.DeletePods && deletions < r.opts.MaxDeletions && deletable(pod, result) && r.delete(pod) {
+			deletions++
+		}
+	}
+	for uid := range r.reported {
+		if !seen[uid] {
+			delete(r.reported, uid)
+		}
+	}
+
+	samples := unmutatedPods.NewSamples()
+	for namespace, count := range counts {
+		samples.Set(float64(count), namespace)
+	}
+	metrics.Replace(samples)
+	glog.V(4).Infof("Reconciled pods, %d without %s in %d namespaces, %d deleted", len(seen), https.UnderlayIPResource, len(counts), deletions)
+}
+
+// namespaceSelectors returns the namespaceSelectors of webhooks admitting
+// pods in the configurations, nil if every namespace is reconciled.
+func (r *Reconciler) namespaceSelectors() ([]labels.Selector, error) {
+	if len(r.opts.Configurations) == 0 {
+		return nil, nil
+	}
+	selectors := []labels.Selector{}
+	for _, name := range r.opts.Configurations {
+		mwc, err := r.client.AdmissionregistrationV1beta1().MutatingWebhookConfigurations().Get(name, metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get mutating webhook configuration %s: %v", name, err)
+		}
+		for _, wh := range mwc.Webhooks {
+			if !admitsPods(wh.Rules) {
+				continue
+			}
+			selector := labels.Everything()
+			if wh.NamespaceSelector != nil {
+				if selector, err = metav1.LabelSelectorAsSelector(wh.NamespaceSelector); err != nil {
+					return nil, fmt.Errorf("invalid namespaceSelector of webhook %s in %s: %v", wh.Name, name, err)
+				}
+			}
+			selectors = append(selectors, selector)
+		}
+	}
+	return selectors, nil
+}
+
+// admitsPods returns whether rules match creating pods.
+func admitsPods(rules []admissionregistrationv1beta1.RuleWithOperations) bool {
+	for _, rule := range rules {
+		creates := false
+		for _, op := range rule.Operations {
+			creates = creates || op == admissionregistrationv1beta1.Create || op == admissionregistrationv1beta1.OperationAll
+		}
+		if creates && containsAny(rule.APIGroups, "", "*") && containsAny(rule.Resources, "pods", "*", "*/*") {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAny(values []string, wanted ...string) bool {
+	for _, value := range values {
+		for _, w := range wanted {
+			if value == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// intercepted returns whether pods in namespace are sent to the webhook,
+// selectors nil means all namespaces are.
+func (r *Reconciler) intercepted(namespace string, selectors []labels.Selector) bool {
+	if selectors == nil {
+		return true
+	}
+	obj, ok := r.namespaces.Get(namespace)
+	if !ok {
+		return false
+	}
+	ns, ok := obj.(*corev1.Namespace)
+	if !ok {
+		return false
+	}
+	for _, selector := range selectors {
+		if selector.Matches(labels.Set(ns.Labels)) {
+			return true
+		}
+	}
+	return false
+}
+
+// unmutated returns how pod should have been mutated if it should have been
+// injected eni-ip but has not, nil otherwise.
+func (r *Reconciler) unmutated(pod *corev1.Pod) *https.Result {
+	if pod.DeletionTimestamp != nil || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+		return nil
+	}
+	if https.PodHasENIIP(pod) {
+		return nil
+	}
+	result, err := r.explainer.Explain(pod.Namespace, pod)
+	if err != nil {
+		glog.Warningf("Failed to explain pod %s/%s: %v", pod.Namespace, pod.Name, err)
+		return nil
+	}
+	// other resources injected by EniIPPolicy are not reconciled
+	if !result.Inject || result.Resource != https.UnderlayIPResource {
+		return nil
+	}
+	return result
+}
+
+// deletable returns whether pod uses tke-route-eni by its own networks
+// annotation, including networks pinned on admission. Namespace or cluster
+// defaults may have changed since the pod was admitted, so such pods are
+// only reported.
+func deletable(pod *corev1.Pod, result *https.Result) bool {
+	if result.NetworksSource != https.NetworksFromPod {
+		glog.V(4).Infof("Not deleting pod %s/%s, its networks are resolved from %s defaults, which may have changed since it was admitted", pod.Namespace, pod.Name, result.NetworksSource)
+		return false
+	}
+	return true
+}
+
+func (r *Reconciler) report(pod *corev1.Pod) {
+	glog.Warningf("%s pod %s/%s has no %s", https.TKERouteENI, pod.Namespace, pod.Name, https.UnderlayIPResource)
+	if ref, err := reference.GetReference(schema.Scheme, pod); err == nil {
+		r.recorder.Eventf(ref, corev1.EventTypeWarning, ReasonMissingENIIP,
+			"Pod uses %s but has no %s, it was probably admitted while the webhook was unavailable", https.TKERouteENI, https.UnderlayIPResource)
+	} else {
+		glog.Warningf("Failed to get reference of pod %s/%s: %v", pod.Namespace, pod.Name, err)
+	}
+	if owner := ownerReference(pod); owner != nil {
+		r.recorder.Eventf(owner, corev1.EventTypeWarning, ReasonMissingENIIP,
+			"Pod %s uses %s but has no %s, re-create it to be mutated by the webhook", pod.Name, https.TKERouteENI, https.UnderlayIPResource)
+	}
+}
+
+// delete deletes pod if it is owned by a controller, which re-creates it.
+func (r *Reconciler) delete(pod *corev1.Pod) bool {
+	owner := ownerReference(pod)
+	// mirror pods are controlled by their node, deleting them is useless
+	if owner == nil || owner.Kind == "Node" {
+		return false
+	}
+	uid := pod.UID
+	err := r.client.CoreV1().Pods(pod.Namespace).Delete(pod.Name, &metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{UID: &uid},
+	})
+	if err != nil {
+		if !k8serrors.IsNotFound(err) && !k8serrors.IsConflict(err) {
+			glog.Warningf("Failed to delete pod %s/%s: %v", pod.Namespace, pod.Name, err)
+		}
+		return false
+	}
+	glog.Infof("Deleted pod %s/%s without %s, %s %s re-creates it", pod.Namespace, pod.Name, https.UnderlayIPResource, owner.Kind, owner.Name)
+	deletedPods.Inc(pod.Namespace)
+	r.recorder.Eventf(owner, corev1.EventTypeNormal, ReasonDeletedPod,
+		"Deleted pod %s without %s so that it is re-created through the webhook", pod.Name, https.UnderlayIPResource)
+	return true
+}
+
+// ownerReference returns the controller of pod, nil if it has none.
+func ownerReference(pod *corev1.Pod) *corev1.ObjectReference {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		return nil
+	}
+	return &corev1.ObjectReference{
+		APIVersion: owner.APIVersion,
+		Kind:       owner.Kind,
+		Namespace:  pod.Namespace,
+		Name:       owner.Name,
+		UID:        owner.UID,
+	}
+}
@@ -0,0 +1,375 @@
+package reconciler
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/events"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/https"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/informer"
+
+	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	admissionregistrationv1beta1client "k8s.io/client-go/kubernetes/typed/admissionregistration/v1beta1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// fakeClient serves mutating webhook configurations and records deleted
+// pods, other calls panic.
+type fakeClient struct {
+	kubernetes.Interface
+	configurations map[string]*admissionregistrationv1beta1.MutatingWebhookConfiguration
+	err            error
+	deleted        []string
+}
+
+func (c *fakeClient) CoreV1() corev1client.CoreV1Interface {
+	return fakeCoreV1{client: c}
+}
+
+func (c *fakeClient) AdmissionregistrationV1beta1() admissionregistrationv1beta1client.AdmissionregistrationV1beta1Interface {
+	return fakeAdmissionregistration{client: c}
+}
+
+type fakeCoreV1 struct {
+	corev1client.CoreV1Interface
+	client *fakeClient
+}
+
+func (c fakeCoreV1) Pods(namespace string) corev1client.PodInterface {
+	return fakePods{client: c.client, namespace: namespace}
+}
+
+func (c fakeCoreV1) Events(namespace string) corev1client.EventInterface {
+	return fakeEvents{}
+}
+
+type fakePods struct {
+	corev1client.PodInterface
+	client    *fakeClient
+	namespace string
+}
+
+func (p fakePods) Delete(name string, options *metav1.DeleteOptions) error {
+	p.client.deleted = append(p.client.deleted, p.namespace+"/"+name)
+	return nil
+}
+
+type fakeEvents struct {
+	corev1client.EventInterface
+}
+
+func (fakeEvents) Create(event *corev1.Event) (*corev1.Event, error) {
+	return event, nil
+}
+
+type fakeAdmissionregistration struct {
+	admissionregistrationv1beta1client.AdmissionregistrationV1beta1Interface
+	client *fakeClient
+}
+
+func (a fakeAdmissionregistration) MutatingWebhookConfigurations() admissionregistrationv1beta1client.MutatingWebhookConfigurationInterface {
+	return fakeConfigurations{client: a.client}
+}
+
+type fakeConfigurations struct {
+	admissionregistrationv1beta1client.MutatingWebhookConfigurationInterface
+	client *fakeClient
+}
+
+func (c fakeConfigurations) Get(name string, options metav1.GetOptions) (*admissionregistrationv1beta1.MutatingWebhookConfiguration, error) {
+	if c.client.err != nil {
+		return nil, c.client.err
+	}
+	mwc, ok := c.client.configurations[name]
+	if !ok {
+		return nil, k8serrors.NewNotFound(schema.GroupResource{Group: "admissionregistration.k8s.io", Resource: "mutatingwebhookconfigurations"}, name)
+	}
+	return mwc, nil
+}
+
+// fakeExplainer returns results by pod name, other pods are not injected.
+type fakeExplainer map[string]*https.Result
+
+func (f fakeExplainer) Explain(namespace string, obj runtime.Object) (*https.Result, error) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return nil, fmt.Errorf("unexpected %T", obj)
+	}
+	if result, ok := f[pod.Name]; ok {
+		return result, nil
+	}
+	return &https.Result{Reason: "not " + https.TKERouteENI}, nil
+}
+
+var (
+	fromPod = &https.Result{Inject: true, Resource: https.UnderlayIPResource, NetworksSource: https.NetworksFromPod}
+	// fromNamespace pods use tke-route-eni by namespace defaults.
+	fromNamespace = &https.Result{Inject: true, Resource: https.UnderlayIPResource, NetworksSource: https.NetworksFromNamespace}
+	protected     = &https.Result{Reason: "protected namespace kube-system"}
+	otherResource = &https.Result{Inject: true, Resource: "tke.cloud.tencent.com/eip", NetworksSource: https.NetworksFromPod}
+)
+
+// podWebhook selects namespaces without the opt out label, like deploy/webhook-registration.yaml.
+var podWebhook = &admissionregistrationv1beta1.MutatingWebhookConfiguration{
+	ObjectMeta: metav1.ObjectMeta{Name: "add-pod-eni-ip-limit-webhook"},
+	Webhooks: []admissionregistrationv1beta1.Webhook{{
+		Name: "add-pod-eni-ip-limit-webhook.tke.cloud.tencent.com",
+		Rules: []admissionregistrationv1beta1.RuleWithOperations{{
+			Operations: []admissionregistrationv1beta1.OperationType{admissionregistrationv1beta1.Create},
+			Rule:       admissionregistrationv1beta1.Rule{APIGroups: []string{""}, APIVersions: []string{"v1"}, Resources: []string{"pods"}},
+		}},
+		NamespaceSelector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+			{Key: "not-add-pod-eni-ip-limit", Operator: metav1.LabelSelectorOpDoesNotExist},
+		}},
+	}},
+}
+
+// templateWebhook does not admit pods, its selector matching every
+// namespace is ignored.
+var templateWebhook = &admissionregistrationv1beta1.MutatingWebhookConfiguration{
+	ObjectMeta: metav1.ObjectMeta{Name: "add-pod-eni-ip-limit-template-webhook"},
+	Webhooks: []admissionregistrationv1beta1.Webhook{{
+		Name: "add-pod-eni-ip-limit-template-webhook.tke.cloud.tencent.com",
+		Rules: []admissionregistrationv1beta1.RuleWithOperations{{
+			Operations: []admissionregistrationv1beta1.OperationType{admissionregistrationv1beta1.Create},
+			Rule:       admissionregistrationv1beta1.Rule{APIGroups: []string{"apps"}, APIVersions: []string{"v1"}, Resources: []string{"deployments"}},
+		}},
+	}},
+}
+
+var testConfigurations = []string{podWebhook.Name, templateWebhook.Name}
+
+func runInformer(t *testing.T, stopCh <-chan struct{}, name string, list runtime.Object) *informer.Informer {
+	i := informer.New(name,
+		func(metav1.ListOptions) (runtime.Object, error) { return list, nil },
+		func(metav1.ListOptions) (watch.Interface, error) { return watch.NewFake(), nil })
+	go i.Run(stopCh)
+	if !i.WaitForSync(stopCh) {
+		t.Fatalf("%s are not synced", name)
+	}
+	return i
+}
+
+func namespace(name string, labels map[string]string) corev1.Namespace {
+	return corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}
+}
+
+var testNamespaces = &corev1.NamespaceList{Items: []corev1.Namespace{
+	namespace("default", nil),
+	namespace("kube-system", nil),
+	namespace("opted-out", map[string]string{"not-add-pod-eni-ip-limit": "true"}),
+}}
+
+// pod returns a running pod controlled by a ReplicaSet, ownerKind empty
+// means it has no controller.
+func pod(namespace, name, ownerKind string) corev1.Pod {
+	p := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, UID: types.UID(namespace + "/" + name)},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "c"}}},
+		Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+	if ownerKind != "" {
+		controller := true
+		p.OwnerReferences = []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: ownerKind, Name: name + "-owner", Controller: &controller}}
+	}
+	return p
+}
+
+func TestUnmutated(t *testing.T) {
+	injected := pod("default", "injected", "ReplicaSet")
+	injected.Spec.Containers[0].Resources.Limits = corev1.ResourceList{https.UnderlayIPResource: resource.MustParse("1")}
+	succeeded := pod("default", "succeeded", "ReplicaSet")
+	succeeded.Status.Phase = corev1.PodSucceeded
+	deleting := pod("default", "deleting", "ReplicaSet")
+	now := metav1.Now()
+	deleting.DeletionTimestamp = &now
+	explainer := fakeExplainer{
+		"missing": fromPod, "injected": fromPod, "succeeded": fromPod, "deleting": fromPod,
+		"protected": protected, "other-resource": otherResource,
+	}
+	r := New(nil, nil, nil, explainer, nil, Options{})
+	tests := []struct {
+		name      string
+		pod       corev1.Pod
+		unmutated bool
+	}{
+		{name: "missing eni-ip", pod: pod("default", "missing", "ReplicaSet"), unmutated: true},
+		{name: "injected", pod: injected},
+		{name: "succeeded", pod: succeeded},
+		{name: "being deleted", pod: deleting},
+		{name: "not tke-route-eni", pod: pod("default", "bridge", "ReplicaSet")},
+		{name: "protected", pod: pod("kube-system", "protected", "ReplicaSet")},
+		{name: "other resource of policy", pod: pod("default", "other-resource", "ReplicaSet")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := r.unmutated(&test.pod) != nil; got != test.unmutated {
+				t.Errorf("unmutated = %v, want %v", got, test.unmutated)
+			}
+		})
+	}
+}
+
+func TestIntercepted(t *testing.T) {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	namespaces := runInformer(t, stopCh, "namespaces", testNamespaces)
+	podsOfAll := podWebhook.DeepCopy()
+	podsOfAll.Webhooks[0].NamespaceSelector = nil
+	podsOfAll.Webhooks[0].Rules[0].Operations = []admissionregistrationv1beta1.OperationType{admissionregistrationv1beta1.OperationAll}
+	podsOfAll.Webhooks[0].Rules[0].Resources = []string{"*"}
+	tests := []struct {
+		name           string
+		configurations map[string]*admissionregistrationv1beta1.MutatingWebhookConfiguration
+		names          []string
+		err            error
+		intercepted    []string
+		fails          bool
+	}{
+		{
+			name:           "opted out",
+			configurations: map[string]*admissionregistrationv1beta1.MutatingWebhookConfiguration{podWebhook.Name: podWebhook, templateWebhook.Name: templateWebhook},
+			names:          testConfigurations,
+			intercepted:    []string{"default", "kube-system"},
+		},
+		{
+			name:           "no selector",
+			configurations: map[string]*admissionregistrationv1beta1.MutatingWebhookConfiguration{podWebhook.Name: podsOfAll},
+			names:          testConfigurations,
+			intercepted:    []string{"default", "kube-system", "opted-out"},
+		},
+		{
+			name:           "only template webhook",
+			configurations: map[string]*admissionregistrationv1beta1.MutatingWebhookConfiguration{templateWebhook.Name: templateWebhook},
+			names:          testConfigurations,
+		},
+		{
+			name:        "no configurations",
+			intercepted: []string{"default", "kube-system", "opted-out", "unknown"},
+		},
+		{
+			name:  "failed to get",
+			names: testConfigurations,
+			err:   fmt.Errorf("connection refused"),
+			fails: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := &fakeClient{configurations: test.configurations, err: test.err}
+			r := New(client, nil, namespaces, nil, nil, Options{Configurations: test.names})
+			selectors, err := r.namespaceSelectors()
+			if (err != nil) != test.fails {
+				t.Fatalf("namespaceSelectors error = %v, want failure %v", err, test.fails)
+			}
+			if err != nil {
+				return
+			}
+			var intercepted []string
+			for _, ns := range []string{"default", "kube-system", "opted-out", "unknown"} {
+				if r.intercepted(ns, selectors) {
+					intercepted = append(intercepted, ns)
+				}
+			}
+			if !reflect.DeepEqual(intercepted, test.intercepted) {
+				t.Errorf("intercepted = %v, want %v", intercepted, test.intercepted)
+			}
+		})
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	namespaces := runInformer(t, stopCh, "namespaces", testNamespaces)
+	pods := runInformer(t, stopCh, "pods", &corev1.PodList{Items: []corev1.Pod{
+		pod("default", "deployed-1", "ReplicaSet"),
+		pod("default", "deployed-2", "ReplicaSet"),
+		pod("default", "defaults", "ReplicaSet"),
+		pod("default", "ownerless", ""),
+		pod("default", "mirror", "Node"),
+		pod("kube-system", "protected", "ReplicaSet"),
+		pod("opted-out", "opted-out", "ReplicaSet"),
+	}})
+	explainer := fakeExplainer{
+		"deployed-1": fromPod, "deployed-2": fromPod, "defaults": fromNamespace,
+		"ownerless": fromPod, "mirror": fromPod, "protected": protected, "opted-out": fromPod,
+	}
+	configurations := map[string]*admissionregistrationv1beta1.MutatingWebhookConfiguration{podWebhook.Name: podWebhook}
+	tests := []struct {
+		name     string
+		opts     Options
+		err      error
+		reported []string
+		// deletions pods are deleted among deletable ones
+		deletable []string
+		deletions int
+	}{
+		{
+			name:     "report only",
+			opts:     Options{Configurations: testConfigurations},
+			reported: []string{"default/defaults", "default/deployed-1", "default/deployed-2", "default/mirror", "default/ownerless"},
+		},
+		{
+			name:      "delete pods of controllers by own networks",
+			opts:      Options{Configurations: testConfigurations, DeletePods: true, MaxDeletions: 10},
+			reported:  []string{"default/defaults", "default/deployed-1", "default/deployed-2", "default/mirror", "default/ownerless"},
+			deletable: []string{"default/deployed-1", "default/deployed-2"},
+			deletions: 2,
+		},
+		{
+			name:      "max deletions",
+			opts:      Options{Configurations: testConfigurations, DeletePods: true, MaxDeletions: 1},
+			reported:  []string{"default/defaults", "default/deployed-1", "default/deployed-2", "default/mirror", "default/ownerless"},
+			deletable: []string{"default/deployed-1", "default/deployed-2"},
+			deletions: 1,
+		},
+		{
+			name:      "every namespace without configurations",
+			opts:      Options{DeletePods: true, MaxDeletions: 10},
+			reported:  []string{"default/defaults", "default/deployed-1", "default/deployed-2", "default/mirror", "default/ownerless", "opted-out/opted-out"},
+			deletable: []string{"default/deployed-1", "default/deployed-2", "opted-out/opted-out"},
+			deletions: 3,
+		},
+		{
+			name: "skipped without configurations",
+			opts: Options{Configurations: testConfigurations, DeletePods: true, MaxDeletions: 10},
+			err:  fmt.Errorf("connection refused"),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := &fakeClient{configurations: configurations, err: test.err}
+			r := New(client, pods, namespaces, explainer, events.NewRecorder(client, "test"), test.opts)
+			r.reconcile()
+			var reported []string
+			for uid := range r.reported {
+				reported = append(reported, string(uid))
+			}
+			sort.Strings(reported)
+			if !reflect.DeepEqual(reported, test.reported) {
+				t.Errorf("reported = %v, want %v", reported, test.reported)
+			}
+			// pods are listed in random order
+			if len(client.deleted) != test.deletions {
+				t.Errorf("deleted %v, want %d of %v", client.deleted, test.deletions, test.deletable)
+			}
+			for _, deleted := range client.deleted {
+				if !containsAny(test.deletable, deleted) {
+					t.Errorf("deleted %s, want one of %v", deleted, test.deletable)
+				}
+			}
+		})
+	}
+}
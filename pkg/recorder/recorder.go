@@ -0,0 +1,217 @@
+package recorder
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"os"
+	"time"
+
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/logging"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/metrics"
+
+	"github.com/golang/glog"
+	"k8s.io/api/admission/v1beta1"
+)
+
+var records = metrics.NewCounterVec("recorder_records_total",
+	"Admissions passed to the recorder, by result, one of written, filtered, dropped and failed.", "result")
+
+// queueSize is the most records waiting to be written, records are dropped
+// rather than slowing down admissions.
+const queueSize = 1024
+
+// Record is an admission as recorded, one JSON object per line.
+type Record struct {
+	Time     time.Time `json:"time"`
+	Path     string    `json:"path"`
+	Decision string    `json:"decision"`
+	Reason   string    `json:"reason,omitempty"`
+	// Request is the AdmissionRequest with redactions applied.
+	Request json.RawMessage `json:"request"`
+	Patch   json.RawMessage `json:"patch,omitempty"`
+	// Denial is the message of a denied or failed admission.
+	Denial   string   `json:"denial,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+	// Inputs are what the admission is decided with besides the request,
+	// see https.Mutation.
+	Inputs map[string]string `json:"inputs,omitempty"`
+}
+
+// Options of a Recorder.
+type Options struct {
+	// File is written until it exceeds MaxBytes, then it is renamed to
+	// File.1, older files are shifted up to File.MaxFiles.
+	File     string
+	MaxBytes int64
+	MaxFiles int
+	// SampleRatio of the admissions passing filters to record.
+	SampleRatio float64
+	// Namespaces and Decisions filter admissions, empty records all.
+	Namespaces []string
+	Decisions  []string
+	// Redactions are applied to requests, see logging.ParseRedactions.
+	Redactions []string
+}
+
+// Recorder writes admissions to a rotating local file.
+type Recorder struct {
+	opts       Options
+	namespaces map[string]bool
+	decisions  map[string]bool
+	queue      chan *Record
+
+	file *os.File
+	size int64
+}
+
+// New returns a recorder writing once Run.
+func New(opts Options) (*Recorder, error) {
+	if opts.File == "" {
+		return nil, fmt.Errorf("no record file")
+	}
+	if opts.MaxBytes <= 0 || opts.MaxFiles < 0 {
+		return nil, fmt.Errorf("invalid record rotation, max bytes %d, max files %d", opts.MaxBytes, opts.MaxFiles)
+	}
+	if opts.SampleRatio < 0 || opts.SampleRatio > 1 {
+		return nil, fmt.Errorf("record sample ratio %v is not in [0, 1]", opts.SampleRatio)
+	}
+	r := &Recorder{
+		opts:       opts,
+		namespaces: toSet(opts.Namespaces),
+		decisions:  toSet(opts.Decisions),
+		queue:      make(chan *Record, queueSize),
+	}
+	return r, nil
+}
+
+func toSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		set[v] = true
+	}
+	return set
+}
+
+// Record queues the admission of req by path if it passes filters and
+// sampling, see https.Recorder.
+func (r *Recorder) Record(path string, req *v1beta1.AdmissionRequest, response *v1beta1.AdmissionResponse, warnings []string, decision, reason string, inputs map[string]string) {
+	if (len(r.namespaces) > 0 && !r.namespaces[req.Namespace]) || (len(r.decisions) > 0 && !r.decisions[decision]) {
+		records.Inc("filtered")
+		return
+	}
+	if r.opts.SampleRatio < 1 && mathrand.Float64() >= r.opts.SampleRatio {
+		records.Inc("filtered")
+		return
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		glog.Warningf("Failed to record admission %s: %v", req.UID, err)
+		records.Inc("failed")
+		return
+	}
+	rec := &Record{
+		Time:     time.Now().UTC(),
+		Path:     path,
+		Decision: decision,
+		Reason:   reason,
+		Request:  json.RawMessage(logging.RedactWith(data, r.opts.Redactions)),
+		Warnings: warnings,
+		Inputs:   inputs,
+	}
+	if response != nil {
+		rec.Patch = json.RawMessage(response.Patch)
+		if !response.Allowed && response.Result != nil {
+			rec.Denial = response.Result.Message
+		}
+	}
+	select {
+	case r.queue <- rec:
+	default:
+		records.Inc("dropped")
+	}
+}
+
+// Run writes queued records until stopCh is closed.
+func (r *Recorder) Run(stopCh <-chan struct{}) {
+	defer func() {
+		if r.file != nil {
+			r.file.Close()
+		}
+	}()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case rec := <-r.queue:
+			if err := r.write(rec); err != nil {
+				glog.Warningf("Failed to write record to %s: %v", r.opts.File, err)
+				records.Inc("failed")
+				continue
+			}
+			records.Inc("written")
+		}
+	}
+}
+
+func (r *Recorder) write(rec *Record) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(rec); err != nil {
+		return err
+	}
+	line := buf.Bytes()
+	if r.file != nil && r.size+int64(len(line)) > r.opts.MaxBytes && r.size > 0 {
+		if err := r.rotate(); err != nil {
+			return err
+		}
+	}
+	if r.file == nil {
+		var err error
+		if r.file, err = os.OpenFile(r.opts.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600); err != nil {
+			return err
+		}
+		info, err := r.file.Stat()
+		if err != nil {
+			return err
+		}
+		r.size = info.Size()
+	}
+	n, err := r.file.Write(line)
+	r.size += int64(n)
+	return err
+}
+
+// rotate closes the file and shifts it to File.1, the next write opens a
+// new one.
+func (r *Recorder) rotate() error {
+	r.file.Close()
+	r.file, r.size = nil, 0
+	if r.opts.MaxFiles == 0 {
+		return os.Remove(r.opts.File)
+	}
+	os.Remove(fmt.Sprintf("%s.%d", r.opts.File, r.opts.MaxFiles))
+	for i := r.opts.MaxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.opts.File, i), fmt.Sprintf("%s.%d", r.opts.File, i+1))
+	}
+	return os.Rename(r.opts.File, r.opts.File+".1")
+}
+
+// Read calls fn with every record of in, in order.
+func Read(in io.Reader, fn func(*Record) error) error {
+	decoder := json.NewDecoder(in)
+	for {
+		rec := &Record{}
+		if err := decoder.Decode(rec); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package recorder
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// readReasons returns reasons of the records in file, nil if it does not exist.
+func readReasons(t *testing.T, file string) []string {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	var reasons []string
+	if err := Read(bytes.NewReader(data), func(rec *Record) error {
+		reasons = append(reasons, rec.Reason)
+		return nil
+	}); err != nil {
+		t.Fatalf("invalid records in %s: %v", file, err)
+	}
+	return reasons
+}
+
+func TestWriteRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recorder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "admissions.jsonl")
+
+	newRecord := func(i int) *Record {
+		return &Record{Time: time.Unix(0, 0).UTC(), Path: "/add-pod-eni-ip-limit", Decision: "allowed", Reason: fmt.Sprintf("r%d", i), Request: []byte(`{}`)}
+	}
+	line, err := json.Marshal(newRecord(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	maxBytes := int64(2 * (len(line) + 1))
+
+	// every file holds two records
+	r, err := New(Options{File: file, MaxBytes: maxBytes, MaxFiles: 2, SampleRatio: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 7; i++ {
+		if err := r.write(newRecord(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.file.Close()
+	expect := map[string][]string{
+		file:        {"r7"},
+		file + ".1": {"r5", "r6"},
+		file + ".2": {"r3", "r4"},
+		file + ".3": nil,
+	}
+	for f, reasons := range expect {
+		if got := readReasons(t, f); !reflect.DeepEqual(got, reasons) {
+			t.Errorf("expect %v in %s, got %v", reasons, filepath.Base(f), got)
+		}
+	}
+
+	// a new recorder appends to the file, and rotates it once full
+	r, _ = New(Options{File: file, MaxBytes: maxBytes, MaxFiles: 0, SampleRatio: 1})
+	for i := 8; i <= 9; i++ {
+		if err := r.write(newRecord(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.file.Close()
+	if got := readReasons(t, file); !reflect.DeepEqual(got, []string{"r9"}) {
+		t.Errorf("expect [r9] without rotated files, got %v", got)
+	}
+	if got := readReasons(t, file+".1"); !reflect.DeepEqual(got, []string{"r5", "r6"}) {
+		t.Errorf("expect rotated files untouched without max files, got %v", got)
+	}
+}
+
+func TestRecordFilters(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      Options
+		namespace string
+		decision  string
+		recorded  bool
+	}{
+		{"no filter", Options{SampleRatio: 1}, "default", "allowed", true},
+		{"namespace", Options{SampleRatio: 1, Namespaces: []string{"default"}}, "default", "allowed", true},
+		{"other namespace", Options{SampleRatio: 1, Namespaces: []string{"prod"}}, "default", "allowed", false},
+		{"decision", Options{SampleRatio: 1, Decisions: []string{"denied", "error"}}, "default", "denied", true},
+		{"other decision", Options{SampleRatio: 1, Decisions: []string{"denied", "error"}}, "default", "patched", false},
+		{"not sampled", Options{}, "default", "allowed", false},
+	}
+	for _, test := range tests {
+		test.opts.File, test.opts.MaxBytes = "unused", 1
+		r, err := New(test.opts)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		req := &v1beta1.AdmissionRequest{Namespace: test.namespace}
+		response := &v1beta1.AdmissionResponse{Result: &metav1.Status{Message: "denied by test"}}
+		r.Record("/add-pod-eni-ip-limit", req, response, nil, test.decision, "reason", map[string]string{"defaultCNI": "true"})
+		if recorded := len(r.queue) == 1; recorded != test.recorded {
+			t.Errorf("%s: expect recorded %t, got %t", test.name, test.recorded, recorded)
+			continue
+		}
+		if test.recorded {
+			rec := <-r.queue
+			if rec.Denial != "denied by test" || rec.Inputs["defaultCNI"] != "true" {
+				t.Errorf("%s: unexpected record %+v", test.name, rec)
+			}
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{"no file", Options{MaxBytes: 1}},
+		{"no max bytes", Options{File: "f"}},
+		{"negative max files", Options{File: "f", MaxBytes: 1, MaxFiles: -1}},
+		{"sample ratio over 1", Options{File: "f", MaxBytes: 1, SampleRatio: 1.5}},
+	}
+	for _, test := range tests {
+		if _, err := New(test.opts); err == nil {
+			t.Errorf("%s: expect error", test.name)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	mathrand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/metrics"
+
+	"github.com/golang/glog"
+)
+
+var exportedSpans = metrics.NewCounterVec("tracing_spans_total",
+	"Spans of admission requests, by result, one of exported, failed and dropped.", "result")
+
+// maxBatch is the most spans exported in one request, and twice it the most
+// queued, spans are dropped rather than slowing down admissions.
+const maxBatch = 512
+
+// Options of a Tracer.
+type Options struct {
+	// Endpoint is the OTLP/HTTP endpoint of a collector, spans are posted to
+	// its /v1/traces unless it has a path, e.g. http://localhost:4318.
+	Endpoint string
+	// ServiceName is the service.name of spans.
+	ServiceName string
+	// SampleRatio of requests without a sampled trace context to trace,
+	// requests with one follow its sampled flag.
+	SampleRatio float64
+	// Period is how often queued spans are exported.
+	Period time.Duration
+}
+
+// Tracer records spans and exports them in OTLP JSON to a collector. It is
+// a minimal exporter rather than the OpenTelemetry SDK, which is not
+// vendored, and can be replaced by it without changing spans.
+type Tracer struct {
+	url    string
+	opts   Options
+	client *http.Client
+	queue  chan *Span
+}
+
+// NewTracer returns a tracer exporting to opts.Endpoint once Run.
+func NewTracer(opts Options) (*Tracer, error) {
+	url := strings.TrimSuffix(opts.Endpoint, "/")
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, fmt.Errorf("tracing endpoint %q is not an http or https url", opts.Endpoint)
+	}
+	if strings.Count(url, "/") == 2 {
+		url += "/v1/traces"
+	}
+	if opts.SampleRatio < 0 || opts.SampleRatio > 1 {
+		return nil, fmt.Errorf("tracing sample ratio %v is not in [0, 1]", opts.SampleRatio)
+	}
+	return &Tracer{
+		url:    url,
+		opts:   opts,
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan *Span, 2*maxBatch),
+	}, nil
+}
+
+func (t *Tracer) sample() bool {
+	return t.opts.SampleRatio >= 1 || mathrand.Float64() < t.opts.SampleRatio
+}
+
+func (t *Tracer) enqueue(s *Span) {
+	select {
+	case t.queue <- s:
+	default:
+		exportedSpans.Inc("dropped")
+	}
+}
+
+// Run exports queued spans every period until stopCh is closed, the spans
+// queued by then are exported before returning.
+func (t *Tracer) Run(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(t.opts.Period)
+	defer ticker.Stop()
+	var batch []*Span
+	for {
+		select {
+		case <-stopCh:
+			for len(t.queue) > 0 && len(batch) < 2*maxBatch {
+				batch = append(batch, <-t.queue)
+			}
+			t.export(batch)
+			return
+		case s := <-t.queue:
+			if batch = append(batch, s); len(batch) >= maxBatch {
+				t.export(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			t.export(batch)
+			batch = nil
+		}
+	}
+}
+
+func (t *Tracer) export(batch []*Span) {
+	if len(batch) == 0 {
+		return
+	}
+	data, err := json.Marshal(t.request(batch))
+	if err == nil {
+		err = t.post(data)
+	}
+	if err != nil {
+		glog.Warningf("Failed to export %d spans to %s: %v", len(batch), t.url, err)
+		exportedSpans.Add(float64(len(batch)), "failed")
+		return
+	}
+	exportedSpans.Add(float64(len(batch)), "exported")
+}
+
+func (t *Tracer) post(data []byte) error {
+	resp, err := t.client.Post(t.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// The OTLP JSON encoding of spans, ids are hex and 64 bit integers are
+// strings, see opentelemetry-proto.
+type (
+	exportRequest struct {
+		ResourceSpans []resourceSpans `json:"resourceSpans"`
+	}
+	resourceSpans struct {
+		Resource   resource     `json:"resource"`
+		ScopeSpans []scopeSpans `json:"scopeSpans"`
+	}
+	resource struct {
+		Attributes []keyValue `json:"attributes"`
+	}
+	scopeSpans struct {
+		Scope scope      `json:"scope"`
+		Spans []spanData `json:"spans"`
+	}
+	scope struct {
+		Name string `json:"name"`
+	}
+	spanData struct {
+		TraceID           string     `json:"traceId"`
+		SpanID            string     `json:"spanId"`
+		ParentSpanID      string     `json:"parentSpanId,omitempty"`
+		Name              string     `json:"name"`
+		Kind              int        `json:"kind"`
+		StartTimeUnixNano string     `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+		Attributes        []keyValue `json:"attributes,omitempty"`
+		Status            *status    `json:"status,omitempty"`
+	}
+	status struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+	keyValue struct {
+		Key   string   `json:"key"`
+		Value anyValue `json:"value"`
+	}
+	anyValue struct {
+		StringValue *string  `json:"stringValue,omitempty"`
+		BoolValue   *bool    `json:"boolValue,omitempty"`
+		IntValue    *string  `json:"intValue,omitempty"`
+		DoubleValue *float64 `json:"doubleValue,omitempty"`
+	}
+)
+
+// statusError is STATUS_CODE_ERROR.
+const statusError = 2
+
+func (t *Tracer) request(batch []*Span) exportRequest {
+	spans := make([]spanData, 0, len(batch))
+	for _, s := range batch {
+		s.mu.Lock()
+		data := spanData{
+			TraceID:           hex.EncodeToString(s.context.TraceID[:]),
+			SpanID:            hex.EncodeToString(s.context.SpanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parent != [8]byte{} {
+			data.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		for _, key := range s.keys {
+			data.Attributes = append(data.Attributes, keyValue{Key: key, Value: toAnyValue(s.attributes[key])})
+		}
+		if s.errMessage != "" {
+			data.Status = &status{Code: statusError, Message: s.errMessage}
+		}
+		s.mu.Unlock()
+		spans = append(spans, data)
+	}
+	service := t.opts.ServiceName
+	return exportRequest{ResourceSpans: []resourceSpans{{
+		Resource:   resource{Attributes: []keyValue{{Key: "service.name", Value: anyValue{StringValue: &service}}}},
+		ScopeSpans: []scopeSpans{{Scope: scope{Name: service}, Spans: spans}},
+	}}}
+}
+
+func toAnyValue(v interface{}) anyValue {
+	switch value := v.(type) {
+	case string:
+		return anyValue{StringValue: &value}
+	case bool:
+		return anyValue{BoolValue: &value}
+	case int:
+		s := strconv.Itoa(value)
+		return anyValue{IntValue: &s}
+	case int64:
+		s := strconv.FormatInt(value, 10)
+		return anyValue{IntValue: &s}
+	case float64:
+		return anyValue{DoubleValue: &value}
+	}
+	s := fmt.Sprint(v)
+	return anyValue{StringValue: &s}
+}
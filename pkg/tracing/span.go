@@ -0,0 +1,176 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceparentHeader carries the W3C trace context of incoming requests.
+const TraceparentHeader = "traceparent"
+
+// Kinds of spans, as numbered by OTLP.
+const (
+	KindInternal = 1
+	KindServer   = 2
+)
+
+// SpanContext identifies a span across processes.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// ParseTraceparent parses a W3C traceparent header of version 00, e.g.
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.
+func ParseTraceparent(header string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) != 4 || parts[0] != "00" {
+		return sc, fmt.Errorf("unsupported traceparent %q", header)
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, fmt.Errorf("invalid traceparent %q", header)
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, fmt.Errorf("invalid trace id in traceparent %q", header)
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, fmt.Errorf("invalid span id in traceparent %q", header)
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return sc, fmt.Errorf("invalid flags in traceparent %q", header)
+	}
+	if sc.TraceID == [16]byte{} || sc.SpanID == [8]byte{} {
+		return sc, fmt.Errorf("all zero ids in traceparent %q", header)
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, nil
+}
+
+// Span is a timed operation of an admission request. A nil span records
+// nothing, so callers need not check whether tracing is enabled.
+type Span struct {
+	tracer  *Tracer
+	name    string
+	kind    int
+	context SpanContext
+	parent  [8]byte
+	start   time.Time
+
+	mu         sync.Mutex
+	end        time.Time
+	attributes map[string]interface{}
+	keys       []string
+	errMessage string
+}
+
+type spanKey struct{}
+
+// FromContext returns the span of ctx, nil if none.
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// Start starts a child of the span of ctx, it records nothing if ctx has no
+// span.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	parent := FromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	span := parent.tracer.newSpan(name, KindInternal, parent.context.TraceID, parent.context.SpanID)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// SetAttribute sets an attribute of string, bool, integer or float value.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.attributes[key]; !ok {
+		s.keys = append(s.keys, key)
+	}
+	s.attributes[key] = value
+}
+
+// SetError marks the span failed with message.
+func (s *Span) SetError(message string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.errMessage = message
+	s.mu.Unlock()
+}
+
+// End ends the span and queues it for export, later calls do nothing.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	ended := !s.end.IsZero()
+	if !ended {
+		s.end = time.Now()
+	}
+	s.mu.Unlock()
+	if !ended {
+		s.tracer.enqueue(s)
+	}
+}
+
+// StartRequest starts the server span of r, a child of the trace context
+// in its headers if any. It records nothing if t is nil or the trace is not
+// sampled.
+func (t *Tracer) StartRequest(r *http.Request, name string) (context.Context, *Span) {
+	ctx := r.Context()
+	if t == nil {
+		return ctx, nil
+	}
+	var traceID [16]byte
+	var parent [8]byte
+	if header := r.Header.Get(TraceparentHeader); header != "" {
+		sc, err := ParseTraceparent(header)
+		if err == nil {
+			if !sc.Sampled {
+				return ctx, nil
+			}
+			traceID, parent = sc.TraceID, sc.SpanID
+		}
+	}
+	if traceID == [16]byte{} {
+		if !t.sample() {
+			return ctx, nil
+		}
+		rand.Read(traceID[:])
+	}
+	span := t.newSpan(name, KindServer, traceID, parent)
+	span.SetAttribute("http.method", r.Method)
+	span.SetAttribute("http.target", r.URL.Path)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func (t *Tracer) newSpan(name string, kind int, traceID [16]byte, parent [8]byte) *Span {
+	span := &Span{
+		tracer:     t,
+		name:       name,
+		kind:       kind,
+		context:    SpanContext{TraceID: traceID, Sampled: true},
+		parent:     parent,
+		start:      time.Now(),
+		attributes: make(map[string]interface{}),
+	}
+	rand.Read(span.context.SpanID[:])
+	return span
+}
@@ -0,0 +1,48 @@
+package tracing
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		header    string
+		traceID   string
+		spanID    string
+		sampled   bool
+		expectErr bool
+	}{
+		{header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", traceID: "4bf92f3577b34da6a3ce929d0e0e4736", spanID: "00f067aa0ba902b7", sampled: true},
+		{header: " 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00 ", traceID: "4bf92f3577b34da6a3ce929d0e0e4736", spanID: "00f067aa0ba902b7"},
+		{header: "00-4BF92F3577B34DA6A3CE929D0E0E4736-00F067AA0BA902B7-03", traceID: "4bf92f3577b34da6a3ce929d0e0e4736", spanID: "00f067aa0ba902b7", sampled: true},
+		{header: "", expectErr: true},
+		{header: "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", expectErr: true},
+		{header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", expectErr: true},
+		{header: "00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01", expectErr: true},
+		{header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902-01", expectErr: true},
+		{header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-1", expectErr: true},
+		{header: "00-zzf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", expectErr: true},
+		{header: "00-4bf92f3577b34da6a3ce929d0e0e4736-zzf067aa0ba902b7-01", expectErr: true},
+		{header: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-zz", expectErr: true},
+		{header: "00-00000000000000000000000000000000-00f067aa0ba902b7-01", expectErr: true},
+		{header: "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", expectErr: true},
+	}
+	for _, test := range tests {
+		sc, err := ParseTraceparent(test.header)
+		if test.expectErr {
+			if err == nil {
+				t.Errorf("%q: expect error, got %+v", test.header, sc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.header, err)
+			continue
+		}
+		traceID, spanID := hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:])
+		if traceID != test.traceID || spanID != test.spanID || sc.Sampled != test.sampled {
+			t.Errorf("%q: expect %s %s sampled %t, got %s %s %t", test.header, test.traceID, test.spanID, test.sampled, traceID, spanID, sc.Sampled)
+		}
+	}
+}
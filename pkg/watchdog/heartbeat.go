@@ -0,0 +1,54 @@
+package watchdog
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+	coordinationv1beta1 "k8s.io/api/coordination/v1beta1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Heartbeat renews the lease namespace/name every period while healthy
+// returns true, until stopCh is closed. Every healthy replica renews the same
+// lease, it goes stale only when none is healthy.
+func Heartbeat(client kubernetes.Interface, namespace, name, identity string, period time.Duration, healthy func() bool, stopCh <-chan struct{}) {
+	glog.Infof("Renewing heartbeat lease %s/%s every %s", namespace, name, period)
+	wait.Until(func() {
+		if !healthy() {
+			glog.Warningf("Not healthy, skip renewing heartbeat lease %s/%s", namespace, name)
+			return
+		}
+		if err := renew(client, namespace, name, identity, period); err != nil {
+			glog.Warningf("Failed to renew heartbeat lease %s/%s: %v", namespace, name, err)
+		}
+	}, period, stopCh)
+}
+
+func renew(client kubernetes.Interface, namespace, name, identity string, period time.Duration) error {
+	leases := client.CoordinationV1beta1().Leases(namespace)
+	now := metav1.NewMicroTime(time.Now())
+	duration := int32(3 * period / time.Second)
+	lease, err := leases.Get(name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		_, err = leases.Create(&coordinationv1beta1.Lease{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+			Spec: coordinationv1beta1.LeaseSpec{
+				HolderIdentity:       &identity,
+				LeaseDurationSeconds: &duration,
+				RenewTime:            &now,
+			},
+		})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	lease.Spec.HolderIdentity = &identity
+	lease.Spec.LeaseDurationSeconds = &duration
+	lease.Spec.RenewTime = &now
+	_, err = leases.Update(lease)
+	return err
+}
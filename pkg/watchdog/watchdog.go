@@ -0,0 +1,165 @@
+package watchdog
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/events"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/metrics"
+
+	"github.com/golang/glog"
+	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+// FailurePoliciesAnnotation records the failure policies of webhooks before
+// they are flipped to Ignore, so that they can be restored.
+const FailurePoliciesAnnotation = "tke.cloud.tencent.com/eni-ip-watchdog-failure-policies"
+
+// Reasons of events raised on the webhook configuration.
+const (
+	ReasonIgnored  = "FailurePolicyIgnored"
+	ReasonRestored = "FailurePolicyRestored"
+)
+
+var tripped = metrics.NewGaugeVec("watchdog_tripped",
+	"Whether failure policies of the webhook configuration are flipped to Ignore.", "configuration")
+
+// Options of the watchdog.
+type Options struct {
+	LeaseNamespace string
+	LeaseName      string
+	// Configuration is the name of the MutatingWebhookConfiguration.
+	Configuration string
+	// StaleAfter is how long the lease may go without renewal before the
+	// failure policies are flipped to Ignore.
+	StaleAfter time.Duration
+	// Period between two checks.
+	Period time.Duration
+}
+
+// Watchdog flips failure policies of the webhook configuration to Ignore when
+// no webhook replica renews the heartbeat lease, so that a broken webhook
+// does not block every pod creation, and restores them once one does.
+type Watchdog struct {
+	client   kubernetes.Interface
+	recorder *events.Recorder
+	opts     Options
+
+	// observedVersion and observedTime avoid depending on clock skew with
+	// webhook replicas, the lease is stale StaleAfter after it is seen changing.
+	observedVersion string
+	observedTime    time.Time
+}
+
+// New returns a watchdog of the lease and webhook configuration in opts.
+func New(client kubernetes.Interface, recorder *events.Recorder, opts Options) *Watchdog {
+	return &Watchdog{client: client, recorder: recorder, opts: opts}
+}
+
+// Run checks the lease every period until stopCh is closed.
+func (w *Watchdog) Run(stopCh <-chan struct{}) {
+	w.observedTime = time.Now()
+	glog.Infof("Watching heartbeat lease %s/%s of %s every %s", w.opts.LeaseNamespace, w.opts.LeaseName, w.opts.Configuration, w.opts.Period)
+	wait.Until(w.check, w.opts.Period, stopCh)
+}
+
+func (w *Watchdog) check() {
+	lease, err := w.client.CoordinationV1beta1().Leases(w.opts.LeaseNamespace).Get(w.opts.LeaseName, metav1.GetOptions{})
+	var holder string
+	if err == nil {
+		if lease.ResourceVersion != w.observedVersion {
+			w.observedVersion, w.observedTime = lease.ResourceVersion, time.Now()
+		}
+		if lease.Spec.HolderIdentity != nil {
+			holder = *lease.Spec.HolderIdentity
+		}
+	} else if !k8serrors.IsNotFound(err) {
+		// can not tell whether the webhook is healthy, leave it alone
+		glog.Warningf("Failed to get heartbeat lease %s/%s: %v", w.opts.LeaseNamespace, w.opts.LeaseName, err)
+		return
+	}
+
+	since := time.Since(w.observedTime)
+	if since <= w.opts.StaleAfter {
+		w.flip(false, fmt.Sprintf("heartbeat lease %s/%s is renewed by %s again", w.opts.LeaseNamespace, w.opts.LeaseName, holder))
+		return
+	}
+	why := fmt.Sprintf("heartbeat lease %s/%s is not renewed for %s", w.opts.LeaseNamespace, w.opts.LeaseName, since.Truncate(time.Second))
+	if holder != "" {
+		why += fmt.Sprintf(", last by %s", holder)
+	}
+	w.flip(true, why)
+}
+
+// flip sets failure policies of all webhooks to Ignore, or restores them.
+// Nothing is done if they are flipped already.
+func (w *Watchdog) flip(ignore bool, why string) {
+	configurations := w.client.AdmissionregistrationV1beta1().MutatingWebhookConfigurations()
+	mwc, err := configurations.Get(w.opts.Configuration, metav1.GetOptions{})
+	if err != nil {
+		glog.Warningf("Failed to get mutating webhook configuration %s: %v", w.opts.Configuration, err)
+		return
+	}
+	saved, flipped := mwc.Annotations[FailurePoliciesAnnotation]
+	tripped.Set(metrics.BoolToFloat(flipped), w.opts.Configuration)
+	if ignore == flipped {
+		return
+	}
+
+	if ignore {
+		policies := make(map[string]admissionregistrationv1beta1.FailurePolicyType)
+		ignorePolicy := admissionregistrationv1beta1.Ignore
+		for i := range mwc.Webhooks {
+			// v1beta1 defaults to Ignore, but apiservers fill it in
+			policy := admissionregistrationv1beta1.Ignore
+			if mwc.Webhooks[i].FailurePolicy != nil {
+				policy = *mwc.Webhooks[i].FailurePolicy
+			}
+			policies[mwc.Webhooks[i].Name] = policy
+			mwc.Webhooks[i].FailurePolicy = &ignorePolicy
+		}
+		data, _ := json.Marshal(policies)
+		if mwc.Annotations == nil {
+			mwc.Annotations = make(map[string]string)
+		}
+		mwc.Annotations[FailurePoliciesAnnotation] = string(data)
+	} else {
+		var policies map[string]admissionregistrationv1beta1.FailurePolicyType
+		if err := json.Unmarshal([]byte(saved), &policies); err != nil {
+			glog.Errorf("Invalid %s of mutating webhook configuration %s, restore failure policies by hand: %v", FailurePoliciesAnnotation, w.opts.Configuration, err)
+			return
+		}
+		for i := range mwc.Webhooks {
+			if policy, ok := policies[mwc.Webhooks[i].Name]; ok {
+				policy := policy
+				mwc.Webhooks[i].FailurePolicy = &policy
+			}
+		}
+		delete(mwc.Annotations, FailurePoliciesAnnotation)
+	}
+	if _, err := configurations.Update(mwc); err != nil {
+		glog.Warningf("Failed to update mutating webhook configuration %s, will retry: %v", w.opts.Configuration, err)
+		return
+	}
+	tripped.Set(metrics.BoolToFloat(ignore), w.opts.Configuration)
+
+	ref := &corev1.ObjectReference{
+		APIVersion: admissionregistrationv1beta1.SchemeGroupVersion.String(),
+		Kind:       "MutatingWebhookConfiguration",
+		Name:       mwc.Name,
+		UID:        mwc.UID,
+	}
+	if ignore {
+		glog.Warningf("Flipped failure policies of %s to Ignore: %s", w.opts.Configuration, why)
+		w.recorder.Eventf(ref, corev1.EventTypeWarning, ReasonIgnored, "Flipped failure policies to Ignore, %s", why)
+	} else {
+		glog.Infof("Restored failure policies of %s: %s", w.opts.Configuration, why)
+		w.recorder.Eventf(ref, corev1.EventTypeNormal, ReasonRestored, "Restored failure policies %s, %s", saved, why)
+	}
+}
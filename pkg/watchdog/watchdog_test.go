@@ -0,0 +1,224 @@
+package watchdog
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/events"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/metrics"
+
+	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
+	coordinationv1beta1 "k8s.io/api/coordination/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	admissionregistrationv1beta1client "k8s.io/client-go/kubernetes/typed/admissionregistration/v1beta1"
+	coordinationv1beta1client "k8s.io/client-go/kubernetes/typed/coordination/v1beta1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// fakeClient serves the heartbeat lease and the webhook configuration and
+// records updates of the configuration and event reasons, other calls panic.
+type fakeClient struct {
+	kubernetes.Interface
+	// lease is nil if not found, leaseErr fails getting it.
+	lease    *coordinationv1beta1.Lease
+	leaseErr error
+	mwc      *admissionregistrationv1beta1.MutatingWebhookConfiguration
+	updates  int
+	reasons  []string
+}
+
+func (c *fakeClient) CoreV1() corev1client.CoreV1Interface {
+	return fakeCoreV1{client: c}
+}
+
+func (c *fakeClient) CoordinationV1beta1() coordinationv1beta1client.CoordinationV1beta1Interface {
+	return fakeCoordination{client: c}
+}
+
+func (c *fakeClient) AdmissionregistrationV1beta1() admissionregistrationv1beta1client.AdmissionregistrationV1beta1Interface {
+	return fakeAdmissionregistration{client: c}
+}
+
+type fakeCoreV1 struct {
+	corev1client.CoreV1Interface
+	client *fakeClient
+}
+
+func (c fakeCoreV1) Events(namespace string) corev1client.EventInterface {
+	return fakeEvents{client: c.client}
+}
+
+type fakeEvents struct {
+	corev1client.EventInterface
+	client *fakeClient
+}
+
+func (e fakeEvents) Create(event *corev1.Event) (*corev1.Event, error) {
+	e.client.reasons = append(e.client.reasons, event.Reason)
+	return event, nil
+}
+
+type fakeCoordination struct {
+	coordinationv1beta1client.CoordinationV1beta1Interface
+	client *fakeClient
+}
+
+func (f fakeCoordination) Leases(namespace string) coordinationv1beta1client.LeaseInterface {
+	return fakeLeases{client: f.client}
+}
+
+type fakeLeases struct {
+	coordinationv1beta1client.LeaseInterface
+	client *fakeClient
+}
+
+func (l fakeLeases) Get(name string, options metav1.GetOptions) (*coordinationv1beta1.Lease, error) {
+	if l.client.leaseErr != nil {
+		return nil, l.client.leaseErr
+	}
+	if l.client.lease == nil {
+		return nil, k8serrors.NewNotFound(schema.GroupResource{Group: "coordination.k8s.io", Resource: "leases"}, name)
+	}
+	return l.client.lease.DeepCopy(), nil
+}
+
+type fakeAdmissionregistration struct {
+	admissionregistrationv1beta1client.AdmissionregistrationV1beta1Interface
+	client *fakeClient
+}
+
+func (a fakeAdmissionregistration) MutatingWebhookConfigurations() admissionregistrationv1beta1client.MutatingWebhookConfigurationInterface {
+	return fakeConfigurations{client: a.client}
+}
+
+type fakeConfigurations struct {
+	admissionregistrationv1beta1client.MutatingWebhookConfigurationInterface
+	client *fakeClient
+}
+
+func (c fakeConfigurations) Get(name string, options metav1.GetOptions) (*admissionregistrationv1beta1.MutatingWebhookConfiguration, error) {
+	if c.client.mwc.Name != name {
+		return nil, k8serrors.NewNotFound(schema.GroupResource{Group: "admissionregistration.k8s.io", Resource: "mutatingwebhookconfigurations"}, name)
+	}
+	return c.client.mwc.DeepCopy(), nil
+}
+
+func (c fakeConfigurations) Update(mwc *admissionregistrationv1beta1.MutatingWebhookConfiguration) (*admissionregistrationv1beta1.MutatingWebhookConfiguration, error) {
+	c.client.updates++
+	c.client.mwc = mwc.DeepCopy()
+	return mwc, nil
+}
+
+func heartbeat(version, holder string) *coordinationv1beta1.Lease {
+	return &coordinationv1beta1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "heartbeat", ResourceVersion: version},
+		Spec:       coordinationv1beta1.LeaseSpec{HolderIdentity: &holder},
+	}
+}
+
+// policies returns the failure policies of webhooks of mwc, "" for unset.
+func policies(mwc *admissionregistrationv1beta1.MutatingWebhookConfiguration) string {
+	var p []string
+	for _, webhook := range mwc.Webhooks {
+		policy := ""
+		if webhook.FailurePolicy != nil {
+			policy = string(*webhook.FailurePolicy)
+		}
+		p = append(p, webhook.Name+"="+policy)
+	}
+	return strings.Join(p, ",")
+}
+
+func trippedSample() string {
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if strings.Contains(line, `watchdog_tripped{configuration="add-pod-eni-ip-limit-webhook"}`) {
+			return line[strings.LastIndex(line, " ")+1:]
+		}
+	}
+	return ""
+}
+
+func TestCheck(t *testing.T) {
+	fail := admissionregistrationv1beta1.Fail
+	client := &fakeClient{
+		lease: heartbeat("1", "webhook-0"),
+		mwc: &admissionregistrationv1beta1.MutatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: "add-pod-eni-ip-limit-webhook"},
+			Webhooks: []admissionregistrationv1beta1.Webhook{
+				{Name: "pods.tke.cloud.tencent.com", FailurePolicy: &fail},
+				{Name: "templates.tke.cloud.tencent.com"},
+			},
+		},
+	}
+	w := New(client, events.NewRecorder(client, "test"), Options{
+		LeaseNamespace: "kube-system",
+		LeaseName:      "heartbeat",
+		Configuration:  "add-pod-eni-ip-limit-webhook",
+		StaleAfter:     time.Minute,
+		Period:         time.Second,
+	})
+	w.observedTime = time.Now()
+	original := "pods.tke.cloud.tencent.com=Fail,templates.tke.cloud.tencent.com="
+	flipped := "pods.tke.cloud.tencent.com=Ignore,templates.tke.cloud.tencent.com=Ignore"
+	restored := "pods.tke.cloud.tencent.com=Fail,templates.tke.cloud.tencent.com=Ignore"
+
+	steps := []struct {
+		name string
+		// stale moves the last observed renewal of the lease back past StaleAfter.
+		stale    bool
+		lease    *coordinationv1beta1.Lease
+		leaseErr error
+		// annotation overwrites the saved failure policies if not empty.
+		annotation string
+
+		policies string
+		updates  int
+		reasons  []string
+		tripped  string
+	}{
+		{name: "renewed", lease: heartbeat("1", "webhook-0"), policies: original, tripped: "0"},
+		{name: "renewed again", lease: heartbeat("2", "webhook-1"), policies: original, tripped: "0"},
+		{name: "stale", stale: true, lease: heartbeat("2", "webhook-1"), policies: flipped, updates: 1, reasons: []string{ReasonIgnored}, tripped: "1"},
+		{name: "still stale", stale: true, lease: heartbeat("2", "webhook-1"), policies: flipped, tripped: "1"},
+		{name: "unknown", stale: true, leaseErr: fmt.Errorf("connection refused"), policies: flipped, tripped: "1"},
+		{name: "restored", lease: heartbeat("3", "webhook-1"), policies: restored, updates: 1, reasons: []string{ReasonRestored}, tripped: "0"},
+		{name: "unknown while healthy", stale: true, leaseErr: fmt.Errorf("connection refused"), policies: restored, tripped: "0"},
+		{name: "lease not found", stale: true, policies: flipped, updates: 1, reasons: []string{ReasonIgnored}, tripped: "1"},
+		{name: "invalid annotation", lease: heartbeat("4", "webhook-0"), annotation: "{", policies: flipped, tripped: "1"},
+	}
+	for _, step := range steps {
+		client.lease, client.leaseErr = step.lease, step.leaseErr
+		client.updates, client.reasons = 0, nil
+		if step.annotation != "" {
+			client.mwc.Annotations[FailurePoliciesAnnotation] = step.annotation
+		}
+		if step.stale {
+			w.observedTime = time.Now().Add(-2 * w.opts.StaleAfter)
+		}
+		w.check()
+
+		if p := policies(client.mwc); p != step.policies {
+			t.Errorf("%s: failure policies %s, want %s", step.name, p, step.policies)
+		}
+		_, annotated := client.mwc.Annotations[FailurePoliciesAnnotation]
+		if ignored := step.policies == flipped; annotated != ignored {
+			t.Errorf("%s: annotated %t with failure policies ignored %t", step.name, annotated, ignored)
+		}
+		if client.updates != step.updates || strings.Join(client.reasons, ",") != strings.Join(step.reasons, ",") {
+			t.Errorf("%s: %d updates with events %v, want %d with %v", step.name, client.updates, client.reasons, step.updates, step.reasons)
+		}
+		if tripped := trippedSample(); tripped != step.tripped {
+			t.Errorf("%s: tripped %s, want %s", step.name, tripped, step.tripped)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	wenhookconfig "github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/config"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/configfile"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/https"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/node"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/readiness"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+var (
+	// flagConfig is config before the configuration file is applied, every
+	// change of the file is applied over it.
+	flagConfig Config
+	// configData is the configuration file in effect on startup.
+	configData []byte
+)
+
+// loadConfigFile applies the configuration file over flags, an invalid file
+// is fatal on startup.
+func loadConfigFile() {
+	flagConfig = config
+	if config.ConfigFile == "" {
+		return
+	}
+	f, data, err := configfile.Load(config.ConfigFile)
+	if err != nil {
+		glog.Fatalf("Failed to load configuration %s: %v", config.ConfigFile, err)
+	}
+	configData = data
+	config.applyFile(f)
+}
+
+// applyFile overrides flags set by f.
+func (c *Config) applyFile(f *configfile.File) {
+	if f.TLS != nil && f.TLS.CertFile != "" {
+		c.CertFile, c.KeyFile = f.TLS.CertFile, f.TLS.KeyFile
+	}
+	if f.DefaultCNI != nil {
+		if f.DefaultCNI.PresetMode != nil {
+			c.PresetMode = *f.DefaultCNI.PresetMode
+		}
+		if f.DefaultCNI.Value != nil {
+			c.DefaultCNI = *f.DefaultCNI.Value
+		}
+	}
+	if f.Resource != nil {
+		c.Resource, c.Quantity = f.Resource.Name, f.Resource.Quantity
+	}
+	if e := f.Exclusions; e != nil {
+		if e.ProtectedNamespaces != nil {
+			c.ProtectedNamespaces = strings.Join(e.ProtectedNamespaces, ",")
+		}
+		if e.VirtualNodeSelectors != nil {
+			c.VirtualNodeSelectors = strings.Join(e.VirtualNodeSelectors, ",")
+		}
+		if e.VirtualNodeTolerations != nil {
+			c.VirtualNodeTolerations = strings.Join(e.VirtualNodeTolerations, ",")
+		}
+		if e.VirtualNodeAnnotations != nil {
+			c.VirtualNodeAnnotations = strings.Join(e.VirtualNodeAnnotations, ",")
+		}
+	}
+	if f.ErrorPolicy != nil {
+		if f.ErrorPolicy.NodeCheck != "" {
+			c.NodeCheck = f.ErrorPolicy.NodeCheck
+		}
+		if f.ErrorPolicy.HeadroomCheck != "" {
+			c.HeadroomCheck = f.ErrorPolicy.HeadroomCheck
+		}
+	}
+	if f.PinNetworks != nil {
+		c.PinNetworks = *f.PinNetworks
+	}
+	if f.StripStale != nil {
+		c.StripStale = *f.StripStale
+	}
+}
+
+// validate checks values of c which are not checked by their packages.
+func (c *Config) validate() error {
+	switch c.NodeCheck {
+	case "", https.NodeCheckOff, https.NodeCheckSkip, https.NodeCheckReject:
+	default:
+		return fmt.Errorf("unknown node-check %q, expect one of off, skip and reject", c.NodeCheck)
+	}
+	switch c.HeadroomCheck {
+	case "", https.HeadroomCheckOff, https.HeadroomCheckWarn, https.HeadroomCheckReject:
+	default:
+		return fmt.Errorf("unknown headroom-check %q, expect one of off, warn and reject", c.HeadroomCheck)
+	}
+	// loops run every period, a non positive one makes them busy loops
+	periods := []struct {
+		flag   string
+		period time.Duration
+	}{
+		{"reconcile-period", c.ReconcilePeriod},
+		{"protection-check-period", c.ProtectionCheckPeriod},
+		{"policy-status-period", c.PolicyStatusPeriod},
+		{"heartbeat-period", c.HeartbeatPeriod},
+		{"capacity-period", c.CapacityPeriod},
+		{"config-check-period", c.ConfigCheckPeriod},
+	}
+	for _, p := range periods {
+		if p.period <= 0 {
+			return fmt.Errorf("%s must be positive, got %v", p.flag, p.period)
+		}
+	}
+	if c.HeartbeatLeaseName != "" && c.HeartbeatCAFile == "" {
+		return fmt.Errorf("heartbeat-lease-name needs heartbeat-ca-file to verify the serving certificate as the apiserver does")
+	}
+	if c.ReadinessGate != "" {
+		if _, err := c.readinessOptions(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readinessOptions returns the options of the readiness gate controller,
+// pods are only added the readiness gate if they are valid.
+func (c *Config) readinessOptions() (readiness.Options, error) {
+	cidrs, err := readiness.ParseCIDRs(c.ENICIDRs)
+	if err != nil {
+		return readiness.Options{}, fmt.Errorf("invalid eni-cidrs: %v", err)
+	}
+	if len(cidrs) == 0 && c.ENICIDRsNodeAnnotation == "" {
+		return readiness.Options{}, fmt.Errorf("readiness-gate needs eni-cidrs or eni-cidrs-node-annotation, pods never become ready otherwise")
+	}
+	return readiness.Options{
+		ConditionType:  corev1.PodConditionType(c.ReadinessGate),
+		CIDRs:          cidrs,
+		NodeAnnotation: c.ENICIDRsNodeAnnotation,
+	}, nil
+}
+
+// serverOptions returns the options of c over the dependencies of wh.
+// Dependencies started on startup, like informers, are never started later,
+// so enabling what needs them requires a restart.
+func (wh *webhook) serverOptions(c Config) (https.Options, error) {
+	if err := c.validate(); err != nil {
+		return https.Options{}, err
+	}
+	opts := wh.options
+	opts.PinNetworks = c.PinNetworks
+	opts.StripStale = c.StripStale
+	// the controller setting the readiness gate only starts on startup
+	if c.ReadinessGate != wh.config.ReadinessGate {
+		return https.Options{}, fmt.Errorf("readiness-gate is %q on startup, changing it needs a restart", wh.config.ReadinessGate)
+	}
+	opts.ReadinessGate = c.ReadinessGate
+	opts.ProtectedNamespaces = c.protectedNamespaces()
+	opts.Resource, opts.Quantity = c.Resource, c.Quantity
+
+	if source := c.cniSource(); source != wh.config.cniSource() {
+		if source.Source != wenhookconfig.SourceValue || wh.config.cniSource().Source != wenhookconfig.SourceValue {
+			return https.Options{}, fmt.Errorf("changing default cni other than its value in preset mode or with default-cni-source=value needs a restart")
+		}
+		state, err := wenhookconfig.Resolve(nil, source, 0, c.DefaultCNI)
+		if err != nil {
+			return https.Options{}, err
+		}
+		opts.DefaultCNI = state
+	}
+	opts.NodeCheck = c.NodeCheck
+	if opts.NodeCheck != "" && opts.NodeCheck != https.NodeCheckOff && opts.NodeEligibility == nil {
+		return https.Options{}, fmt.Errorf("node-check was off on startup, enabling it needs a restart")
+	}
+	opts.HeadroomCheck = c.HeadroomCheck
+	if opts.HeadroomCheck != "" && opts.HeadroomCheck != https.HeadroomCheckOff && opts.Headroom == nil {
+		return https.Options{}, fmt.Errorf("headroom-check was off on startup, enabling it needs a restart")
+	}
+	virtualNodes, err := node.ParseVirtualNodeRules(c.VirtualNodeSelectors, c.VirtualNodeTolerations, c.VirtualNodeAnnotations)
+	if err != nil {
+		return https.Options{}, err
+	}
+	// nodes are only known if started for other checks
+	virtualNodes.Nodes = wh.nodes
+	opts.VirtualNodes = virtualNodes
+	return opts, nil
+}
+
+// reload serves admissions with next and the certificate of next, the
+// configuration in effect is kept if next is invalid.
+func (wh *webhook) reload(next Config, cert *certificate) error {
+	opts, err := wh.serverOptions(next)
+	if err != nil {
+		return err
+	}
+	if err := cert.load(next); err != nil {
+		return err
+	}
+	wh.server.Update(opts)
+	if next.cniSource() != wh.config.cniSource() {
+		glog.Infof("Whether %s is default cni: %t", https.TKERouteENI, opts.DefaultCNI.DefaultCNI())
+	}
+	if namespaces := next.protectedNamespaces(); wh.protection != nil && !reflect.DeepEqual(namespaces, wh.config.protectedNamespaces()) {
+		// namespaceSelectors may not exclude the newly protected namespaces
+		wh.protection.SetNamespaces(namespaces)
+		go wh.protection.Check()
+	}
+	wh.mu.Lock()
+	wh.options, wh.config = opts, next
+	wh.mu.Unlock()
+	return nil
+}
+
+// effective returns the configuration and options in effect.
+func (wh *webhook) effective() (Config, https.Options) {
+	wh.mu.RLock()
+	defer wh.mu.RUnlock()
+	return wh.config, wh.options
+}
+
+// certificate serves the certificate of the configuration in effect.
+type certificate struct {
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	// files and content of cert, to reload it once they change
+	certFile, keyFile string
+	certPEM, keyPEM   []byte
+}
+
+// load reads the certificate of c, the one in effect is kept on errors.
+func (s *certificate) load(c Config) error {
+	certPEM, keyPEM, err := readKeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return err
+	}
+	return s.set(c.CertFile, c.KeyFile, certPEM, keyPEM)
+}
+
+func (s *certificate) set(certFile, keyFile string, certPEM, keyPEM []byte) error {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.cert = &cert
+	s.certFile, s.keyFile = certFile, keyFile
+	s.certPEM, s.keyPEM = certPEM, keyPEM
+	s.mu.Unlock()
+	return nil
+}
+
+func readKeyPair(certFile, keyFile string) ([]byte, []byte, error) {
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certPEM, keyPEM, nil
+}
+
+// run reloads the certificate every period once its files change, e.g. when
+// the secret is renewed, until stopCh is closed.
+func (s *certificate) run(period time.Duration, stopCh <-chan struct{}) {
+	wait.Until(s.check, period, stopCh)
+}
+
+func (s *certificate) check() {
+	s.mu.RLock()
+	certFile, keyFile, loadedCert, loadedKey := s.certFile, s.keyFile, s.certPEM, s.keyPEM
+	s.mu.RUnlock()
+	certPEM, keyPEM, err := readKeyPair(certFile, keyFile)
+	if err != nil {
+		glog.Warningf("Failed to read certificate %s, keep the one in effect: %v", certFile, err)
+		return
+	}
+	if bytes.Equal(certPEM, loadedCert) && bytes.Equal(keyPEM, loadedKey) {
+		return
+	}
+	// the cert and key may be written one after the other, a mismatch is
+	// retried on the next check
+	if err := s.set(certFile, keyFile, certPEM, keyPEM); err != nil {
+		glog.Warningf("Certificate %s is invalid, keep the one in effect: %v", certFile, err)
+		return
+	}
+	glog.Infof("Certificate %s is reloaded", certFile)
+}
+
+func (s *certificate) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cert, nil
+}
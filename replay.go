@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/https"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/recorder"
+
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// replayed is a recorded admission and its decision by this build.
+type replayed struct {
+	Time     string   `json:"time"`
+	Path     string   `json:"path"`
+	Object   string   `json:"object"`
+	Recorded string   `json:"recorded"`
+	Replayed string   `json:"replayed"`
+	Reason   string   `json:"reason,omitempty"`
+	Changes  []string `json:"changes,omitempty"`
+}
+
+// lastDecision keeps the decision of the latest admission, admissions are
+// replayed one at a time.
+type lastDecision struct {
+	response *v1beta1.AdmissionResponse
+	decision string
+	reason   string
+}
+
+func (l *lastDecision) Record(path string, req *v1beta1.AdmissionRequest, response *v1beta1.AdmissionResponse, warnings []string, decision, reason string, inputs map[string]string) {
+	l.response, l.decision, l.reason = response, decision, reason
+}
+
+// recordedNamespace has the recorded default networks of the namespace of an
+// admission.
+type recordedNamespace struct {
+	networks string
+	ok       bool
+}
+
+func (n recordedNamespace) DefaultNetworks(namespace string) (string, bool) { return n.networks, n.ok }
+
+func (n recordedNamespace) Known(namespace string) bool { return true }
+
+// recordedPolicy matches the policy recorded with an admission, policies are
+// not listed offline.
+type recordedPolicy struct {
+	match *https.PolicyMatch
+}
+
+func (p recordedPolicy) Match(namespace string, pod *corev1.Pod, networks []string) (*https.PolicyMatch, string) {
+	return p.match, ""
+}
+
+func (p recordedPolicy) Matched(name string) {}
+
+// recordedOptions returns base with the inputs recorded with an admission,
+// so that it is decided with the default cni, namespace default networks
+// and policy in effect when recorded. Records without inputs use base.
+func recordedOptions(base https.Options, inputs map[string]string) (https.Options, error) {
+	if len(inputs) == 0 {
+		return base, nil
+	}
+	opts := base
+	defaultCNI, err := strconv.ParseBool(inputs[https.InputDefaultCNI])
+	if err != nil {
+		return opts, fmt.Errorf("invalid recorded %s: %v", https.InputDefaultCNI, err)
+	}
+	opts.DefaultCNI = &staticDefaults{defaultCNI: defaultCNI, defaultNetworks: inputs[https.InputDefaultNetworks]}
+	networks, ok := inputs[https.InputNamespaceNetworks]
+	opts.NamespaceDefaults = recordedNamespace{networks: networks, ok: ok}
+	opts.Policies = nil
+	if data, ok := inputs[https.InputPolicy]; ok {
+		match := &https.PolicyMatch{}
+		if err := json.Unmarshal([]byte(data), match); err != nil {
+			return opts, fmt.Errorf("invalid recorded %s: %v", https.InputPolicy, err)
+		}
+		opts.Policies = recordedPolicy{match: match}
+	}
+	return opts, nil
+}
+
+func describeRequest(req *v1beta1.AdmissionRequest) string {
+	name := req.Name
+	if name == "" {
+		var obj struct {
+			Metadata struct {
+				Name         string `json:"name"`
+				GenerateName string `json:"generateName"`
+			} `json:"metadata"`
+		}
+		json.Unmarshal(req.Object.Raw, &obj)
+		if name = obj.Metadata.Name; name == "" {
+			name = obj.Metadata.GenerateName
+		}
+	}
+	if req.Namespace == "" {
+		return fmt.Sprintf("%s %s", req.Kind.Kind, name)
+	}
+	return fmt.Sprintf("%s %s/%s", req.Kind.Kind, req.Namespace, name)
+}
+
+// samePatch returns whether JSON patches a and b are equal, ignoring
+// formatting.
+func samePatch(a, b []byte) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) == len(b)
+	}
+	var x, y interface{}
+	if json.Unmarshal(a, &x) != nil || json.Unmarshal(b, &y) != nil {
+		return string(a) == string(b)
+	}
+	return reflect.DeepEqual(x, y)
+}
+
+func replay(admissions *https.Registry, server *https.ReloadableServer, base https.Options, last *lastDecision, rec *recorder.Record) (*replayed, error) {
+	req := &v1beta1.AdmissionRequest{}
+	if err := json.Unmarshal(rec.Request, req); err != nil {
+		return nil, fmt.Errorf("invalid request recorded at %s: %v", rec.Time.Format(time.RFC3339), err)
+	}
+	opts, err := recordedOptions(base, rec.Inputs)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", rec.Time.Format(time.RFC3339), err)
+	}
+	server.Update(opts)
+	r := &replayed{
+		Time:     rec.Time.Format(time.RFC3339),
+		Path:     rec.Path,
+		Object:   describeRequest(req),
+		Recorded: rec.Decision,
+	}
+	*last = lastDecision{}
+	admissions.Admit(context.Background(), rec.Path, req)
+	if last.response == nil {
+		return nil, fmt.Errorf("%s %s: path %s is not served", r.Time, r.Object, rec.Path)
+	}
+	r.Replayed, r.Reason = last.decision, last.reason
+	var denial string
+	if !last.response.Allowed && last.response.Result != nil {
+		denial = last.response.Result.Message
+	}
+	if r.Replayed != r.Recorded {
+		r.Changes = append(r.Changes, "decision")
+	}
+	if !samePatch(rec.Patch, last.response.Patch) {
+		r.Changes = append(r.Changes, "patch")
+	}
+	if denial != rec.Denial {
+		r.Changes = append(r.Changes, "denial")
+	}
+	return r, nil
+}
+
+// replayCommand admits recorded admissions with this build and reports
+// those decided differently than recorded, e.g. to validate an upgrade
+// against real traffic before rolling it out.
+func replayCommand(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	var files stringSlice
+	var output string
+	var all bool
+	var opts offlineOptions
+	fs.Var(&files, "f", "File of admissions recorded by --record-file, - for stdin, may be given multiple times.")
+	fs.StringVar(&output, "o", "table", "Output format, one of table and json.")
+	fs.BoolVar(&all, "all", false, "Whether to report admissions decided as recorded too.")
+	opts.addFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s replay -f FILE [flags]\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Admissions are decided with the default cni, namespace default networks and EniIPPolicy recorded with them, flags like --virtual-node-selectors should match the webhook which recorded them. Flags like --default-networks only apply to admissions recorded without them.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if len(files) == 0 {
+		fs.Usage()
+		return 2
+	}
+	if output != "table" && output != "json" {
+		fmt.Fprintf(os.Stderr, "unknown output format %q\n", output)
+		return 2
+	}
+
+	base, err := opts.options()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	hs := https.NewReloadableServer(base)
+	admissions := https.NewRegistry()
+	admissions.RegisterMutator("/add-pod-eni-ip-limit", "eni-ip", hs.PodMutator())
+	admissions.RegisterMutator("/add-pod-eni-ip-limit-template", "eni-ip", hs.TemplateMutator())
+	last := &lastDecision{}
+	admissions.SetRecorder(last)
+
+	failed := false
+	total := 0
+	results := []*replayed{}
+	for _, file := range files {
+		err := readRecords(file, func(rec *recorder.Record) error {
+			total++
+			r, err := replay(admissions, hs, base, last, rec)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", file, err)
+				failed = true
+				return nil
+			}
+			if all || len(r.Changes) > 0 {
+				results = append(results, r)
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read %s: %v\n", file, err)
+			return 1
+		}
+	}
+
+	changed := 0
+	for _, r := range results {
+		if len(r.Changes) > 0 {
+			changed++
+		}
+	}
+	if output == "json" {
+		data, _ := json.MarshalIndent(results, "", "  ")
+		fmt.Println(string(data))
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "TIME\tPATH\tOBJECT\tRECORDED\tREPLAYED\tCHANGES\tREASON")
+		for _, r := range results {
+			changes := strings.Join(r.Changes, ",")
+			if changes == "" {
+				changes = "none"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.Time, r.Path, r.Object, r.Recorded, r.Replayed, changes, r.Reason)
+		}
+		w.Flush()
+	}
+	fmt.Fprintf(os.Stderr, "replayed %d admissions, %d decided differently\n", total, changed)
+	if failed || changed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// readRecords calls fn with every record of file, - for stdin.
+func readRecords(file string, fn func(*recorder.Record) error) error {
+	if file == "-" {
+		return recorder.Read(os.Stdin, fn)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return recorder.Read(f, fn)
+}
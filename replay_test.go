@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/https"
+)
+
+func TestSamePatch(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		same bool
+	}{
+		{"both empty", "", "", true},
+		{"one empty", `[]`, "", false},
+		{"formatting", `[{"op":"add","path":"/a","value":1}]`, "[ {\"path\": \"/a\", \"op\": \"add\", \"value\": 1} ]", true},
+		{"other value", `[{"op":"add","path":"/a","value":1}]`, `[{"op":"add","path":"/a","value":2}]`, false},
+		{"other order", `[{"op":"add","path":"/a","value":1},{"op":"remove","path":"/b"}]`, `[{"op":"remove","path":"/b"},{"op":"add","path":"/a","value":1}]`, false},
+		{"not json", `[{`, `[{`, true},
+		{"not json and json", `[{`, `[]`, false},
+	}
+	for _, test := range tests {
+		if same := samePatch([]byte(test.a), []byte(test.b)); same != test.same {
+			t.Errorf("%s: expect %t, got %t", test.name, test.same, same)
+		}
+	}
+}
+
+func TestRecordedOptions(t *testing.T) {
+	base := https.Options{
+		DefaultCNI:        &staticDefaults{defaultCNI: true, defaultNetworks: https.TKERouteENI},
+		NamespaceDefaults: staticNamespaceDefaults{"default": "tke-bridge"},
+	}
+	tests := []struct {
+		name       string
+		inputs     map[string]string
+		defaultCNI bool
+		networks   string
+		namespace  string
+		policy     string
+		expectErr  bool
+	}{
+		{name: "no inputs", defaultCNI: true, networks: https.TKERouteENI, namespace: "tke-bridge"},
+		{
+			name:     "cluster default",
+			inputs:   map[string]string{https.InputDefaultCNI: "false", https.InputDefaultNetworks: "tke-bridge"},
+			networks: "tke-bridge",
+		},
+		{
+			name:       "namespace default",
+			inputs:     map[string]string{https.InputDefaultCNI: "true", https.InputNamespaceNetworks: "tke-route-eni"},
+			defaultCNI: true,
+			namespace:  "tke-route-eni",
+		},
+		{
+			name:       "policy",
+			inputs:     map[string]string{https.InputDefaultCNI: "true", https.InputPolicy: `{"name":"reject","action":"Reject","quantity":"1"}`},
+			defaultCNI: true,
+			policy:     "reject",
+		},
+		{name: "invalid default cni", inputs: map[string]string{https.InputDefaultCNI: "yes please"}, expectErr: true},
+		{name: "invalid policy", inputs: map[string]string{https.InputDefaultCNI: "true", https.InputPolicy: `{`}, expectErr: true},
+	}
+	for _, test := range tests {
+		opts, err := recordedOptions(base, test.inputs)
+		if (err != nil) != test.expectErr {
+			t.Errorf("%s: expect error %t, got %v", test.name, test.expectErr, err)
+			continue
+		}
+		if test.expectErr {
+			continue
+		}
+		if opts.DefaultCNI.DefaultCNI() != test.defaultCNI || opts.DefaultCNI.DefaultNetworks() != test.networks {
+			t.Errorf("%s: expect default cni %t %q, got %t %q", test.name, test.defaultCNI, test.networks,
+				opts.DefaultCNI.DefaultCNI(), opts.DefaultCNI.DefaultNetworks())
+		}
+		if namespace, _ := opts.NamespaceDefaults.DefaultNetworks("default"); namespace != test.namespace {
+			t.Errorf("%s: expect namespace networks %q, got %q", test.name, test.namespace, namespace)
+		}
+		policy := ""
+		if opts.Policies != nil {
+			if m, _ := opts.Policies.Match("default", nil, nil); m != nil {
+				policy = m.Name
+			}
+		}
+		if policy != test.policy {
+			t.Errorf("%s: expect policy %q, got %q", test.name, test.policy, policy)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/https"
+
+	"github.com/golang/glog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// maxSimulateBytes limits the objects posted to /simulate.
+const maxSimulateBytes = 1 << 20
+
+// simulation is the outcome of simulating the admission of one object.
+type simulation struct {
+	Object string `json:"object"`
+	// Decision summarizes the result as mutate -o explain does.
+	Decision string        `json:"decision"`
+	Result   *https.Result `json:"result,omitempty"`
+	// Mutated is the object as admitted, omitted if it is rejected.
+	Mutated json.RawMessage `json:"mutated,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// simulateHandler explains how pods and workloads posted as YAML or JSON
+// would be admitted by explainer, without an AdmissionReview. Objects
+// without a namespace are taken as in ?namespace, default by default.
+func simulateHandler(explainer https.HttpsServer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST pods or workloads as YAML or JSON", http.StatusMethodNotAllowed)
+			return
+		}
+		namespace := r.URL.Query().Get("namespace")
+		if namespace == "" {
+			namespace = metav1.NamespaceDefault
+		}
+		objects, err := readObjects(io.LimitReader(r.Body, maxSimulateBytes))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid objects: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		simulations := []simulation{}
+		for _, o := range objects {
+			o := o
+			var result *https.Result
+			if o.err == nil {
+				result, o.err = explainer.Explain(namespace, o.obj)
+			}
+			sim := simulation{Object: o.describe(), Decision: explain(&o, result), Result: result}
+			if o.err != nil {
+				sim.Error = o.err.Error()
+			} else if result.Rejection == "" {
+				sim.Mutated = json.RawMessage(o.raw)
+				if result.Patch != nil {
+					if sim.Mutated, err = applyManifestPatch(o.raw, result.Patch); err != nil {
+						sim.Mutated, sim.Error = nil, fmt.Sprintf("patch does not apply: %v", err)
+					}
+				}
+			}
+			simulations = append(simulations, sim)
+		}
+
+		data, err := json.MarshalIndent(map[string][]simulation{"items": simulations}, "", "  ")
+		if err == nil && r.URL.Query().Get("output") == "yaml" {
+			w.Header().Set("Content-Type", "application/yaml")
+			data, err = yaml.JSONToYAML(data)
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if _, err := io.Copy(w, bytes.NewReader(data)); err != nil {
+			glog.Warningf("Failed to write simulation: %v", err)
+		}
+	})
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/https"
+)
+
+const simulatedObjects = `apiVersion: v1
+kind: Pod
+metadata:
+  name: route-eni
+spec:
+  containers:
+  - name: c
+---
+apiVersion: v1
+kind: Pod
+metadata:
+  name: bridge
+  namespace: team-a
+spec:
+  containers:
+  - name: c
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+      - name: c
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+`
+
+func TestSimulateHandler(t *testing.T) {
+	handler := simulateHandler(https.NewHttpsServer(https.Options{
+		DefaultCNI:        &staticDefaults{defaultCNI: true, defaultNetworks: https.TKERouteENI},
+		NamespaceDefaults: staticNamespaceDefaults{"team-a": "tke-bridge"},
+	}))
+	tests := []struct {
+		name        string
+		method      string
+		query       string
+		body        string
+		code        int
+		contentType string
+		// decisions of the simulated objects, prefixes of them
+		decisions []string
+		// mutated is whether each object is returned mutated
+		mutated []bool
+	}{
+		{
+			name:        "objects",
+			method:      http.MethodPost,
+			body:        simulatedObjects,
+			code:        http.StatusOK,
+			contentType: "application/json",
+			decisions:   []string{"inject tke.cloud.tencent.com/eni-ip", "skip, not tke-route-eni", "inject tke.cloud.tencent.com/eni-ip", "error: "},
+			mutated:     []bool{true, true, true, false},
+		},
+		{
+			name:        "namespace of query",
+			method:      http.MethodPost,
+			query:       "?namespace=team-a",
+			body:        simulatedObjects,
+			code:        http.StatusOK,
+			contentType: "application/json",
+			decisions:   []string{"skip, not tke-route-eni", "skip, not tke-route-eni", "skip, not tke-route-eni", "error: "},
+			mutated:     []bool{true, true, true, false},
+		},
+		{name: "yaml", method: http.MethodPost, query: "?output=yaml", body: simulatedObjects, code: http.StatusOK, contentType: "application/yaml"},
+		{name: "get", method: http.MethodGet, code: http.StatusMethodNotAllowed},
+		{name: "invalid", method: http.MethodPost, body: "{", code: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(test.method, "/simulate"+test.query, strings.NewReader(test.body)))
+			if rec.Code != test.code {
+				t.Fatalf("code = %d, want %d: %s", rec.Code, test.code, rec.Body)
+			}
+			if test.contentType != "" && rec.Header().Get("Content-Type") != test.contentType {
+				t.Errorf("content type = %q, want %q", rec.Header().Get("Content-Type"), test.contentType)
+			}
+			if test.decisions == nil {
+				return
+			}
+			var response struct {
+				Items []simulation `json:"items"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if len(response.Items) != len(test.decisions) {
+				t.Fatalf("%d simulations, want %d: %s", len(response.Items), len(test.decisions), rec.Body)
+			}
+			for i, sim := range response.Items {
+				if !strings.HasPrefix(sim.Decision, test.decisions[i]) {
+					t.Errorf("%s: decision %q, want %q", sim.Object, sim.Decision, test.decisions[i])
+				}
+				if (sim.Mutated != nil) != test.mutated[i] {
+					t.Errorf("%s: mutated %s, want mutated %v", sim.Object, sim.Mutated, test.mutated[i])
+				}
+				injected := strings.Contains(string(sim.Mutated), https.UnderlayIPResource)
+				if want := strings.HasPrefix(test.decisions[i], "inject"); injected != want {
+					t.Errorf("%s: mutated %s, want eni-ip %v", sim.Object, sim.Mutated, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/client"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/events"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/health"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/metrics"
+	"github.com/qyzhaoxun/add-pod-eni-ip-limit-webhook/pkg/watchdog"
+
+	"github.com/golang/glog"
+)
+
+// certExpiryMargin is how long before the serving certificate expires the
+// self check fails, so that the watchdog flips failure policies before the
+// apiserver rejects the certificate.
+const certExpiryMargin = 5 * time.Minute
+
+// selfCheck returns whether the webhook serves on its own port, which is
+// what the apiserver calls through the service, with a certificate the
+// apiserver accepts: valid against caFile for serverName and not expiring
+// within certExpiryMargin.
+func selfCheck(caFile, serverName string) func() bool {
+	return func() bool {
+		// caFile is read every time to follow rotations of a mounted bundle
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			glog.Warningf("Self check failed: %v", err)
+			return false
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(ca) {
+			glog.Warningf("Self check failed: no certificate found in %s", caFile)
+			return false
+		}
+		c := &http.Client{
+			Timeout: 5 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: serverName},
+			},
+		}
+		resp, err := c.Get("https://127.0.0.1:443/healthz")
+		if err != nil {
+			glog.Warningf("Self check failed: %v", err)
+			return false
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			glog.Warningf("Self check failed: /healthz returns %s", resp.Status)
+			return false
+		}
+		if cert := resp.TLS.PeerCertificates[0]; time.Until(cert.NotAfter) < certExpiryMargin {
+			glog.Warningf("Self check failed: serving certificate expires at %s", cert.NotAfter.Format(time.RFC3339))
+			return false
+		}
+		return true
+	}
+}
+
+// runHeartbeat renews the heartbeat lease while the webhook serves, the
+// watchdog flips the failure policy once no replica does.
+func runHeartbeat(wh *webhook, stopCh <-chan struct{}) {
+	if config.HeartbeatLeaseName == "" {
+		return
+	}
+	identity, err := os.Hostname()
+	if err != nil {
+		glog.Fatalf("Failed to get hostname: %v", err)
+	}
+	serverName := config.HeartbeatServerName
+	if serverName == "" {
+		serverName = fmt.Sprintf("add-pod-eni-ip-limit-webhook.%s.svc", config.LeaderElectNamespace)
+	}
+	healthy := selfCheck(config.HeartbeatCAFile, serverName)
+	go watchdog.Heartbeat(wh.client, config.LeaderElectNamespace, config.HeartbeatLeaseName, identity, config.HeartbeatPeriod, healthy, stopCh)
+}
+
+// watchdogCommand flips failure policies of the webhook configuration to
+// Ignore while no webhook replica renews the heartbeat lease, and restores
+// them once one does. It runs until terminated.
+func watchdogCommand(args []string) int {
+	fs := flag.NewFlagSet("watchdog", flag.ExitOnError)
+	opts := watchdog.Options{
+		LeaseNamespace: config.LeaderElectNamespace,
+		LeaseName:      defaultHeartbeatLeaseName,
+		Configuration:  "add-pod-eni-ip-limit-webhook",
+		StaleAfter:     time.Minute,
+		Period:         10 * time.Second,
+	}
+	var listen string
+	fs.StringVar(&opts.LeaseNamespace, "lease-namespace", opts.LeaseNamespace, "Namespace of the heartbeat lease, defaults to $POD_NAMESPACE or kube-system.")
+	fs.StringVar(&opts.LeaseName, "lease-name", opts.LeaseName, "Name of the heartbeat lease renewed by webhook replicas, see --heartbeat-lease-name of the webhook.")
+	fs.StringVar(&opts.Configuration, "webhook-configuration", opts.Configuration, "Name of the MutatingWebhookConfiguration whose failure policies are flipped.")
+	fs.DurationVar(&opts.StaleAfter, "stale-after", opts.StaleAfter, "How long the lease may go without renewal before failure policies are flipped to Ignore.")
+	fs.DurationVar(&opts.Period, "period", opts.Period, "How often the lease is checked.")
+	fs.StringVar(&listen, "listen", ":8080", "Address serving /healthz and /metrics, empty disables it.")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [webhook flags] watchdog [flags]\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Webhook flags like --kubeconfig decide how to reach the cluster.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if opts.StaleAfter <= opts.Period {
+		fmt.Fprintln(os.Stderr, "stale-after must be longer than period")
+		return 2
+	}
+
+	if listen != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/healthz", health.Healthz)
+		mux.Handle("/metrics", metrics.Handler())
+		go func() {
+			glog.Fatal(http.ListenAndServe(listen, mux))
+		}()
+	}
+
+	stopCh := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		close(stopCh)
+	}()
+	cs, err := client.GetKubeClient(config.InCluster, config.Master, config.KubeConfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to get kube client: %v\n", err)
+		return 1
+	}
+	watchdog.New(cs, events.NewRecorder(cs, "add-pod-eni-ip-limit-webhook-watchdog"), opts).Run(stopCh)
+	return 0
+}